@@ -0,0 +1,23 @@
+//go:build !unix
+
+package shell
+
+import "os"
+
+// Access modes of the file tests of test and [[.
+const (
+	accessRead    = 4
+	accessWrite   = 2
+	accessExecute = 1
+)
+
+// accessible reports whether path has a permission bit for mode, without
+// access(2) to tell which of them apply to the shell.
+func accessible(path string, mode uint32) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	perm := uint32(info.Mode().Perm())
+	return perm&(mode<<6|mode<<3|mode) != 0
+}
@@ -0,0 +1,18 @@
+//go:build unix
+
+package shell
+
+import "golang.org/x/sys/unix"
+
+// Access modes of the file tests of test and [[.
+const (
+	accessRead    = unix.R_OK
+	accessWrite   = unix.W_OK
+	accessExecute = unix.X_OK
+)
+
+// accessible reports whether the shell may access path in mode, as
+// access(2) decides with the real user and group.
+func accessible(path string, mode uint32) bool {
+	return unix.Access(path, mode) == nil
+}
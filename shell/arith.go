@@ -0,0 +1,593 @@
+package shell
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Arithmetic follows the shell's integer arithmetic: 64-bit signed integers
+// with the C operators and precedence, ** for powers and variables read by
+// name. A variable that is unset or empty is 0; one holding an expression is
+// evaluated in turn.
+
+// maxArithDepth limits how deep variables holding expressions may nest, so
+// that x=x does not recurse forever.
+const maxArithDepth = 64
+
+// arithOperators are the operators of arithmetic, longest first so that the
+// tokenizer picks "<<=" over "<<" and "<".
+var arithOperators = []string{
+	"<<=", ">>=",
+	"**", "++", "--", "+=", "-=", "*=", "/=", "%=", "&=", "^=", "|=",
+	"<<", ">>", "<=", ">=", "==", "!=", "&&", "||",
+	"+", "-", "*", "/", "%", "<", ">", "=", "!", "~", "&", "^", "|", "?", ":", "(", ")", ",",
+}
+
+// arithPrecedence is the precedence of the binary operators, higher binding
+// tighter. Assignment, ?: and the comma are handled separately.
+var arithPrecedence = map[string]int{
+	"||": 1,
+	"&&": 2,
+	"|":  3,
+	"^":  4,
+	"&":  5,
+	"==": 6, "!=": 6,
+	"<": 7, "<=": 7, ">": 7, ">=": 7,
+	"<<": 8, ">>": 8,
+	"+": 9, "-": 9,
+	"*": 10, "/": 10, "%": 10,
+	"**": 11,
+}
+
+// arithAssignments are the assignment operators.
+var arithAssignments = map[string]bool{
+	"=": true, "+=": true, "-=": true, "*=": true, "/=": true, "%=": true,
+	"<<=": true, ">>=": true, "&=": true, "^=": true, "|=": true,
+}
+
+// arithToken is an operator, a number or a variable name; all are empty at
+// the end of the expression.
+type arithToken struct {
+	op    string
+	num   int64
+	isNum bool
+	name  string
+}
+
+// operand is the value of a subexpression; name is set when it is a bare
+// variable and so can be assigned to.
+type operand struct {
+	value int64
+	name  string
+}
+
+type arith struct {
+	in    *Interpreter
+	expr  string
+	pos   int
+	tok   arithToken
+	depth int
+	// skip is non-zero in the branches that && || and ?: do not take, which
+	// are parsed without assigning or failing on a division by zero.
+	skip int
+}
+
+// arithmetic evaluates an arithmetic expression, as in $(( expr )) or let.
+// Assignments in it set shell variables.
+func (in *Interpreter) arithmetic(expr string) (int64, error) {
+	v, err := in.evalArith(expr, 0)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", strings.TrimSpace(expr), err)
+	}
+	return v, nil
+}
+
+func (in *Interpreter) evalArith(expr string, depth int) (int64, error) {
+	if depth > maxArithDepth {
+		return 0, errors.New("expression recursion level exceeded")
+	}
+	if strings.TrimSpace(expr) == "" {
+		return 0, nil
+	}
+	a := &arith{in: in, expr: expr, depth: depth}
+	if err := a.next(); err != nil {
+		return 0, err
+	}
+	v, err := a.comma()
+	if err != nil {
+		return 0, err
+	}
+	if !a.atEnd() {
+		return 0, fmt.Errorf("syntax error in expression near %q", a.tokenText())
+	}
+	return v.value, nil
+}
+
+func (a *arith) atEnd() bool {
+	return a.tok == arithToken{}
+}
+
+// tokenText returns the current token as written, for error messages.
+func (a *arith) tokenText() string {
+	switch {
+	case a.tok.op != "":
+		return a.tok.op
+	case a.tok.name != "":
+		return a.tok.name
+	default:
+		return strconv.FormatInt(a.tok.num, 10)
+	}
+}
+
+// next reads the following token into a.tok.
+func (a *arith) next() error {
+	for a.pos < len(a.expr) && strings.IndexByte(" \t\n", a.expr[a.pos]) >= 0 {
+		a.pos++
+	}
+	a.tok = arithToken{}
+	if a.pos >= len(a.expr) {
+		return nil
+	}
+	rest := a.expr[a.pos:]
+	c := rest[0]
+	switch {
+	case '0' <= c && c <= '9':
+		n := 0
+		for n < len(rest) && (isWordByte(rest[n]) || rest[n] == '#') {
+			n++
+		}
+		num, err := parseArithNumber(rest[:n])
+		if err != nil {
+			return err
+		}
+		a.tok.num, a.tok.isNum = num, true
+		a.pos += n
+		return nil
+	case c == '$':
+		name, n := varReference(rest[1:])
+		if n == 0 {
+			return fmt.Errorf("syntax error: invalid variable %q", rest)
+		}
+		a.tok.name = name
+		a.pos += 1 + n
+		return nil
+	case c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z':
+		name, n := varReference(rest)
+		a.tok.name = name
+		a.pos += n
+		return nil
+	}
+	for _, op := range arithOperators {
+		if strings.HasPrefix(rest, op) {
+			a.tok.op = op
+			a.pos += len(op)
+			return nil
+		}
+	}
+	return fmt.Errorf("syntax error: invalid character %q", c)
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9'
+}
+
+// parseArithNumber parses a decimal number, a hexadecimal one starting with
+// 0x, an octal one starting with 0, or base#digits for bases 2 to 36.
+func parseArithNumber(s string) (int64, error) {
+	if base, digits, ok := strings.Cut(s, "#"); ok {
+		b, err := strconv.Atoi(base)
+		if err != nil || b < 2 || b > 36 {
+			return 0, fmt.Errorf("%s: invalid arithmetic base", s)
+		}
+		n, err := strconv.ParseInt(digits, b, 64)
+		if err != nil {
+			return 0, fmt.Errorf("%s: value too great for base", s)
+		}
+		return n, nil
+	}
+	base := 10
+	switch {
+	case strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X"):
+		base, s = 16, s[2:]
+	case len(s) > 1 && s[0] == '0':
+		base, s = 8, s[1:]
+	}
+	n, err := strconv.ParseInt(s, base, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s: invalid number", s)
+	}
+	return n, nil
+}
+
+// expect consumes the operator op or fails.
+func (a *arith) expect(op string) error {
+	if a.tok.op != op {
+		if a.atEnd() {
+			return fmt.Errorf("syntax error: %q expected", op)
+		}
+		return fmt.Errorf("syntax error: %q expected near %q", op, a.tokenText())
+	}
+	return a.next()
+}
+
+// comma parses expr, expr, ... and returns the last value.
+func (a *arith) comma() (operand, error) {
+	v, err := a.assignment()
+	for err == nil && a.tok.op == "," {
+		if err = a.next(); err == nil {
+			v, err = a.assignment()
+		}
+	}
+	return v, err
+}
+
+// assignment parses name = expr and the compound assignments like +=, which
+// are right associative, and falls back to a conditional expression.
+func (a *arith) assignment() (operand, error) {
+	left, err := a.conditional()
+	if err != nil {
+		return left, err
+	}
+	op := a.tok.op
+	if !arithAssignments[op] {
+		return left, nil
+	}
+	if left.name == "" {
+		return left, errors.New("attempted assignment to non-variable")
+	}
+	if err := a.next(); err != nil {
+		return left, err
+	}
+	right, err := a.assignment()
+	if err != nil {
+		return left, err
+	}
+	value := right.value
+	if op != "=" {
+		if value, err = a.apply(strings.TrimSuffix(op, "="), left.value, right.value); err != nil {
+			return left, err
+		}
+	}
+	return operand{value: value}, a.set(left.name, value)
+}
+
+// conditional parses cond ? expr : expr.
+func (a *arith) conditional() (operand, error) {
+	cond, err := a.binary(1)
+	if err != nil || a.tok.op != "?" {
+		return cond, err
+	}
+	if err := a.next(); err != nil {
+		return cond, err
+	}
+
+	if cond.value == 0 {
+		a.skip++
+	}
+	then, err := a.comma()
+	if cond.value == 0 {
+		a.skip--
+	}
+	if err != nil {
+		return then, err
+	}
+	if err := a.expect(":"); err != nil {
+		return then, err
+	}
+
+	if cond.value != 0 {
+		a.skip++
+	}
+	otherwise, err := a.conditional()
+	if cond.value != 0 {
+		a.skip--
+	}
+	if err != nil {
+		return otherwise, err
+	}
+	if cond.value != 0 {
+		return operand{value: then.value}, nil
+	}
+	return operand{value: otherwise.value}, nil
+}
+
+// binary parses the binary operators of precedence minPrec and higher.
+func (a *arith) binary(minPrec int) (operand, error) {
+	left, err := a.unary()
+	if err != nil {
+		return left, err
+	}
+	for {
+		op := a.tok.op
+		prec, ok := arithPrecedence[op]
+		if !ok || prec < minPrec {
+			return left, nil
+		}
+		if err := a.next(); err != nil {
+			return left, err
+		}
+
+		// The right operand of && and || is only evaluated when needed.
+		short := (op == "&&" && left.value == 0) || (op == "||" && left.value != 0)
+		if short {
+			a.skip++
+		}
+		next := prec + 1
+		if op == "**" {
+			next = prec
+		}
+		right, err := a.binary(next)
+		if short {
+			a.skip--
+		}
+		if err != nil {
+			return right, err
+		}
+
+		var value int64
+		switch op {
+		case "&&":
+			value = boolValue(left.value != 0 && right.value != 0)
+		case "||":
+			value = boolValue(left.value != 0 || right.value != 0)
+		default:
+			if value, err = a.apply(op, left.value, right.value); err != nil {
+				return left, err
+			}
+		}
+		left = operand{value: value}
+	}
+}
+
+// apply computes a binary operator other than && and ||.
+func (a *arith) apply(op string, x, y int64) (int64, error) {
+	switch op {
+	case "+":
+		return x + y, nil
+	case "-":
+		return x - y, nil
+	case "*":
+		return x * y, nil
+	case "/", "%":
+		if y == 0 {
+			if a.skip > 0 {
+				return 0, nil
+			}
+			return 0, errors.New("division by zero")
+		}
+		if op == "/" {
+			return x / y, nil
+		}
+		return x % y, nil
+	case "**":
+		if y < 0 {
+			return 0, errors.New("exponent less than 0")
+		}
+		result := int64(1)
+		for ; y > 0; y >>= 1 {
+			if y&1 == 1 {
+				result *= x
+			}
+			x *= x
+		}
+		return result, nil
+	case "<<":
+		return x << (uint64(y) & 63), nil
+	case ">>":
+		return x >> (uint64(y) & 63), nil
+	case "&":
+		return x & y, nil
+	case "^":
+		return x ^ y, nil
+	case "|":
+		return x | y, nil
+	case "==":
+		return boolValue(x == y), nil
+	case "!=":
+		return boolValue(x != y), nil
+	case "<":
+		return boolValue(x < y), nil
+	case "<=":
+		return boolValue(x <= y), nil
+	case ">":
+		return boolValue(x > y), nil
+	case ">=":
+		return boolValue(x >= y), nil
+	}
+	return 0, fmt.Errorf("syntax error: unexpected %q", op)
+}
+
+func boolValue(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// unary parses the prefix operators, then a primary with its postfix ++ or
+// --.
+func (a *arith) unary() (operand, error) {
+	switch op := a.tok.op; op {
+	case "+", "-", "!", "~":
+		if err := a.next(); err != nil {
+			return operand{}, err
+		}
+		v, err := a.unary()
+		if err != nil {
+			return v, err
+		}
+		switch op {
+		case "-":
+			v.value = -v.value
+		case "!":
+			v.value = boolValue(v.value == 0)
+		case "~":
+			v.value = ^v.value
+		}
+		return operand{value: v.value}, nil
+	case "++", "--":
+		if err := a.next(); err != nil {
+			return operand{}, err
+		}
+		v, err := a.unary()
+		if err != nil {
+			return v, err
+		}
+		if v.name == "" {
+			return v, fmt.Errorf("%s: operand is not a variable", op)
+		}
+		value := v.value + 1
+		if op == "--" {
+			value = v.value - 1
+		}
+		return operand{value: value}, a.set(v.name, value)
+	}
+
+	v, err := a.primary()
+	if err != nil {
+		return v, err
+	}
+	if op := a.tok.op; (op == "++" || op == "--") && v.name != "" {
+		if err := a.next(); err != nil {
+			return v, err
+		}
+		value := v.value + 1
+		if op == "--" {
+			value = v.value - 1
+		}
+		return operand{value: v.value}, a.set(v.name, value)
+	}
+	return v, nil
+}
+
+// primary parses a number, a variable or a parenthesized expression.
+func (a *arith) primary() (operand, error) {
+	switch {
+	case a.tok.name != "":
+		name := a.tok.name
+		value, err := a.get(name)
+		if err != nil {
+			return operand{}, err
+		}
+		return operand{value: value, name: name}, a.next()
+	case a.tok.op == "(":
+		if err := a.next(); err != nil {
+			return operand{}, err
+		}
+		v, err := a.comma()
+		if err != nil {
+			return v, err
+		}
+		return operand{value: v.value}, a.expect(")")
+	case a.tok.isNum:
+		v := a.tok.num
+		return operand{value: v}, a.next()
+	case a.atEnd():
+		return operand{}, errors.New("syntax error: operand expected")
+	}
+	return operand{}, fmt.Errorf("syntax error: operand expected near %q", a.tok.op)
+}
+
+// get returns the value of a variable.
+func (a *arith) get(name string) (int64, error) {
+	value, ok := a.in.LookupEnv(name)
+	if !ok && a.skip == 0 && a.in.Option("nounset") {
+		return 0, fmt.Errorf("%s: unbound variable", name)
+	}
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, nil
+	}
+	if n, err := parseArithNumber(value); err == nil {
+		return n, nil
+	}
+	if a.skip > 0 {
+		return 0, nil
+	}
+	return a.in.evalArith(value, a.depth+1)
+}
+
+// set assigns a variable, unless in a branch that is not taken.
+func (a *arith) set(name string, value int64) error {
+	if a.skip > 0 {
+		return nil
+	}
+	return a.in.assign(name, strconv.FormatInt(value, 10))
+}
+
+// arithCommand returns the expression of a (( expr )) command, which
+// splitArgs keeps as a single word. In ((a) + (b)) the inner parentheses
+// belong to the expression.
+func arithCommand(word string) (string, bool) {
+	if len(word) < 4 || !strings.HasPrefix(word, "((") || !strings.HasSuffix(word, "))") ||
+		closingParen(word) != len(word) {
+		return "", false
+	}
+	if closingParen(word[1:]) == len(word)-2 {
+		return word[2 : len(word)-2], true
+	}
+	return word[1 : len(word)-1], true
+}
+
+// runArith runs (( expr )) or let: the status is 0 when the value is not 0,
+// 1 when it is 0 or the expression is invalid.
+func runArith(env *Env, cmd string, exprs []string) int {
+	var v int64
+	for _, expr := range exprs {
+		var err error
+		if v, err = env.Shell.arithmetic(expr); err != nil {
+			fmt.Fprintf(env.Stderr, "%s: %v\n", cmd, err)
+			return 1
+		}
+	}
+	if v == 0 {
+		return 1
+	}
+	return 0
+}
+
+// let expr ...
+func handleLet(env *Env, args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(env.Stderr, "let: expression expected")
+		return 1
+	}
+	return runArith(env, "let", args)
+}
+
+// arithExpansion returns the expression and length of the $(( expr )) at the
+// start of s, or a length of 0 if the parentheses do not match.
+func arithExpansion(s string) (string, int) {
+	if !strings.HasPrefix(s, "$((") {
+		return "", 0
+	}
+	n := closingParen(s[1:])
+	if n == 0 {
+		return "", 0
+	}
+	expr, ok := arithCommand(s[1 : 1+n])
+	if !ok {
+		return "", 0
+	}
+	return expr, 1 + n
+}
+
+// closingParen returns the length of the parenthesized text at the start of
+// s, or 0 if it is not closed.
+func closingParen(s string) int {
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return i + 1
+			}
+		}
+	}
+	return 0
+}
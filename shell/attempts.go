@@ -0,0 +1,152 @@
+package shell
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// loginLimits controls how failed logins are throttled. After every
+// consecutive failure the next attempt is delayed by backoff, doubling each
+// time; after maxAttempts failures the account is locked for lockout. Failures
+// older than lockout are forgotten. The limits are read from the environment:
+//
+//	GOSH_LOGIN_MAX_ATTEMPTS   failures before lockout (default 5)
+//	GOSH_LOGIN_BACKOFF        initial delay after a failure (default 1s)
+//	GOSH_LOGIN_LOCKOUT        lockout duration (default 15m)
+type loginLimits struct {
+	maxAttempts int
+	backoff     time.Duration
+	lockout     time.Duration
+}
+
+var defaultLoginLimits = loginLimits{
+	maxAttempts: 5,
+	backoff:     time.Second,
+	lockout:     15 * time.Minute,
+}
+
+func loadLoginLimits() (loginLimits, error) {
+	limits := defaultLoginLimits
+
+	if v := os.Getenv("GOSH_LOGIN_MAX_ATTEMPTS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return limits, fmt.Errorf("GOSH_LOGIN_MAX_ATTEMPTS: invalid number %q", v)
+		}
+		limits.maxAttempts = n
+	}
+	if v := os.Getenv("GOSH_LOGIN_BACKOFF"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return limits, fmt.Errorf("GOSH_LOGIN_BACKOFF: invalid duration %q", v)
+		}
+		limits.backoff = d
+	}
+	if v := os.Getenv("GOSH_LOGIN_LOCKOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return limits, fmt.Errorf("GOSH_LOGIN_LOCKOUT: invalid duration %q", v)
+		}
+		limits.lockout = d
+	}
+	return limits, nil
+}
+
+// wait returns how long username has to wait before another login attempt is
+// allowed. Attempts are tracked for every username, existing or not, so the
+// answer does not reveal which accounts exist.
+func (l loginLimits) wait(db *sql.DB, username string, now time.Time) (time.Duration, error) {
+	rows, err := db.Query(`
+		SELECT attempted_at
+		FROM login_attempts
+		WHERE username = ? AND success = 0
+		  AND id > COALESCE((SELECT MAX(id) FROM login_attempts WHERE username = ? AND success = 1), 0)
+		ORDER BY id DESC
+	`, username, username)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var failures int
+	var latest time.Time
+	for rows.Next() {
+		var at time.Time
+		if err := rows.Scan(&at); err != nil {
+			return 0, err
+		}
+		if now.Sub(at) > l.lockout {
+			break
+		}
+		if failures == 0 {
+			latest = at
+		}
+		failures++
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if failures == 0 {
+		return 0, nil
+	}
+
+	delay := l.lockout
+	if failures < l.maxAttempts {
+		delay = l.backoff << (failures - 1)
+		if delay > l.lockout || delay < 0 {
+			delay = l.lockout
+		}
+	}
+	return max(latest.Add(delay).Sub(now), 0), nil
+}
+
+func recordLoginAttempt(db *sql.DB, username string, success bool, now time.Time) error {
+	_, err := db.Exec("INSERT INTO login_attempts (username, success, attempted_at) VALUES (?, ?, ?)",
+		username, success, now.UTC())
+	return err
+}
+
+// errIncorrectPassword is returned by confirmPassword for a wrong password.
+var errIncorrectPassword = errors.New("incorrect password")
+
+// confirmPassword checks the password of username for commands that ask for
+// it again, such as passwd. Like a login, it is refused while the account is
+// throttled, and a wrong password counts as a failed attempt.
+func (in *Interpreter) confirmPassword(username, password string) error {
+	now := time.Now()
+	wait, err := in.limits.wait(in.db, username, now)
+	if err != nil {
+		return err
+	}
+	if wait > 0 {
+		return fmt.Errorf("too many failed attempts, try again in %v", wait.Round(time.Second))
+	}
+	if err := verifyPassword(in.db, username, password); err != nil {
+		if err := recordLoginAttempt(in.db, username, false, now); err != nil {
+			return err
+		}
+		return errIncorrectPassword
+	}
+	return nil
+}
+
+// lastLogin returns the time of the most recent successful login of username.
+func lastLogin(db *sql.DB, username string) (time.Time, bool, error) {
+	var at time.Time
+	err := db.QueryRow(`
+		SELECT attempted_at FROM login_attempts
+		WHERE username = ? AND success = 1
+		ORDER BY id DESC LIMIT 1
+	`, username).Scan(&at)
+	if err == sql.ErrNoRows {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return at, true, nil
+}
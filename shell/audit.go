@@ -0,0 +1,82 @@
+package shell
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// audit appends an entry to the audit log. actor is the user running the
+// command ("" for guests) and target what the action applied to. Failures to
+// write the log are reported but never stop the command itself.
+func (in *Interpreter) audit(actor, action, target string, success bool, detail string) {
+	_, err := in.db.Exec(`INSERT INTO audit_log (at, username, action, target, success, detail)
+		VALUES (?, ?, ?, ?, ?, ?)`, time.Now().UTC(), actor, action, target, success, detail)
+	if err != nil {
+		fmt.Fprintf(in.stderr, "Failed to write audit log: %v\n", err)
+	}
+}
+
+// handleAudit prints audit log entries, newest first.
+//
+//	audit [-n count] [-u user] [-a action]
+func handleAudit(env *Env, args []string) int {
+	limit := 20
+	user, action := "", ""
+	for i := 0; i < len(args); i++ {
+		if i+1 >= len(args) {
+			fmt.Fprintln(env.Stderr, "audit: invalid arguments")
+			return 1
+		}
+		switch args[i] {
+		case "-n":
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil || n <= 0 {
+				fmt.Fprintf(env.Stderr, "audit: invalid count %s\n", args[i+1])
+				return 1
+			}
+			limit = n
+		case "-u":
+			user = args[i+1]
+		case "-a":
+			action = args[i+1]
+		default:
+			fmt.Fprintf(env.Stderr, "audit: unknown option %s\n", args[i])
+			return 1
+		}
+		i++
+	}
+
+	rows, err := env.Shell.db.Query(`
+		SELECT at, username, action, target, success, detail
+		FROM audit_log
+		WHERE (? = '' OR username = ?) AND (? = '' OR action = ?)
+		ORDER BY id DESC
+		LIMIT ?
+	`, user, user, action, action, limit)
+	if err != nil {
+		fmt.Fprintf(env.Stderr, "audit: %v\n", err)
+		return 1
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var at time.Time
+		var actor, act, target, detail string
+		var success bool
+		if err := rows.Scan(&at, &actor, &act, &target, &success, &detail); err != nil {
+			fmt.Fprintf(env.Stderr, "audit: %v\n", err)
+			continue
+		}
+		if actor == "" {
+			actor = "-"
+		}
+		result := "ok"
+		if !success {
+			result = "FAILED"
+		}
+		line := fmt.Sprintf("%s  %-12s %-14s %-12s %-6s %s", at.Local().Format(time.DateTime), actor, act, target, result, detail)
+		fmt.Fprintln(env.Stdout, line)
+	}
+	return 0
+}
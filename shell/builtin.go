@@ -0,0 +1,185 @@
+package shell
+
+import (
+	"bufio"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Builtin is a command implemented inside the shell. Run receives the
+// arguments without the command name and returns the exit status. Help
+// returns the usage text; its first line is a one-line synopsis.
+type Builtin interface {
+	Name() string
+	Help() string
+	Run(env *Env, args []string) int
+}
+
+// Env is the environment a builtin runs in: its standard streams and the
+// interpreter whose state (user, variables, working directory) it may use.
+type Env struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+	Shell  *Interpreter
+	// pipeline is set for the commands of a pipeline of several, which run
+	// concurrently and so may not change the session.
+	pipeline bool
+}
+
+// Getenv returns the value of a shell variable.
+func (e *Env) Getenv(name string) string {
+	return e.Shell.Getenv(name)
+}
+
+// Path resolves name against the shell's working directory.
+func (e *Env) Path(name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(e.Shell.Dir(), name)
+}
+
+// ReadLine reads a line from the builtin's input, without the newline. It
+// never reads past the line, so whatever follows is left for the next reader,
+// which matters when the input is the shell's own. io.EOF is returned only
+// when there was nothing left to read.
+func (e *Env) ReadLine() (string, error) {
+	if br, ok := e.Stdin.(*bufio.Reader); ok {
+		line, err := br.ReadString('\n')
+		if err == io.EOF && line != "" {
+			err = nil
+		}
+		return strings.TrimSuffix(line, "\n"), err
+	}
+
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		n, err := e.Stdin.Read(b)
+		if n == 1 {
+			if b[0] == '\n' {
+				return string(line), nil
+			}
+			line = append(line, b[0])
+		}
+		if err == io.EOF && len(line) > 0 {
+			return string(line), nil
+		}
+		if err != nil {
+			return string(line), err
+		}
+	}
+}
+
+type builtinFunc struct {
+	name string
+	help string
+	run  func(env *Env, args []string) int
+}
+
+func (b builtinFunc) Name() string                    { return b.name }
+func (b builtinFunc) Help() string                    { return b.help }
+func (b builtinFunc) Run(env *Env, args []string) int { return b.run(env, args) }
+
+// NewBuiltin turns a function into a Builtin.
+func NewBuiltin(name, help string, run func(env *Env, args []string) int) Builtin {
+	return builtinFunc{name: name, help: help, run: run}
+}
+
+// Registry holds the builtins known to an interpreter.
+type Registry struct {
+	builtins map[string]Builtin
+}
+
+func NewRegistry() *Registry {
+	return &Registry{builtins: make(map[string]Builtin)}
+}
+
+// Register adds b to the registry, replacing any builtin with the same name.
+func (r *Registry) Register(b Builtin) {
+	r.builtins[b.Name()] = b
+}
+
+// Unregister removes the builtin called name, if any.
+func (r *Registry) Unregister(name string) {
+	delete(r.builtins, name)
+}
+
+func (r *Registry) Lookup(name string) (Builtin, bool) {
+	b, ok := r.builtins[name]
+	return b, ok
+}
+
+// Names returns the names of all registered builtins in sorted order.
+func (r *Registry) Names() []string {
+	names := make([]string, 0, len(r.builtins))
+	for name := range r.builtins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// DefaultRegistry returns a registry with every builtin of the shell.
+func DefaultRegistry() *Registry {
+	builtin := func(name string, run func(env *Env, args []string) int) Builtin {
+		return NewBuiltin(name, builtinHelp[name], run)
+	}
+
+	r := NewRegistry()
+	for _, b := range []Builtin{
+		builtin("help", handleHelp),
+		builtin("exit", handleExit),
+		builtin("echo", handleEcho),
+		builtin("printf", handlePrintf),
+		builtin("cat", handleCat),
+		builtin("grep", handleGrep),
+		builtin("head", handleHead),
+		builtin("tail", handleTail),
+		builtin("wc", handleWc),
+		builtin("sort", handleSort),
+		builtin("uniq", handleUniq),
+		builtin("type", handleType),
+		builtin("which", handleWhich),
+		builtin("hash", handleHash),
+		builtin("timeout", handleTimeout),
+		builtin("ulimit", handleUlimit),
+		builtin("pwd", handlePwd),
+		builtin("cd", handleCd),
+		builtin("export", handleExport),
+		builtin("read", handleRead),
+		builtin("let", handleLet),
+		builtin("test", handleTest),
+		builtin("[", handleBracket),
+		builtin("set", handleSet),
+		builtin("source", handleSource),
+		builtin(".", handleSource),
+		builtin("ls", handleLs),
+		builtin("mkdir", handleMkdir),
+		builtin("rm", handleRm),
+		builtin("cp", handleCp),
+		builtin("mv", handleMv),
+		builtin("touch", handleTouch),
+		builtin("stat", handleStat),
+		builtin("history", handleHistory),
+		builtin("login", handleLogin),
+		builtin("logout", handleLogout),
+		builtin("adduser", handleAddUser),
+		builtin("passwd", handlePasswd),
+		builtin("deluser", handleDelUser),
+		builtin("users", handleUsers),
+		builtin("whoami", handleWhoami),
+		builtin("role", handleRole),
+		builtin("perm", handlePerm),
+		builtin("last", handleLast),
+		builtin("audit", handleAudit),
+		builtin("record", handleRecord),
+		builtin("replay", handleReplay),
+	} {
+		r.Register(b)
+	}
+	return r
+}
@@ -0,0 +1,172 @@
+package shell
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+)
+
+// catOptions are the flags of cat. -A stands for showNonprinting, showEnds
+// and showTabs together.
+type catOptions struct {
+	number          bool // -n: number all lines
+	numberNonblank  bool // -b: number non-empty lines, overrides -n
+	squeeze         bool // -s: never print more than one empty line in a row
+	showNonprinting bool // -v: ^X and M-X notation for control and 8-bit bytes
+	showEnds        bool // -E: $ at the end of each line
+	showTabs        bool // -T: tabs as ^I
+}
+
+// catWriter applies the cat options to a stream of bytes. Its state carries
+// over from one file to the next, so numbering continues across files.
+type catWriter struct {
+	catOptions
+	w       *bufio.Writer
+	line    int
+	atStart bool
+	blank   bool // the previous line was empty
+}
+
+func (c *catWriter) write(p []byte) {
+	for _, b := range p {
+		if c.atStart {
+			if b == '\n' {
+				if c.squeeze && c.blank {
+					continue
+				}
+				c.blank = true
+				if c.number && !c.numberNonblank {
+					c.writeNumber()
+				}
+				c.writeNewline()
+				continue
+			}
+			if c.number || c.numberNonblank {
+				c.writeNumber()
+			}
+			c.blank = false
+			c.atStart = false
+		}
+		if b == '\n' {
+			c.writeNewline()
+			c.atStart = true
+			continue
+		}
+		c.writeByte(b)
+	}
+}
+
+func (c *catWriter) writeNumber() {
+	c.line++
+	fmt.Fprintf(c.w, "%6d\t", c.line)
+}
+
+func (c *catWriter) writeNewline() {
+	if c.showEnds {
+		c.w.WriteByte('$')
+	}
+	c.w.WriteByte('\n')
+}
+
+func (c *catWriter) writeByte(b byte) {
+	switch {
+	case b == '\t':
+		if c.showTabs {
+			c.w.WriteString("^I")
+			return
+		}
+	case !c.showNonprinting:
+	case b >= 128:
+		c.w.WriteString("M-")
+		c.writeByte(b - 128)
+		return
+	case b < 32:
+		c.w.Write([]byte{'^', b + 64})
+		return
+	case b == 127:
+		c.w.WriteString("^?")
+		return
+	}
+	c.w.WriteByte(b)
+}
+
+// copy streams r through the options in chunks, flushing after every chunk
+// so that output keeps up with slow input such as a terminal or a pipe.
+func (c *catWriter) copy(r io.Reader) error {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			c.write(buf[:n])
+			if err := c.w.Flush(); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// handleCat copies files, or its input for "-" and when no file is given,
+// to its output.
+//
+//	cat [-nbsAvET] [file ...]
+func handleCat(env *Env, args []string) int {
+	flags, args, err := getopt(args, "nbsAvET")
+	if err != nil {
+		fmt.Fprintf(env.Stderr, "cat: %v\n", err)
+		return 1
+	}
+	all := flags.has('A')
+	opts := catOptions{
+		number:          flags.has('n'),
+		numberNonblank:  flags.has('b'),
+		squeeze:         flags.has('s'),
+		showNonprinting: all || flags.has('v'),
+		showEnds:        all || flags.has('E'),
+		showTabs:        all || flags.has('T'),
+	}
+	if len(args) == 0 {
+		args = []string{"-"}
+	}
+
+	// Without options the data is copied as is, which lets io.Copy use the
+	// fastest path available, such as splice between files and pipes.
+	plain := opts == catOptions{}
+	cw := &catWriter{catOptions: opts, w: bufio.NewWriter(env.Stdout), atStart: true}
+
+	status := 0
+	for _, name := range args {
+		var r io.Reader = env.Stdin
+		var f *os.File
+		if name != "-" {
+			var err error
+			if f, err = os.Open(env.Path(name)); err != nil {
+				fmt.Fprintf(env.Stderr, "cat: %v\n", err)
+				status = 1
+				continue
+			}
+			r = f
+		}
+
+		var err error
+		if plain {
+			_, err = io.Copy(env.Stdout, r)
+		} else {
+			err = cw.copy(r)
+		}
+		if f != nil {
+			f.Close()
+		}
+		if err != nil {
+			fmt.Fprintf(env.Stderr, "cat: %s: %v\n", name, err)
+			status = 1
+		}
+	}
+	return status
+}
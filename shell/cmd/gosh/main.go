@@ -0,0 +1,110 @@
+// Command gosh is the interactive shell built on package main/shell. Given a
+// script file it runs the script instead, and with -listen it serves shell
+// sessions over a Unix socket or TCP.
+//
+//	gosh [flags] [script]
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"main/shell"
+)
+
+func main() {
+	shell.ExecLimited()
+
+	dbFlag := flag.String("db", "", "path to the shell database (defaults to $GOSH_DB, then ./shell.db)")
+	restricted := flag.Bool("r", false, "restricted mode: confine cd and the file builtins to the working directory, forbid changing PATH, output redirection and commands named by path")
+	listen := flag.String("listen", "", "serve sessions on `addr`, unix:path or [tcp:]host:port, instead of the terminal")
+	jsonOutput := flag.Bool("json", false, "make builtins such as ls, history and type print JSON records, like set -o json")
+	record := flag.String("record", "", "record the session to `file` in the asciicast v2 format")
+	flag.Parse()
+
+	db, err := shell.OpenDB(shell.DatabasePath(*dbFlag))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "database error: %v\n", err)
+		os.Exit(1)
+	}
+	cfg := shell.Config{DB: db, Restricted: *restricted}
+	if *jsonOutput {
+		cfg.Options = append(cfg.Options, "json")
+	}
+
+	if *listen != "" {
+		os.Exit(serve(*listen, cfg))
+	}
+
+	in, err := shell.New(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		db.Close()
+		os.Exit(1)
+	}
+	if *record != "" {
+		f, err := os.Create(*record)
+		if err == nil {
+			err = in.StartRecording(f, "")
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "record: %v\n", err)
+			db.Close()
+			os.Exit(1)
+		}
+	}
+
+	var code int
+	if script := flag.Arg(0); script != "" {
+		code = runScript(in, script)
+	} else {
+		code = in.Run()
+	}
+	db.Close()
+	os.Exit(code)
+}
+
+// runScript runs the command lines of a script file and ends the session.
+func runScript(in *shell.Interpreter, path string) int {
+	defer in.Close()
+	f, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 127
+	}
+	defer f.Close()
+	return in.RunScript(f)
+}
+
+// serve runs a shell server until it is interrupted or terminated.
+func serve(addr string, cfg shell.Config) int {
+	defer cfg.DB.Close()
+
+	l, err := shell.Listen(addr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	srv := &shell.Server{Config: cfg}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		srv.Close()
+	}()
+
+	fmt.Fprintf(os.Stderr, "serving shell sessions on %s\n", l.Addr())
+	if err := srv.Serve(l); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		srv.Close()
+		return 1
+	}
+	// Serve returns as soon as the listener is closed; Close also waits for
+	// the sessions to be recorded as ended.
+	srv.Close()
+	return 0
+}
@@ -0,0 +1,370 @@
+package shell
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Conditions are evaluated by test and [ on their arguments, and by the
+// [[ ]] keyword on the words between the brackets. Within [[ ]] the words
+// are expanded only when needed, && and || replace -a and -o, the right side
+// of == and != is a pattern unless quoted, =~ matches a regular expression
+// and the operands of integer comparisons are arithmetic expressions.
+
+// fileTests are the unary operators testing a file.
+var fileTests = map[string]func(info os.FileInfo, path string) bool{
+	"-e": func(info os.FileInfo, path string) bool { return true },
+	"-f": func(info os.FileInfo, path string) bool { return info.Mode().IsRegular() },
+	"-d": func(info os.FileInfo, path string) bool { return info.IsDir() },
+	"-s": func(info os.FileInfo, path string) bool { return info.Size() > 0 },
+	"-r": func(info os.FileInfo, path string) bool { return accessible(path, accessRead) },
+	"-w": func(info os.FileInfo, path string) bool { return accessible(path, accessWrite) },
+	"-x": func(info os.FileInfo, path string) bool { return accessible(path, accessExecute) },
+}
+
+// binaryTests are the binary operators comparing strings or integers.
+var binaryTests = map[string]bool{
+	"=": true, "==": true, "!=": true, "<": true, ">": true,
+	"-eq": true, "-ne": true, "-lt": true, "-le": true, "-gt": true, "-ge": true,
+}
+
+type condition struct {
+	env   *Env
+	words []string
+	pos   int
+	// extended is set for [[ ]].
+	extended bool
+	// skip is non-zero in the operands && and || do not need, which are
+	// parsed without being expanded.
+	skip int
+}
+
+// and and or return the logical operators of the condition.
+func (c *condition) and() string {
+	if c.extended {
+		return "&&"
+	}
+	return "-a"
+}
+
+func (c *condition) or() string {
+	if c.extended {
+		return "||"
+	}
+	return "-o"
+}
+
+// evaluate evaluates the whole condition.
+func (c *condition) evaluate() (bool, error) {
+	ok, err := c.disjunction()
+	if err == nil && c.pos < len(c.words) {
+		err = fmt.Errorf("%s: unexpected argument", c.words[c.pos])
+	}
+	return ok, err
+}
+
+// peek returns the word i words ahead, or "" past the end.
+func (c *condition) peek(i int) string {
+	if c.pos+i < len(c.words) {
+		return c.words[c.pos+i]
+	}
+	return ""
+}
+
+func (c *condition) remaining() int {
+	return len(c.words) - c.pos
+}
+
+func (c *condition) disjunction() (bool, error) {
+	ok, err := c.conjunction()
+	for err == nil && c.remaining() > 0 && c.peek(0) == c.or() {
+		c.pos++
+		if ok {
+			c.skip++
+		}
+		var right bool
+		right, err = c.conjunction()
+		if ok {
+			c.skip--
+		}
+		ok = ok || right
+	}
+	return ok, err
+}
+
+func (c *condition) conjunction() (bool, error) {
+	ok, err := c.negation()
+	for err == nil && c.remaining() > 0 && c.peek(0) == c.and() {
+		c.pos++
+		if !ok {
+			c.skip++
+		}
+		var right bool
+		right, err = c.negation()
+		if !ok {
+			c.skip--
+		}
+		ok = ok && right
+	}
+	return ok, err
+}
+
+func (c *condition) negation() (bool, error) {
+	if c.peek(0) == "!" && c.remaining() > 1 {
+		c.pos++
+		ok, err := c.negation()
+		return !ok, err
+	}
+	return c.primary()
+}
+
+// primary parses ( condition ), a binary or unary test, or a single word,
+// which is true when not empty. A binary operator in second position wins,
+// so that "test -f = -f" compares two strings.
+func (c *condition) primary() (bool, error) {
+	switch {
+	case c.remaining() == 0:
+		return false, errors.New("argument expected")
+	case c.remaining() >= 3 && (binaryTests[c.peek(1)] || c.extended && c.peek(1) == "=~"):
+		left, op, right := c.peek(0), c.peek(1), c.peek(2)
+		c.pos += 3
+		return c.binary(left, op, right)
+	case c.peek(0) == "(" && c.remaining() > 1:
+		c.pos++
+		ok, err := c.disjunction()
+		if err != nil {
+			return false, err
+		}
+		if c.peek(0) != ")" {
+			return false, errors.New("')' expected")
+		}
+		c.pos++
+		return ok, nil
+	case c.remaining() >= 2 && (fileTests[c.peek(0)] != nil || c.peek(0) == "-n" || c.peek(0) == "-z"):
+		op, word := c.peek(0), c.peek(1)
+		c.pos += 2
+		return c.unary(op, word)
+	}
+	word := c.peek(0)
+	c.pos++
+	s, err := c.operand(word, nil)
+	return s != "", err
+}
+
+// operand returns the value of a word; only [[ ]] expands them, passing the
+// quoted text through literal.
+func (c *condition) operand(word string, literal func(string) string) (string, error) {
+	if !c.extended || c.skip > 0 {
+		return word, nil
+	}
+	return c.env.Shell.expand(word, literal)
+}
+
+func (c *condition) unary(op, word string) (bool, error) {
+	s, err := c.operand(word, nil)
+	if err != nil || c.skip > 0 {
+		return false, err
+	}
+	switch op {
+	case "-n":
+		return s != "", nil
+	case "-z":
+		return s == "", nil
+	}
+	path := c.env.Path(s)
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, nil
+	}
+	return fileTests[op](info, path), nil
+}
+
+func (c *condition) binary(left, op, right string) (bool, error) {
+	x, err := c.operand(left, nil)
+	if err != nil {
+		return false, err
+	}
+	// Quoted parts of patterns and regular expressions match literally.
+	var literal func(string) string
+	switch op {
+	case "=", "==", "!=":
+		literal = escapePattern
+	case "=~":
+		literal = regexp.QuoteMeta
+	}
+	y, err := c.operand(right, literal)
+	if err != nil || c.skip > 0 {
+		return false, err
+	}
+
+	switch op {
+	case "=", "==", "!=":
+		equal := x == y
+		if c.extended {
+			re, err := regexp.Compile(patternRegexp(y))
+			if err != nil {
+				return false, fmt.Errorf("%s: invalid pattern", y)
+			}
+			equal = re.MatchString(x)
+		}
+		return equal == (op != "!="), nil
+	case "<":
+		return x < y, nil
+	case ">":
+		return x > y, nil
+	case "=~":
+		re, err := regexp.Compile(y)
+		if err != nil {
+			return false, fmt.Errorf("%s: invalid regular expression", y)
+		}
+		return re.MatchString(x), nil
+	}
+
+	a, err := c.integer(x)
+	if err != nil {
+		return false, err
+	}
+	b, err := c.integer(y)
+	if err != nil {
+		return false, err
+	}
+	switch op {
+	case "-eq":
+		return a == b, nil
+	case "-ne":
+		return a != b, nil
+	case "-lt":
+		return a < b, nil
+	case "-le":
+		return a <= b, nil
+	case "-gt":
+		return a > b, nil
+	default:
+		return a >= b, nil
+	}
+}
+
+// integer converts the operand of an integer comparison, an arithmetic
+// expression within [[ ]].
+func (c *condition) integer(s string) (int64, error) {
+	if c.extended {
+		return c.env.Shell.arithmetic(s)
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s: integer expression expected", s)
+	}
+	return n, nil
+}
+
+// escapePattern escapes the characters of s that are special in patterns.
+func escapePattern(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`*?[]\`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// patternRegexp converts a shell pattern, with *, ? and [...], to a regular
+// expression matching whole strings. A backslash escapes the next character.
+func patternRegexp(pattern string) string {
+	var b strings.Builder
+	b.WriteString("^(?s:")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+				b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+			} else {
+				b.WriteString(`\\`)
+			}
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + class + "]")
+			i += end + 1
+		default:
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	b.WriteString(")$")
+	return b.String()
+}
+
+// runCondition evaluates words as a condition: the status is 0 when true, 1
+// when false and 2 when the condition is invalid.
+func runCondition(env *Env, cmd string, words []string, extended bool) int {
+	if len(words) == 0 {
+		if extended {
+			fmt.Fprintf(env.Stderr, "%s: condition expected\n", cmd)
+			return 2
+		}
+		return 1
+	}
+	c := &condition{env: env, words: words, extended: extended}
+	ok, err := c.evaluate()
+	if err != nil {
+		fmt.Fprintf(env.Stderr, "%s: %v\n", cmd, err)
+		return 2
+	}
+	if !ok {
+		return 1
+	}
+	return 0
+}
+
+// test expr
+func handleTest(env *Env, args []string) int {
+	return runCondition(env, "test", args, false)
+}
+
+// [ expr ]
+func handleBracket(env *Env, args []string) int {
+	if len(args) == 0 || args[len(args)-1] != "]" {
+		fmt.Fprintln(env.Stderr, "[: missing ]")
+		return 2
+	}
+	return runCondition(env, "[", args[:len(args)-1], false)
+}
+
+// condCommand returns the inside of a [[ condition ]] command, which
+// splitArgs keeps as a single word.
+func condCommand(word string) (string, bool) {
+	if len(word) < 5 || !strings.HasPrefix(word, "[[") || !strings.HasSuffix(word, "]]") ||
+		!strings.ContainsAny(word[2:3], " \t") || !strings.ContainsAny(word[len(word)-3:len(word)-2], " \t") {
+		return "", false
+	}
+	return word[2 : len(word)-2], true
+}
+
+// compoundCommand returns the keyword of a (( )) or [[ ]] command word, or
+// "" for other words.
+func compoundCommand(word string) string {
+	if _, ok := arithCommand(word); ok {
+		return "(("
+	}
+	if _, ok := condCommand(word); ok {
+		return "[["
+	}
+	return ""
+}
@@ -0,0 +1,463 @@
+package shell
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// The file builtins report errors as "cmd: cannot <op> 'name': reason", with
+// name as the user wrote it. Like every command they are subject to the
+// role permissions, so e.g. "perm deny guest rm" keeps guests from deleting.
+
+func fileError(env *Env, cmd, op, name string, err error) {
+	var pathErr *fs.PathError
+	var linkErr *os.LinkError
+	switch {
+	case errors.As(err, &pathErr):
+		err = pathErr.Err
+	case errors.As(err, &linkErr):
+		err = linkErr.Err
+	}
+	fmt.Fprintf(env.Stderr, "%s: cannot %s '%s': %v\n", cmd, op, name, err)
+}
+
+// confirm asks a yes/no question on stderr and reads the answer from the
+// builtin's input.
+func confirm(env *Env, question string) bool {
+	fmt.Fprint(env.Stderr, question)
+	answer, err := env.ReadLine()
+	if err != nil {
+		fmt.Fprintln(env.Stderr)
+		return false
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// mkdir [-p] dir ...
+func handleMkdir(env *Env, args []string) int {
+	opts, dirs, err := getopt(args, "p")
+	if err != nil {
+		fmt.Fprintf(env.Stderr, "mkdir: %v\n", err)
+		return 1
+	}
+	if len(dirs) == 0 {
+		fmt.Fprintln(env.Stderr, "mkdir: missing operand")
+		return 1
+	}
+
+	status := 0
+	for _, dir := range dirs {
+		if err := env.Shell.confine(env.Path(dir)); err != nil {
+			fileError(env, "mkdir", "create directory", dir, err)
+			status = 1
+			continue
+		}
+		if opts.has('p') {
+			err = os.MkdirAll(env.Path(dir), 0755)
+		} else {
+			err = os.Mkdir(env.Path(dir), 0755)
+		}
+		if err != nil {
+			fileError(env, "mkdir", "create directory", dir, err)
+			status = 1
+		}
+	}
+	return status
+}
+
+// rm [-rfi] file ...
+func handleRm(env *Env, args []string) int {
+	opts, files, err := getopt(args, "rRfi")
+	if err != nil {
+		fmt.Fprintf(env.Stderr, "rm: %v\n", err)
+		return 1
+	}
+	recursive := opts.has('r') || opts.has('R')
+	force := opts.has('f')
+	if len(files) == 0 && !force {
+		fmt.Fprintln(env.Stderr, "rm: missing operand")
+		return 1
+	}
+
+	status := 0
+	for _, name := range files {
+		if base := filepath.Base(name); base == "." || base == ".." || filepath.Clean(env.Path(name)) == "/" {
+			fmt.Fprintf(env.Stderr, "rm: refusing to remove '%s'\n", name)
+			status = 1
+			continue
+		}
+		path := env.Path(name)
+		if err := env.Shell.confine(path); err != nil {
+			fileError(env, "rm", "remove", name, err)
+			status = 1
+			continue
+		}
+		info, err := os.Lstat(path)
+		if err != nil {
+			if !force || !errors.Is(err, fs.ErrNotExist) {
+				fileError(env, "rm", "remove", name, err)
+				status = 1
+			}
+			continue
+		}
+		if info.IsDir() && !recursive {
+			fileError(env, "rm", "remove", name, syscall.EISDIR)
+			status = 1
+			continue
+		}
+		if opts.has('i') && !force && !confirm(env, fmt.Sprintf("rm: remove '%s'? ", name)) {
+			continue
+		}
+
+		if info.IsDir() {
+			err = os.RemoveAll(path)
+		} else {
+			err = os.Remove(path)
+		}
+		if err != nil {
+			fileError(env, "rm", "remove", name, err)
+			status = 1
+		}
+	}
+	return status
+}
+
+// transfer holds what cp and mv share: the options deciding whether an
+// existing destination may be replaced.
+type transfer struct {
+	env  *Env
+	cmd  string
+	opts options
+}
+
+// mayReplace reports whether dst, the destination for name, may be written.
+// -n never replaces an existing file; -i asks first unless -f is given.
+func (t transfer) mayReplace(dst, name string) bool {
+	if _, err := os.Lstat(dst); err != nil {
+		return true
+	}
+	if t.opts.has('n') {
+		return false
+	}
+	if t.opts.has('i') && !t.opts.has('f') {
+		return confirm(t.env, fmt.Sprintf("%s: overwrite '%s'? ", t.cmd, name))
+	}
+	return true
+}
+
+// destinations pairs each source operand with its destination path. With
+// several sources, or when the last operand is a directory, sources go into
+// that directory.
+func (t transfer) destinations(operands []string) ([]string, []string, bool) {
+	if len(operands) < 2 {
+		if len(operands) == 0 {
+			fmt.Fprintf(t.env.Stderr, "%s: missing file operand\n", t.cmd)
+		} else {
+			fmt.Fprintf(t.env.Stderr, "%s: missing destination file operand after '%s'\n", t.cmd, operands[0])
+		}
+		return nil, nil, false
+	}
+	sources, target := operands[:len(operands)-1], operands[len(operands)-1]
+	info, err := os.Stat(t.env.Path(target))
+	isDir := err == nil && info.IsDir()
+	if len(sources) > 1 && !isDir {
+		fmt.Fprintf(t.env.Stderr, "%s: target '%s' is not a directory\n", t.cmd, target)
+		return nil, nil, false
+	}
+
+	dsts := make([]string, len(sources))
+	for i, src := range sources {
+		dsts[i] = t.env.Path(target)
+		if isDir {
+			dsts[i] = filepath.Join(dsts[i], filepath.Base(src))
+		}
+	}
+	return sources, dsts, true
+}
+
+// confine refuses, in restricted mode, a source operand or a destination
+// outside the root.
+func (t transfer) confine(src, dst string) error {
+	if err := t.env.Shell.confine(t.env.Path(src)); err != nil {
+		return err
+	}
+	return t.env.Shell.confine(dst)
+}
+
+// sameFile reports whether the destination dst of the source operand src is
+// the source itself, which copying would truncate, and says so on stderr.
+// target is the destination operand.
+func (t transfer) sameFile(src, dst, target string) bool {
+	path := t.env.Path(src)
+	same := func(stat func(string) (fs.FileInfo, error)) bool {
+		a, err := stat(path)
+		if err != nil || a.IsDir() {
+			return false
+		}
+		b, err := stat(dst)
+		return err == nil && os.SameFile(a, b)
+	}
+	if !same(os.Stat) && !same(os.Lstat) {
+		return false
+	}
+	name := target
+	if dst != t.env.Path(target) {
+		name = filepath.Join(target, filepath.Base(src))
+	}
+	fmt.Fprintf(t.env.Stderr, "%s: '%s' and '%s' are the same file\n", t.cmd, src, name)
+	return true
+}
+
+func copyFile(src, dst string, mode fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode.Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// copyPath copies src to dst, descending into directories when recursive is
+// set. Symbolic links are copied as links.
+func (t transfer) copyPath(src, dst, name string, recursive bool) error {
+	info, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	switch {
+	case info.Mode()&fs.ModeSymlink != 0:
+		link, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		if !t.mayReplace(dst, name) {
+			return nil
+		}
+		os.Remove(dst)
+		return os.Symlink(link, dst)
+	case info.IsDir():
+		if !recursive {
+			return fmt.Errorf("-r not specified; omitting directory")
+		}
+		if rel, err := filepath.Rel(src, dst); err == nil && !strings.HasPrefix(rel, "..") {
+			return fmt.Errorf("cannot copy a directory into itself")
+		}
+		if err := os.MkdirAll(dst, info.Mode().Perm()|0700); err != nil {
+			return err
+		}
+		entries, err := os.ReadDir(src)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err := t.copyPath(filepath.Join(src, e.Name()), filepath.Join(dst, e.Name()), filepath.Join(name, e.Name()), true); err != nil {
+				return err
+			}
+		}
+		return os.Chmod(dst, info.Mode().Perm())
+	}
+
+	if !t.mayReplace(dst, name) {
+		return nil
+	}
+	err = copyFile(src, dst, info.Mode())
+	if err != nil && t.opts.has('f') && errors.Is(err, fs.ErrPermission) {
+		// -f: replace a destination that cannot be opened for writing.
+		if os.Remove(dst) == nil {
+			err = copyFile(src, dst, info.Mode())
+		}
+	}
+	return err
+}
+
+// cp [-rfin] source ... dest
+func handleCp(env *Env, args []string) int {
+	opts, operands, err := getopt(args, "rRfin")
+	if err != nil {
+		fmt.Fprintf(env.Stderr, "cp: %v\n", err)
+		return 1
+	}
+	t := transfer{env: env, cmd: "cp", opts: opts}
+	sources, dsts, ok := t.destinations(operands)
+	if !ok {
+		return 1
+	}
+
+	status := 0
+	for i, src := range sources {
+		if err := t.confine(src, dsts[i]); err != nil {
+			fileError(env, "cp", "copy", src, err)
+			status = 1
+			continue
+		}
+		if t.sameFile(src, dsts[i], operands[len(operands)-1]) {
+			status = 1
+			continue
+		}
+		if err := t.copyPath(env.Path(src), dsts[i], src, opts.has('r') || opts.has('R')); err != nil {
+			fileError(env, "cp", "copy", src, err)
+			status = 1
+		}
+	}
+	return status
+}
+
+// mv [-fin] source ... dest
+func handleMv(env *Env, args []string) int {
+	opts, operands, err := getopt(args, "fin")
+	if err != nil {
+		fmt.Fprintf(env.Stderr, "mv: %v\n", err)
+		return 1
+	}
+	t := transfer{env: env, cmd: "mv", opts: opts}
+	sources, dsts, ok := t.destinations(operands)
+	if !ok {
+		return 1
+	}
+
+	status := 0
+	for i, src := range sources {
+		path := env.Path(src)
+		if err := t.confine(src, dsts[i]); err != nil {
+			fileError(env, "mv", "move", src, err)
+			status = 1
+			continue
+		}
+		if _, err := os.Lstat(path); err != nil {
+			fileError(env, "mv", "move", src, err)
+			status = 1
+			continue
+		}
+		if t.sameFile(src, dsts[i], operands[len(operands)-1]) {
+			status = 1
+			continue
+		}
+		if !t.mayReplace(dsts[i], src) {
+			continue
+		}
+		err := os.Rename(path, dsts[i])
+		if errors.Is(err, syscall.EXDEV) {
+			// Across file systems a move is a copy followed by a removal.
+			cp := transfer{env: env, cmd: "mv", opts: options{'f': ""}}
+			if err = cp.copyPath(path, dsts[i], src, true); err == nil {
+				err = os.RemoveAll(path)
+			}
+		}
+		if err != nil {
+			fileError(env, "mv", "move", src, err)
+			status = 1
+		}
+	}
+	return status
+}
+
+// touch [-c] file ...
+func handleTouch(env *Env, args []string) int {
+	opts, files, err := getopt(args, "c")
+	if err != nil {
+		fmt.Fprintf(env.Stderr, "touch: %v\n", err)
+		return 1
+	}
+	if len(files) == 0 {
+		fmt.Fprintln(env.Stderr, "touch: missing file operand")
+		return 1
+	}
+
+	status := 0
+	now := time.Now()
+	for _, name := range files {
+		path := env.Path(name)
+		if err := env.Shell.confine(path); err != nil {
+			fileError(env, "touch", "touch", name, err)
+			status = 1
+			continue
+		}
+		err := os.Chtimes(path, now, now)
+		if errors.Is(err, fs.ErrNotExist) {
+			if opts.has('c') {
+				continue
+			}
+			var f *os.File
+			if f, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0644); err == nil {
+				err = f.Close()
+			}
+		}
+		if err != nil {
+			fileError(env, "touch", "touch", name, err)
+			status = 1
+		}
+	}
+	return status
+}
+
+func fileType(mode fs.FileMode) string {
+	switch {
+	case mode.IsRegular():
+		return "regular file"
+	case mode.IsDir():
+		return "directory"
+	case mode&fs.ModeSymlink != 0:
+		return "symbolic link"
+	case mode&fs.ModeNamedPipe != 0:
+		return "fifo"
+	case mode&fs.ModeSocket != 0:
+		return "socket"
+	case mode&fs.ModeCharDevice != 0:
+		return "character special file"
+	case mode&fs.ModeDevice != 0:
+		return "block special file"
+	}
+	return "unknown"
+}
+
+// stat file ...
+func handleStat(env *Env, args []string) int {
+	_, files, err := getopt(args, "")
+	if err != nil {
+		fmt.Fprintf(env.Stderr, "stat: %v\n", err)
+		return 1
+	}
+	if len(files) == 0 {
+		fmt.Fprintln(env.Stderr, "stat: missing operand")
+		return 1
+	}
+
+	status := 0
+	for _, name := range files {
+		path := env.Path(name)
+		info, err := os.Lstat(path)
+		if err != nil {
+			fileError(env, "stat", "stat", name, err)
+			status = 1
+			continue
+		}
+		title := name
+		if info.Mode()&fs.ModeSymlink != 0 {
+			if link, err := os.Readlink(path); err == nil {
+				title += " -> " + link
+			}
+		}
+		fmt.Fprintf(env.Stdout, "  File: %s\n", title)
+		fmt.Fprintf(env.Stdout, "  Size: %-12d Type: %s\n", info.Size(), fileType(info.Mode()))
+		fmt.Fprintf(env.Stdout, "  Mode: %s (%04o)\n", info.Mode(), info.Mode().Perm())
+		fmt.Fprintf(env.Stdout, "Modify: %s\n", info.ModTime().Format("2006-01-02 15:04:05.000000000 -0700"))
+	}
+	return status
+}
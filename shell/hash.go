@@ -0,0 +1,265 @@
+package shell
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// hashEntry is a remembered PATH lookup and how often it was used.
+type hashEntry struct {
+	path string
+	hits int
+}
+
+// keywords are the words the interpreter handles itself before looking up
+// commands.
+var keywords = map[string]bool{"time": true, "((": true, "[[": true}
+
+// isExecutable reports whether path is a file with an execute bit set.
+func isExecutable(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && !info.IsDir() && info.Mode()&0111 != 0
+}
+
+// searchPath returns the executables called name in the session's PATH, in
+// PATH order. With all unset it stops at the first.
+func searchPath(env *Env, name string, all bool) []string {
+	var paths []string
+	for _, dir := range filepath.SplitList(env.Getenv("PATH")) {
+		if dir == "" {
+			dir = "."
+		}
+		path := env.Path(filepath.Join(dir, name))
+		if isExecutable(path) {
+			paths = append(paths, path)
+			if !all {
+				break
+			}
+		}
+	}
+	return paths
+}
+
+// hashed returns the remembered path of name. Entries whose file is gone or
+// no longer executable are forgotten.
+func (in *Interpreter) hashed(name string) (string, bool) {
+	in.mu.RLock()
+	entry, ok := in.commands[name]
+	in.mu.RUnlock()
+	if !ok {
+		return "", false
+	}
+	if !isExecutable(entry.path) {
+		in.mu.Lock()
+		delete(in.commands, name)
+		in.mu.Unlock()
+		return "", false
+	}
+	return entry.path, true
+}
+
+// hash remembers path as the location of name and counts hits uses.
+func (in *Interpreter) hash(name, path string, hits int) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	entry, ok := in.commands[name]
+	if !ok || entry.path != path {
+		entry = &hashEntry{path: path}
+		in.commands[name] = entry
+	}
+	entry.hits += hits
+}
+
+// lookPath finds an executable in the session's PATH, through the hash table
+// so that repeated commands do not search PATH again. Names containing a
+// slash are used as they are.
+func lookPath(env *Env, name string) (string, error) {
+	if strings.Contains(name, "/") {
+		return env.Path(name), nil
+	}
+	path, ok := env.Shell.hashed(name)
+	if !ok {
+		paths := searchPath(env, name, false)
+		if len(paths) == 0 {
+			return "", exec.ErrNotFound
+		}
+		path = paths[0]
+	}
+	env.Shell.hash(name, path, 1)
+	return path, nil
+}
+
+func handleType(env *Env, args []string) int {
+	opts, names, err := getopt(args, "atp")
+	if err != nil {
+		fmt.Fprintf(env.Stderr, "type: %v\n", err)
+		return 1
+	}
+	if len(names) == 0 {
+		fmt.Fprintln(env.Stderr, "type: missing argument")
+		return 1
+	}
+
+	// report prints what name is: a keyword, builtin or file, the latter
+	// with its path.
+	report := func(name, kind, path string, hashed bool) {
+		switch {
+		case env.JSON():
+			writeRecord(env.Stdout, struct {
+				Name   string `json:"name"`
+				Kind   string `json:"kind"`
+				Path   string `json:"path,omitempty"`
+				Hashed bool   `json:"hashed,omitempty"`
+			}{name, kind, path, hashed})
+		case opts.has('t'):
+			fmt.Fprintln(env.Stdout, kind)
+		case opts.has('p'):
+			if path != "" {
+				fmt.Fprintln(env.Stdout, path)
+			}
+		case kind != "file":
+			fmt.Fprintf(env.Stdout, "%s is a shell %s\n", name, kind)
+		case hashed:
+			fmt.Fprintf(env.Stdout, "%s is hashed (%s)\n", name, path)
+		default:
+			fmt.Fprintf(env.Stdout, "%s is %s\n", name, path)
+		}
+	}
+
+	status := 0
+	for _, name := range names {
+		found := false
+		if keywords[name] {
+			found = true
+			report(name, "keyword", "", false)
+			if !opts.has('a') {
+				continue
+			}
+		}
+		if _, ok := env.Shell.Registry().Lookup(name); ok {
+			found = true
+			report(name, "builtin", "", false)
+			if !opts.has('a') {
+				continue
+			}
+		}
+
+		var paths []string
+		hashed := false
+		switch {
+		case strings.Contains(name, "/"):
+			if isExecutable(env.Path(name)) {
+				paths = []string{name}
+			}
+		case opts.has('a'):
+			paths = searchPath(env, name, true)
+		default:
+			if path, ok := env.Shell.hashed(name); ok {
+				paths, hashed = []string{path}, true
+			} else {
+				paths = searchPath(env, name, false)
+			}
+		}
+		for _, path := range paths {
+			found = true
+			report(name, "file", path, hashed)
+		}
+
+		if !found {
+			if env.JSON() || (!opts.has('t') && !opts.has('p')) {
+				fmt.Fprintf(env.Stderr, "type: %s: not found\n", name)
+			}
+			status = 1
+		}
+	}
+	return status
+}
+
+// which [-a] name ...
+func handleWhich(env *Env, args []string) int {
+	opts, names, err := getopt(args, "a")
+	if err != nil {
+		fmt.Fprintf(env.Stderr, "which: %v\n", err)
+		return 1
+	}
+	if len(names) == 0 {
+		fmt.Fprintln(env.Stderr, "which: missing argument")
+		return 1
+	}
+
+	status := 0
+	for _, name := range names {
+		var paths []string
+		if strings.Contains(name, "/") {
+			if isExecutable(env.Path(name)) {
+				paths = []string{name}
+			}
+		} else {
+			paths = searchPath(env, name, opts.has('a'))
+		}
+		if len(paths) == 0 {
+			status = 1
+		}
+		for _, path := range paths {
+			fmt.Fprintln(env.Stdout, path)
+		}
+	}
+	return status
+}
+
+// hash [-r] [name ...]
+func handleHash(env *Env, args []string) int {
+	opts, names, err := getopt(args, "r")
+	if err != nil {
+		fmt.Fprintf(env.Stderr, "hash: %v\n", err)
+		return 1
+	}
+	in := env.Shell
+	if opts.has('r') {
+		in.mu.Lock()
+		clear(in.commands)
+		in.mu.Unlock()
+	}
+
+	if len(names) > 0 {
+		status := 0
+		for _, name := range names {
+			if _, ok := in.Registry().Lookup(name); ok || strings.Contains(name, "/") {
+				continue
+			}
+			paths := searchPath(env, name, false)
+			if len(paths) == 0 {
+				fmt.Fprintf(env.Stderr, "hash: %s: not found\n", name)
+				status = 1
+				continue
+			}
+			in.hash(name, paths[0], 0)
+		}
+		return status
+	}
+	if opts.has('r') {
+		return 0
+	}
+
+	in.mu.RLock()
+	names = make([]string, 0, len(in.commands))
+	for name := range in.commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if len(names) == 0 {
+		fmt.Fprintln(env.Stdout, "hash: hash table empty")
+	} else {
+		fmt.Fprintln(env.Stdout, "hits\tcommand")
+		for _, name := range names {
+			entry := in.commands[name]
+			fmt.Fprintf(env.Stdout, "%4d\t%s\n", entry.hits, entry.path)
+		}
+	}
+	in.mu.RUnlock()
+	return 0
+}
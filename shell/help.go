@@ -0,0 +1,597 @@
+package shell
+
+import (
+	"fmt"
+	"strings"
+)
+
+// builtinHelp holds the usage text of every default builtin. The first line
+// is the synopsis shown by a bare "help"; the rest is printed by "help name"
+// and "name --help".
+var builtinHelp = map[string]string{
+	"help": `help [name]
+Without arguments, list the builtins with their synopsis. With a name, print
+the usage of that builtin. Every builtin also accepts --help.
+
+Examples:
+  help
+  help cd
+  cd --help`,
+
+	"exit": `exit [status]
+Exit the shell with the given status, 0 by default.
+
+Examples:
+  exit
+  exit 2`,
+
+	"echo": `echo [-neE] [arg ...]
+Print the arguments separated by spaces, followed by a newline.
+
+Options:
+  -n   do not print the trailing newline
+  -e   interpret backslash escapes: \a \b \c (stop output) \e \f \n \r
+       \t \v \\ \0nnn (octal) \xHH \uHHHH \UHHHHHHHH
+  -E   do not interpret backslash escapes (the default)
+
+Examples:
+  echo hello world
+  echo "home is $HOME"
+  echo -e 'name:\tgosh\n\u263a'`,
+
+	"printf": `printf format [arg ...]
+Print the arguments according to format. Supported directives are %s, %b
+(argument with echo -e escapes), %q (argument quoted for the shell), %c, %d,
+%i, %u, %x, %X, %o, %f, %e and %g, with flags, width and precision, and %%.
+The format understands the same escapes as echo -e, with octal written \nnn.
+When there are more arguments than directives, the format is reused.
+
+Examples:
+  printf '%s is %d years old\n' gosh 3
+  printf '%-10s|%5.2f\n' a 1 b 2.5
+  printf '%x %q\n' 255 "it's"`,
+
+	"cat": `cat [-nbsAvET] [file ...]
+Print the contents of the files in order. A file named - and no files at
+all stand for the standard input. Files are streamed, so their size does
+not matter.
+
+Options:
+  -n   number all output lines
+  -b   number non-empty output lines, overrides -n
+  -s   squeeze repeated empty lines into one
+  -v   show control characters as ^X and 8-bit bytes as M-X
+  -E   show $ at the end of each line
+  -T   show tabs as ^I
+  -A   same as -vET
+
+Examples:
+  cat notes.txt
+  cat -n header.txt - footer.txt
+  ls | cat -A`,
+
+	"grep": `grep [-ivnrclhHFE] pattern [file ...]
+Print the lines matching pattern, a regular expression in Go's RE2 syntax.
+Exits with 0 when a line matched, 1 when none did and 2 on errors.
+
+Options:
+  -i   ignore case
+  -v   print the lines that do not match
+  -n   prefix lines with their line number
+  -r   search directories recursively, the working directory by default
+  -c   print the number of matching lines instead of the lines
+  -l   print only the names of files with a match
+  -h   never prefix lines with the file name
+  -H   always prefix lines with the file name
+  -F   treat pattern as a fixed string
+  -E   accepted for compatibility; patterns are always extended
+
+Examples:
+  grep -n TODO main.go
+  grep -ri 'error|fail' logs
+  history | grep -v cd`,
+
+	"head": `head [-n lines | -c bytes] [file ...]
+Print the first 10 lines of each file, or of the input.
+
+Options:
+  -n lines   print the first lines lines instead; -5 is short for -n 5
+  -c bytes   print the first bytes bytes instead
+
+Examples:
+  head -n 3 notes.txt
+  ls | head -1`,
+
+	"tail": `tail [-f] [-n [+]lines] [file ...]
+Print the last 10 lines of each file, or of the input. Only the end of
+regular files is read, so tail is quick on large logs.
+
+Options:
+  -n lines    print the last lines lines; -n +lines starts at that line
+  -f          keep printing data appended to the files, until the reader
+              of the output goes away
+
+Examples:
+  tail -n 20 app.log
+  tail -f app.log | grep ERROR`,
+
+	"wc": `wc [-lwmc] [file ...]
+Print the number of lines, words and bytes of each file, or of the input,
+and a total for several files.
+
+Options:
+  -l   print the line count
+  -w   print the word count
+  -m   print the character count
+  -c   print the byte count
+
+Examples:
+  wc notes.txt
+  ls | wc -w`,
+
+	"sort": `sort [-nrfu] [-t sep] [-k field[,field]] [file ...]
+Print the lines of the files, or of the input, sorted. Lines with equal
+keys are ordered by the whole line.
+
+Options:
+  -n           compare by the number at the start of the key
+  -r           reverse the order
+  -f           ignore case
+  -u           print only the first of lines with equal keys
+  -t sep       separate fields by sep instead of by blanks
+  -k n[,m]     sort by fields n to m, or n to the end of the line
+
+Examples:
+  sort -u names.txt
+  sort -t : -k 3 -n /etc/passwd`,
+
+	"uniq": `uniq [-cdui] [file]
+Print the lines of the file, or of the input, with adjacent duplicates
+collapsed into one.
+
+Options:
+  -c   prefix lines with their number of occurrences
+  -d   print only duplicated lines
+  -u   print only unique lines
+  -i   ignore case
+
+Examples:
+  sort words.txt | uniq -c | sort -rn`,
+
+	"type": `type [-atp] name ...
+Tell whether each name is a shell keyword, a builtin or an external command,
+and where the command is found in PATH. Only files with an execute bit
+count. The time keyword, written before a pipeline, reports the real, user
+and system time it took. With set -o json, print a record per match with its
+name, kind and path.
+
+Options:
+  -a   print every builtin and PATH entry called name, not only the one
+       that runs
+  -t   print only "keyword", "builtin" or "file"
+  -p   print only the path of the file that runs, nothing for builtins
+
+Examples:
+  type cd
+  type -a echo
+  type -t ls`,
+
+	"which": `which [-a] name ...
+Print the path of the executable each name runs from PATH. Builtins are not
+considered. Exits with 1 when a name is not found.
+
+Options:
+  -a   print all matches in PATH, not only the first
+
+Examples:
+  which ls
+  which -a python3`,
+
+	"hash": `hash [-r] [name ...]
+Commands are looked up in PATH once and then remembered until PATH changes.
+Without arguments, list the remembered commands with how often each ran.
+With names, look them up and remember them.
+
+Options:
+  -r   forget all remembered commands
+
+Examples:
+  hash
+  hash -r`,
+
+	"timeout": `timeout [-k duration] duration command [arg ...]
+Run the program command from PATH and stop it when it is still running
+after duration: it is sent SIGTERM, and SIGKILL if it has not exited
+5 seconds later. Durations are seconds, or minutes, hours or days with an
+m, h or d suffix; 0 disables the timeout. Exits with 124 when the command
+timed out, 137 when it had to be killed, and the command's status otherwise.
+
+Options:
+  -k duration   wait duration instead of 5 seconds before sending SIGKILL
+
+Examples:
+  timeout 10 curl -s example.com
+  timeout -k 1 2.5m make`,
+
+	"ulimit": `ulimit [-a] [-tvn [limit]]
+Print or set the resource limits of the external commands run by this
+session; the shell itself is not limited. A limit is a number or
+"unlimited", and cannot exceed the shell's own hard limit. Without options,
+all limits are printed.
+
+Options:
+  -a   print all limits
+  -t   CPU time in seconds
+  -v   virtual memory in kilobytes
+  -n   number of open files
+
+Examples:
+  ulimit -a
+  ulimit -t 60
+  ulimit -v 1048576`,
+
+	"set": `set [-eux] [+eux] [-o name | +o name] ...
+Turn shell options on with -o and off with +o; -e, -u and -x are short for
+-o errexit, -o nounset and -o xtrace. Without arguments, or with a lone -o,
+list the options and whether they are on; a lone +o prints the set commands
+that restore them.
+
+Options:
+  errexit    exit the shell as soon as a command line fails
+  json       ls, history and type print one JSON record per line instead
+             of text; the --json flag of gosh turns it on from the start
+  nounset    expanding an unset variable is an error
+  pipefail   a pipeline fails with the status of its last failing command
+             rather than the status of its last command
+  xtrace     print each command to stderr before running it, after
+             expansion, prefixed with $PS4 ("+ " by default)
+
+Examples:
+  set -eu
+  set -o pipefail
+  set -x; export PS4='trace: '
+  set -o json
+  ls | grep '"type":"directory"'
+  set +o json`,
+
+	"source": `source file
+Run the command lines of file in the current session, so that variables,
+options and the working directory it sets stay set. Lines starting with #
+are comments. In restricted mode, file cannot contain a slash.
+
+Examples:
+  source setup.sh
+  . ./setup.sh`,
+
+	".": `. file
+Same as source.`,
+
+	"pwd": `pwd
+Print the working directory of the session.`,
+
+	"cd": `cd [dir]
+Change the working directory of the session to dir, or to $HOME when no
+directory is given. Updates PWD and OLDPWD. In restricted mode, cd cannot
+leave the root directory of the session.
+
+Examples:
+  cd /tmp
+  cd ..`,
+
+	"export": `export name=value ...
+Set shell variables. They are expanded by echo and passed to external
+commands in their environment. PATH, SHELL and ENV cannot be changed in
+restricted mode.
+
+Examples:
+  export EDITOR=vi
+  export TMOUT=600`,
+
+	"read": `read [-rs] [-p prompt] [-t timeout] [-a array | name ...]
+Read a line of input and split it into fields at the characters of IFS,
+blanks by default, assigning them to the names in order; the last name gets
+the rest of the line. Without names the whole line goes to REPLY. Reads from
+the session's input, a redirection or a pipe, so "cmd | read a b" sets a
+and b in the session. The status is 1 at the end of input and 142 when the
+timeout expires.
+
+Unless -r is given, a backslash escapes the next character, which then does
+not separate fields, and a backslash at the end of the line joins the next
+line.
+
+Options:
+  -a array     assign the fields to the elements of array, read back with
+               ${array[i]}, ${array[@]} and their number ${#array[@]}
+  -p prompt    print prompt on stderr first when reading the session's
+               input
+  -r           keep backslashes as they are
+  -s           do not echo the input on a terminal, for secrets
+  -t timeout   give up after timeout, in seconds or with an m, h or d
+               suffix
+
+Examples:
+  read -p 'Name: ' name
+  read -r first rest < notes.txt
+  export IFS=.
+  echo 192.168.0.1 | read -a octets
+  echo ${octets[0]} of ${#octets[@]}`,
+
+	"let": `let expr ...
+Evaluate arithmetic expressions. The status is 0 when the last one is not 0,
+and 1 when it is 0 or invalid. (( expr )) is the same as let "expr", and
+$(( expr )) expands to the value of expr in any word.
+
+Expressions use 64-bit integers with the operators of C, by precedence:
+  ++ --  + - ! ~  **  * / %  + -  << >>  < <= > >=  == !=  &  ^  |  &&  ||
+  ?:  = += -= *= /= %= <<= >>= &= ^= |=  ,
+Variables are read by name, with or without $; unset or empty ones are 0.
+Numbers are decimal, hexadecimal with 0x, octal with 0, or base#digits.
+
+Examples:
+  let i++
+  (( total += size ))
+  echo $(( (a + b) / 2 ))`,
+
+	"test": `test expr
+Evaluate a condition: the status is 0 when it holds, 1 when it does not and
+2 when it is invalid. [ expr ] is the same as test expr. [[ expr ]] expands
+variables in expr itself, so that empty ones need no quotes, joins
+conditions with && and || instead of -a and -o, and adds pattern and
+regular expression matching.
+
+Conditions:
+  -e file        file exists
+  -f file        file is a regular file
+  -d file        file is a directory
+  -r file        file is readable
+  -w file        file is writable
+  -x file        file is executable
+  -s file        file is not empty
+  -n s, s        s is not empty
+  -z s           s is empty
+  s = t, s == t  the strings are equal; within [[ ]], t is a pattern with
+                 * ? and [...] unless quoted
+  s != t         the strings differ, or s does not match the pattern t
+  s < t, s > t   s sorts before or after t
+  s =~ re        s matches the regular expression re, only within [[ ]]
+  a -eq b        the integers are equal; also -ne -lt -le -gt -ge; within
+                 [[ ]], a and b are arithmetic expressions
+  ! expr, ( expr ), expr -a expr, expr -o expr
+
+Examples:
+  test -d /tmp
+  [ "$USER" = root ]
+  [[ -f $file && $file == *.txt ]]
+  [[ $version =~ ^[0-9]+\.[0-9]+$ ]]`,
+
+	"[": `[ expr ]
+Same as test expr.`,
+
+	"ls": `ls [dir]
+List the entries of dir, the working directory by default. With set -o json,
+print a record per entry with its name, type, size, mode and modification
+time.`,
+
+	"mkdir": `mkdir [-p] dir ...
+Create the directories.
+
+Options:
+  -p   create missing parent directories too, and do not fail when a
+       directory already exists
+
+Examples:
+  mkdir -p src/cmd/tool`,
+
+	"rm": `rm [-rfi] file ...
+Remove the files. ".", ".." and / are never removed.
+
+Options:
+  -r   remove directories and their contents recursively; -R is the same
+  -f   ignore missing files and never prompt
+  -i   ask before every removal
+
+Examples:
+  rm notes.txt
+  rm -rf build`,
+
+	"cp": `cp [-rfin] source dest
+cp [-rfin] source ... dir
+Copy source to dest, or the sources into the directory dir. File modes are
+preserved and symbolic links are copied as links.
+
+Options:
+  -r   copy directories recursively; -R is the same
+  -f   replace destination files that cannot be opened for writing
+  -i   ask before overwriting a file, unless -f is given
+  -n   never overwrite a file
+
+Examples:
+  cp notes.txt notes.bak
+  cp -r src backup`,
+
+	"mv": `mv [-fin] source dest
+mv [-fin] source ... dir
+Move or rename source to dest, or move the sources into the directory dir.
+Moves across file systems copy and then remove the source.
+
+Options:
+  -f   do not ask before overwriting
+  -i   ask before overwriting a file, unless -f is given
+  -n   never overwrite a file
+
+Examples:
+  mv draft.txt final.txt
+  mv -n a.log b.log logs`,
+
+	"touch": `touch [-c] file ...
+Set the access and modification times of the files to now, creating the
+files that do not exist.
+
+Options:
+  -c   do not create missing files
+
+Examples:
+  touch .done`,
+
+	"stat": `stat file ...
+Print the name, size, type, mode and modification time of the files.
+Symbolic links are described themselves, not their targets.
+
+Examples:
+  stat notes.txt`,
+
+	"history": `history [clean]
+List the commands run in this session, or by the logged in user, with how
+often each was run. "history clean" forgets them. With set -o json, print a
+record per command with its count and when it was last used.
+
+Examples:
+  history
+  history clean`,
+
+	"login": `login username [password]
+Log in as username. Without a password argument, the password is prompted
+for and not echoed. Repeated failures delay further attempts and finally
+lock the account for a while.
+
+Examples:
+  login alice`,
+
+	"logout": `logout
+End the session of the logged in user.`,
+
+	"adduser": `adduser username [password]
+Create a user with the "user" role. Without a password argument, the
+password is prompted for twice. The password has to meet the policy set
+with the GOSH_PASSWORD_* variables. Only admins may add users, except for
+the very first one, who becomes admin.
+
+Examples:
+  adduser bob`,
+
+	"passwd": `passwd
+Change the password of the logged in user. Prompts for the current
+password and twice for the new one. Wrong current passwords count as failed
+logins.`,
+
+	"deluser": `deluser username
+Delete a user along with their history, after confirming with your own
+password. Only the admin role may run it by default. The last admin cannot
+be deleted.
+
+Examples:
+  deluser bob`,
+
+	"users": `users
+List all users. Requires being logged in.`,
+
+	"whoami": `whoami
+Print the name of the logged in user.`,
+
+	"role": `role username [role]
+Print the role of username, or change it to role (admin or user).
+
+Examples:
+  role bob
+  role bob admin`,
+
+	"perm": `perm [role]
+perm allow|deny|reset role command
+List the allow and deny rules, optionally of one role, or change them. A
+rule for a command takes precedence over the role's "*" rule; reset removes
+a rule. exit and logout are always allowed.
+
+Examples:
+  perm user
+  perm deny user ls
+  perm allow guest '*'
+  perm reset user ls`,
+
+	"last": `last [-n count] [username]
+List the most recent sessions, 10 by default. Only admins may list the
+sessions of other users.
+
+Options:
+  -n count   list count sessions
+
+Examples:
+  last
+  last -n 3 bob`,
+
+	"audit": `audit [-n count] [-u user] [-a action]
+List audit log entries, newest first, 20 by default.
+
+Options:
+  -n count    list count entries
+  -u user     only entries by user
+  -a action   only entries for action, such as login or deluser
+
+Examples:
+  audit -a login
+  audit -u bob -n 50`,
+
+	"record": `record [-t title] file
+record stop
+Record the session to file in the asciicast v2 format of asciinema, with the
+timing of every command line and all output, until "record stop" or the end
+of the session. Passwords given as arguments are left out, as in history.
+Without arguments, tell whether the session is being recorded.
+
+Options:
+  -t title   store title in the recording
+
+Examples:
+  record -t "disk cleanup" cleanup.cast
+  record stop`,
+
+	"replay": `replay [-s speed] [-i seconds] file
+Play back a recording made with record, or by asciinema, with its original
+timing.
+
+Options:
+  -s speed     play speed times faster, e.g. 2 or 0.5
+  -i seconds   shorten pauses to at most seconds
+
+Examples:
+  replay cleanup.cast
+  replay -s 4 -i 1 cleanup.cast`,
+}
+
+// synopsis returns the first line of a builtin's help.
+func synopsis(b Builtin) string {
+	line, _, _ := strings.Cut(b.Help(), "\n")
+	return line
+}
+
+func handleHelp(env *Env, args []string) int {
+	registry := env.Shell.Registry()
+	if len(args) == 0 {
+		names := registry.Names()
+		width := 0
+		for _, name := range names {
+			width = max(width, len(name))
+		}
+		for _, name := range names {
+			b, _ := registry.Lookup(name)
+			fmt.Fprintf(env.Stdout, "%-*s  %s\n", width, name, synopsis(b))
+		}
+		fmt.Fprintln(env.Stdout, "\nType 'help name' or 'name --help' for details.")
+		return 0
+	}
+
+	status := 0
+	for _, name := range args {
+		b, ok := registry.Lookup(name)
+		if !ok {
+			fmt.Fprintf(env.Stderr, "help: no help for %s\n", name)
+			status = 1
+			continue
+		}
+		printUsage(env, b)
+	}
+	return status
+}
+
+func printUsage(env *Env, b Builtin) {
+	fmt.Fprintln(env.Stdout, "Usage: "+b.Help())
+}
@@ -0,0 +1,517 @@
+package shell
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config configures a new Interpreter. Only DB is required.
+type Config struct {
+	// DB is the shell database, as returned by OpenDB.
+	DB *sql.DB
+	// Registry holds the builtins; DefaultRegistry is used when nil.
+	Registry *Registry
+
+	// The interpreter's streams default to the process's standard streams.
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+
+	// Dir is the initial working directory, the process's by default.
+	Dir string
+	// Env holds the initial variables as "key=value" pairs, the process's
+	// environment by default.
+	Env []string
+
+	// Restricted confines the session for untrusted users: cd and the file
+	// builtins cannot leave Root, PATH, SHELL and ENV cannot be changed,
+	// output cannot be redirected to files and commands cannot be named by
+	// path.
+	Restricted bool
+	// Root is the directory a restricted session is confined to, Dir by
+	// default.
+	Root string
+
+	// RequireLogin ends Run as soon as no user is logged in, after logout or
+	// an idle timeout. It is meant for sessions that start with a login, like
+	// those of a Server.
+	RequireLogin bool
+
+	// Options lists the shell options to turn on, as with "set -o name".
+	Options []string
+}
+
+// Interpreter is a single shell session. Its working directory, variables,
+// logged in user and history are its own, so several interpreters can run in
+// one process.
+type Interpreter struct {
+	registry *Registry
+	db       *sql.DB
+	policy   passwordPolicy
+	limits   loginLimits
+
+	stdin  io.Reader
+	reader *bufio.Reader
+	lines  *lineReader
+	stdout io.Writer
+	stderr io.Writer
+
+	// mu guards dir, vars, arrays, the hashed commands, the ulimit settings
+	// and the shell options, which the commands of a pipeline share.
+	mu       sync.RWMutex
+	dir      string
+	vars     map[string]string
+	arrays   map[string][]string
+	commands map[string]*hashEntry
+	rlimits  map[int]uint64
+	settings map[string]bool
+
+	restricted   bool
+	root         string
+	requireLogin bool
+
+	recorder *recorder
+
+	user           string
+	sessionID      int64
+	sessionHistory []historyEntry
+
+	exited   bool
+	exitCode int
+}
+
+// New creates an interpreter. The password policy and login limits are read
+// from the environment (see passwordPolicy and loginLimits).
+func New(cfg Config) (*Interpreter, error) {
+	if cfg.DB == nil {
+		return nil, errors.New("shell: Config.DB is required")
+	}
+
+	policy, err := loadPasswordPolicy()
+	if err != nil {
+		return nil, fmt.Errorf("password policy: %w", err)
+	}
+	limits, err := loadLoginLimits()
+	if err != nil {
+		return nil, fmt.Errorf("login limits: %w", err)
+	}
+
+	in := &Interpreter{
+		registry: cfg.Registry,
+		db:       cfg.DB,
+		policy:   policy,
+		limits:   limits,
+		stdin:    cfg.Stdin,
+		stdout:   cfg.Stdout,
+		stderr:   cfg.Stderr,
+		dir:      cfg.Dir,
+		vars:     make(map[string]string),
+		arrays:   make(map[string][]string),
+		commands: make(map[string]*hashEntry),
+		rlimits:  make(map[int]uint64),
+		settings: make(map[string]bool),
+
+		requireLogin: cfg.RequireLogin,
+	}
+	if in.registry == nil {
+		in.registry = DefaultRegistry()
+	}
+	if in.stdin == nil {
+		in.stdin = os.Stdin
+	}
+	if in.stdout == nil {
+		in.stdout = os.Stdout
+	}
+	if in.stderr == nil {
+		in.stderr = os.Stderr
+	}
+	if in.dir == "" {
+		if in.dir, err = os.Getwd(); err != nil {
+			return nil, err
+		}
+	}
+	if in.dir, err = filepath.Abs(in.dir); err != nil {
+		return nil, err
+	}
+
+	environ := cfg.Env
+	if environ == nil {
+		environ = os.Environ()
+	}
+	for _, kv := range environ {
+		if name, value, ok := strings.Cut(kv, "="); ok {
+			in.vars[name] = value
+		}
+	}
+	in.vars["PWD"] = in.dir
+	for _, name := range cfg.Options {
+		if err := in.SetOption(name, true); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Restricted {
+		root := cfg.Root
+		if root == "" {
+			root = in.dir
+		}
+		if in.root, err = filepath.Abs(root); err == nil {
+			in.root, err = filepath.EvalSymlinks(in.root)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("restricted root: %w", err)
+		}
+		in.restricted = true
+		if !in.within(in.dir) {
+			return nil, fmt.Errorf("shell: %s is outside the restricted root %s", in.dir, in.root)
+		}
+	}
+
+	in.reader = bufio.NewReader(in.stdin)
+	in.lines = newLineReader(in.reader)
+	return in, nil
+}
+
+func (in *Interpreter) Registry() *Registry { return in.registry }
+
+func (in *Interpreter) DB() *sql.DB { return in.db }
+
+// User returns the logged in user, or "" for a guest session.
+func (in *Interpreter) User() string { return in.user }
+
+// Dir returns the working directory of the session.
+func (in *Interpreter) Dir() string {
+	in.mu.RLock()
+	defer in.mu.RUnlock()
+	return in.dir
+}
+
+// Chdir changes the working directory of the session; relative paths are
+// resolved against the current one.
+func (in *Interpreter) Chdir(dir string) error {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(in.dir, dir)
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return &os.PathError{Op: "chdir", Path: dir, Err: errors.New("not a directory")}
+	}
+	if in.restricted && !in.within(dir) {
+		return &os.PathError{Op: "chdir", Path: dir, Err: errRestricted}
+	}
+	in.vars["OLDPWD"] = in.dir
+	in.dir = filepath.Clean(dir)
+	in.vars["PWD"] = in.dir
+	return nil
+}
+
+func (in *Interpreter) Getenv(name string) string {
+	in.mu.RLock()
+	defer in.mu.RUnlock()
+	return in.vars[name]
+}
+
+// LookupEnv returns the value of a variable and whether it is set.
+func (in *Interpreter) LookupEnv(name string) (string, bool) {
+	in.mu.RLock()
+	defer in.mu.RUnlock()
+	value, ok := in.vars[name]
+	return value, ok
+}
+
+// Array returns the elements of an array variable, such as those set by
+// read -a, and whether it is set. Arrays are not passed to external commands.
+func (in *Interpreter) Array(name string) ([]string, bool) {
+	in.mu.RLock()
+	defer in.mu.RUnlock()
+	values, ok := in.arrays[name]
+	return values, ok
+}
+
+// SetArray sets an array variable.
+func (in *Interpreter) SetArray(name string, values []string) error {
+	if !validVarName.MatchString(name) {
+		return fmt.Errorf("%s: not a valid identifier", name)
+	}
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.arrays[name] = values
+	return nil
+}
+
+func (in *Interpreter) Setenv(name, value string) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.vars[name] = value
+	if name == "PATH" {
+		// Remembered lookups may no longer be what PATH finds.
+		clear(in.commands)
+	}
+}
+
+// Environ returns the variables as sorted "key=value" pairs, the form used
+// for the environment of external commands.
+func (in *Interpreter) Environ() []string {
+	in.mu.RLock()
+	defer in.mu.RUnlock()
+
+	environ := make([]string, 0, len(in.vars))
+	for name, value := range in.vars {
+		environ = append(environ, name+"="+value)
+	}
+	sort.Strings(environ)
+	return environ
+}
+
+// Exited reports whether the exit builtin was run, and with which status.
+func (in *Interpreter) Exited() (code int, exited bool) {
+	return in.exitCode, in.exited
+}
+
+// Run reads and executes commands until exit or the end of input and returns
+// the exit status.
+func (in *Interpreter) Run() int {
+	defer in.Close()
+
+	for !in.exited && (in.user != "" || !in.requireLogin) {
+		// Display prompt
+		prompt := "$ "
+		if in.user != "" {
+			prompt = in.user + ":$ "
+		}
+		fmt.Fprint(in.stdout, prompt)
+
+		// Read input, logging idle users out
+		timeout := time.Duration(0)
+		if in.user != "" {
+			timeout = in.idleTimeout()
+		}
+		line, timedOut, err := in.lines.readLine(timeout)
+		if timedOut {
+			fmt.Fprintf(in.stdout, "\nauto-logout: idle for %v\n", timeout)
+			in.switchUser("", "timeout")
+			continue
+		}
+		if err == io.EOF && line == "" {
+			fmt.Fprintln(in.stdout)
+			break
+		}
+		if err != nil && err != io.EOF {
+			// The input is gone, as when a connection is closed.
+			fmt.Fprintln(in.stderr, "Error reading input:", err)
+			break
+		}
+
+		in.Execute(line)
+	}
+	return in.exitCode
+}
+
+// Close ends the session of the logged in user, if any, and stops reading
+// input. The interpreter cannot be run again.
+func (in *Interpreter) Close() {
+	in.switchUser("", "exit")
+	if in.recorder != nil {
+		if err := in.StopRecording(); err != nil {
+			fmt.Fprintf(in.stderr, "Failed to save recording: %v\n", err)
+		}
+	}
+	in.lines.close()
+}
+
+// Execute runs a single command line and returns its exit status. With the
+// errexit option, a failing command line exits the shell.
+func (in *Interpreter) Execute(line string) int {
+	status := in.execute(line)
+	if status != 0 && !in.exited && in.Option("errexit") {
+		in.exited = true
+		in.exitCode = status
+	}
+	return status
+}
+
+// RunScript runs the command lines read from r without prompting, until the
+// input ends or the shell exits. It returns the status of the last command,
+// or the exit status.
+func (in *Interpreter) RunScript(r io.Reader) int {
+	br := bufio.NewReader(r)
+	status := 0
+	for !in.exited {
+		line, err := br.ReadString('\n')
+		if line != "" {
+			status = in.Execute(line)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fmt.Fprintln(in.stderr, "Error reading script:", err)
+			return 1
+		}
+	}
+	if in.exited {
+		return in.exitCode
+	}
+	return status
+}
+
+func (in *Interpreter) execute(line string) int {
+	// Split into arguments; lines starting with # are comments
+	line = strings.TrimSpace(line)
+	if strings.HasPrefix(line, "#") {
+		line = ""
+	}
+	args := splitArgs(line)
+	if len(args) == 0 {
+		in.recorder.input("")
+		return 0
+	}
+
+	// The time keyword times the whole pipeline.
+	timed := args[0] == "time"
+	words, pipeErr := splitPipeline(args[1:])
+	if !timed {
+		words, pipeErr = splitPipeline(args)
+	}
+	// Each word is expanded once, as expansions can have side effects, and
+	// the permissions are checked on the expanded commands that run. What
+	// history keeps depends on those commands too, so it is recorded after.
+	var cmds []stage
+	var expandErr error
+	if pipeErr == nil {
+		cmds = make([]stage, len(words))
+		for i, c := range words {
+			if cmds[i], expandErr = in.expandStage(c); expandErr != nil {
+				cmds = cmds[:i]
+				break
+			}
+		}
+	}
+	cmdNames := make([]string, len(cmds))
+	for i, c := range cmds {
+		cmdNames[i] = c.name()
+	}
+	entry := historyLine(line, args, cmdNames)
+	in.recorder.input(entry)
+
+	// Update history
+	if in.user != "" {
+		_, err := in.db.Exec("INSERT INTO command_history (username, command) VALUES (?, ?)", in.user, entry)
+		if err != nil {
+			fmt.Fprintf(in.stderr, "Failed to save history: %v\n", err)
+		}
+	} else {
+		in.sessionHistory = append(in.sessionHistory, historyEntry{command: entry, count: 1, lastUsed: time.Now()})
+	}
+
+	if timed && len(args) == 1 {
+		return in.timePipeline(nil)
+	}
+	if pipeErr != nil {
+		fmt.Fprintln(in.stderr, pipeErr)
+		return 2
+	}
+	if expandErr != nil {
+		fmt.Fprintln(in.stderr, expandErr)
+		return 1
+	}
+
+	// Check permissions of every command before running any of them
+	role, err := in.role()
+	if err != nil {
+		fmt.Fprintf(in.stderr, "%s: %v\n", args[0], err)
+		return 1
+	}
+	for _, c := range cmds {
+		name := c.name()
+		names := []string{name}
+		if name == "timeout" {
+			if inner := timeoutCommand(c.args); inner != "" {
+				names = append(names, inner)
+			}
+		}
+		if err := in.checkRestricted(c, names); err != nil {
+			fmt.Fprintln(in.stderr, err)
+			return 1
+		}
+		for _, cmd := range names {
+			allowed, err := commandAllowed(in.db, role, cmd)
+			if err != nil {
+				fmt.Fprintf(in.stderr, "%s: %v\n", cmd, err)
+				return 1
+			}
+			if !allowed {
+				in.audit(in.user, "denied", cmd, false, "role "+role)
+				fmt.Fprintf(in.stderr, "%s: permission denied\n", cmd)
+				return 1
+			}
+		}
+	}
+
+	if timed {
+		return in.timePipeline(cmds)
+	}
+	return in.runPipeline(cmds)
+}
+
+// role returns the role of the logged in user.
+func (in *Interpreter) role() (string, error) {
+	role, err := userRole(in.db, in.user)
+	if err == sql.ErrNoRows {
+		// The account was deleted from another session.
+		in.switchUser("", "deleted")
+		return roleGuest, nil
+	}
+	return role, err
+}
+
+// switchUser keeps the sessions table in sync whenever the logged in user
+// changes, whatever the reason.
+func (in *Interpreter) switchUser(username, reason string) {
+	if username == in.user {
+		return
+	}
+
+	now := time.Now()
+	if in.user != "" {
+		if err := endSession(in.db, in.sessionID, reason, now); err != nil {
+			fmt.Fprintf(in.stderr, "Failed to record session: %v\n", err)
+		}
+		in.audit(in.user, "logout", in.user, true, reason)
+	}
+	in.user = username
+	if in.user != "" {
+		var err error
+		if in.sessionID, err = startSession(in.db, in.user, now); err != nil {
+			fmt.Fprintf(in.stderr, "Failed to record session: %v\n", err)
+		}
+	}
+}
+
+// childStdin returns what an external command given r as its input should
+// read from. The shell's own input can only be handed over when it is a file
+// and nothing of it is buffered; otherwise children get no input.
+func (in *Interpreter) childStdin(r io.Reader) io.Reader {
+	if r != io.Reader(in.reader) {
+		return r
+	}
+	if f, ok := in.stdin.(*os.File); ok && in.reader.Buffered() == 0 {
+		return f
+	}
+	return nil
+}
@@ -0,0 +1,286 @@
+package shell
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// defaultKillAfter is how long timeout waits after SIGTERM before it sends
+// SIGKILL, unless -k says otherwise.
+const defaultKillAfter = 5 * time.Second
+
+// deadline stops an external command run by timeout: the command is sent
+// SIGTERM once after has passed, and SIGKILL if it is still running kill
+// later.
+type deadline struct {
+	after time.Duration
+	kill  time.Duration
+}
+
+// wait waits for cmd to finish. A command stopped by the deadline has status
+// 124, or 137 when it had to be killed. A nil deadline waits for ever.
+func (dl *deadline) wait(cmd *exec.Cmd) (int, error) {
+	if dl == nil {
+		return 0, cmd.Wait()
+	}
+	// Do not wait for output from children the command left behind.
+	cmd.WaitDelay = time.Second
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	select {
+	case err := <-done:
+		return 0, err
+	case <-time.After(dl.after):
+	}
+	cmd.Process.Signal(syscall.SIGTERM)
+	select {
+	case <-done:
+		return 124, nil
+	case <-time.After(dl.kill):
+	}
+	cmd.Process.Kill()
+	<-done
+	return 128 + int(syscall.SIGKILL), nil
+}
+
+// parseDuration parses a timeout duration: a number of seconds, or of
+// minutes, hours or days with an m, h or d suffix. Fractions are allowed.
+func parseDuration(s string) (time.Duration, error) {
+	unit, number := time.Second, s
+	if n := len(s); n > 0 {
+		switch s[n-1] {
+		case 's':
+			number = s[:n-1]
+		case 'm':
+			unit, number = time.Minute, s[:n-1]
+		case 'h':
+			unit, number = time.Hour, s[:n-1]
+		case 'd':
+			unit, number = 24*time.Hour, s[:n-1]
+		}
+	}
+	f, err := strconv.ParseFloat(number, 64)
+	if err != nil || f < 0 || number == "" || strings.ContainsAny(number, "xXpPnN") {
+		return 0, fmt.Errorf("invalid time interval '%s'", s)
+	}
+	return time.Duration(f * float64(unit)), nil
+}
+
+// timeout [-k duration] duration command [arg ...]
+func handleTimeout(env *Env, args []string) int {
+	opts, args, err := getopt(args, "k:")
+	if err != nil {
+		fmt.Fprintf(env.Stderr, "timeout: %v\n", err)
+		return 125
+	}
+	if len(args) < 2 {
+		fmt.Fprintln(env.Stderr, "timeout: missing operand")
+		return 125
+	}
+
+	dl := &deadline{kill: defaultKillAfter}
+	if dl.after, err = parseDuration(args[0]); err != nil {
+		fmt.Fprintf(env.Stderr, "timeout: %v\n", err)
+		return 125
+	}
+	if opts.has('k') {
+		if dl.kill, err = parseDuration(opts['k']); err != nil {
+			fmt.Fprintf(env.Stderr, "timeout: %v\n", err)
+			return 125
+		}
+	}
+	if dl.after == 0 {
+		// As with GNU timeout, a zero duration disables the timeout.
+		dl = nil
+	}
+	return executeExternalCommand(env, args[1], args[2:], dl)
+}
+
+// timeoutCommand returns the command run by a timeout stage, so that it is
+// subject to the same permission check as when run on its own.
+func timeoutCommand(args []string) string {
+	if len(args) == 0 {
+		return ""
+	}
+	_, rest, err := getopt(args[1:], "k:")
+	if err != nil || len(rest) < 2 {
+		return ""
+	}
+	return rest[1]
+}
+
+// resourceLimit describes a limit that ulimit sets for external commands.
+type resourceLimit struct {
+	option   byte
+	name     string
+	unit     string
+	resource int
+	// scale is the number of the resource's units in one of ulimit's.
+	scale uint64
+}
+
+// execLimitsEnv passes the limits to apply to the process that a program
+// re-runs itself as to start a limited command, as resource=value pairs
+// separated by commas.
+const execLimitsEnv = "GOSH_EXEC_LIMITS"
+
+// limitsEnabled is set once the program has called ExecLimited.
+var limitsEnabled atomic.Bool
+
+// ExecLimited lets the ulimit settings of a session apply to external
+// commands from their very start. Programs embedding the shell call it first
+// thing in main; without it, commands cannot be run under limits set with
+// ulimit.
+//
+// A limited command is started by running the program's own executable
+// again, so ExecLimited usually returns at once, but in that process it sets
+// the limits and replaces the process with the command, never returning.
+// Package initialization has run by then, so init functions should not
+// start work of their own.
+func ExecLimited() {
+	limitsEnabled.Store(true)
+	spec, ok := os.LookupEnv(execLimitsEnv)
+	if !ok {
+		return
+	}
+	err := execLimited(spec)
+	fmt.Fprintf(os.Stderr, "%s: cannot apply limits: %v\n", os.Args[0], err)
+	os.Exit(126)
+}
+
+// applyLimits makes cmd run with the session's ulimit settings.
+func (in *Interpreter) applyLimits(cmd *exec.Cmd) error {
+	in.mu.RLock()
+	defer in.mu.RUnlock()
+	if len(in.rlimits) == 0 {
+		return nil
+	}
+	return limitCommand(cmd, in.rlimits)
+}
+
+// rlimit returns the limit external commands of the session get: the one set
+// with ulimit, or else the shell's own.
+func (in *Interpreter) rlimit(resource int) (uint64, error) {
+	in.mu.RLock()
+	value, ok := in.rlimits[resource]
+	in.mu.RUnlock()
+	if ok {
+		return value, nil
+	}
+	value, _, err := getRlimit(resource)
+	return value, err
+}
+
+func formatLimit(l resourceLimit, value uint64) string {
+	if value == rlimInfinity {
+		return "unlimited"
+	}
+	return strconv.FormatUint(value/l.scale, 10)
+}
+
+// ulimit [-a] [-tvn [limit]]
+func handleUlimit(env *Env, args []string) int {
+	if len(resourceLimits) == 0 {
+		fmt.Fprintln(env.Stderr, "ulimit: not supported on this system")
+		return 1
+	}
+	spec := "a"
+	for _, l := range resourceLimits {
+		spec += string(l.option)
+	}
+	opts, args, err := getopt(args, spec)
+	if err != nil {
+		fmt.Fprintf(env.Stderr, "ulimit: %v\n", err)
+		return 1
+	}
+
+	var selected []resourceLimit
+	for _, l := range resourceLimits {
+		if opts.has(l.option) || opts.has('a') || len(opts) == 0 {
+			selected = append(selected, l)
+		}
+	}
+
+	if len(args) == 0 {
+		status := 0
+		for _, l := range selected {
+			value, err := env.Shell.rlimit(l.resource)
+			if err != nil {
+				fmt.Fprintf(env.Stderr, "ulimit: %s: %v\n", l.name, err)
+				status = 1
+				continue
+			}
+			if len(selected) == 1 {
+				fmt.Fprintln(env.Stdout, formatLimit(l, value))
+				continue
+			}
+			label := l.name + " ("
+			if l.unit != "" {
+				label += l.unit + ", "
+			}
+			label += "-" + string(l.option) + ")"
+			fmt.Fprintf(env.Stdout, "%-28s %s\n", label, formatLimit(l, value))
+		}
+		return status
+	}
+	if len(args) > 1 || len(selected) != 1 || opts.has('a') {
+		fmt.Fprintln(env.Stderr, "ulimit: too many arguments")
+		return 1
+	}
+
+	l := selected[0]
+	value := uint64(rlimInfinity)
+	if args[0] != "unlimited" {
+		n, err := strconv.ParseUint(args[0], 10, 64)
+		if err != nil {
+			fmt.Fprintf(env.Stderr, "ulimit: %s: invalid number\n", args[0])
+			return 1
+		}
+		value = n * l.scale
+	}
+	// Children cannot be given more than the shell itself may have.
+	_, hard, err := getRlimit(l.resource)
+	if err != nil {
+		fmt.Fprintf(env.Stderr, "ulimit: %s: %v\n", l.name, err)
+		return 1
+	}
+	if hard != rlimInfinity && value > hard {
+		fmt.Fprintf(env.Stderr, "ulimit: %s: cannot raise the limit above %s\n", l.name, formatLimit(l, hard))
+		return 1
+	}
+
+	in := env.Shell
+	in.mu.Lock()
+	in.rlimits[l.resource] = value
+	in.mu.Unlock()
+	return 0
+}
+
+// formatTime formats a duration as the time keyword reports it, e.g. 0m1.250s.
+func formatTime(d time.Duration) string {
+	return fmt.Sprintf("%dm%.3fs", int(d/time.Minute), (d % time.Minute).Seconds())
+}
+
+// timePipeline runs cmds for the time keyword and reports on stderr the real
+// time they took and the user and system CPU time of the shell and its
+// children.
+func (in *Interpreter) timePipeline(cmds []stage) int {
+	user, sys := cpuTimes()
+	start := time.Now()
+	status := 0
+	if len(cmds) > 0 {
+		status = in.runPipeline(cmds)
+	}
+	real := time.Since(start)
+	endUser, endSys := cpuTimes()
+
+	fmt.Fprintf(in.stderr, "\nreal\t%s\nuser\t%s\nsys\t%s\n", formatTime(real), formatTime(endUser-user), formatTime(endSys-sys))
+	return status
+}
@@ -0,0 +1,212 @@
+package shell
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const defaultDBPath = "./shell.db"
+
+// migration is a single forward step of the database schema. Migrations are
+// applied in order and each one runs inside its own transaction.
+type migration struct {
+	version     int
+	description string
+	statements  []string
+}
+
+// migrations must only ever be appended to; never edit a migration that has
+// already been released, add a new one instead.
+var migrations = []migration{
+	{
+		version:     1,
+		description: "create users and command_history",
+		// IF NOT EXISTS keeps this step safe for databases created before
+		// schema versioning existed.
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS users (
+				username TEXT PRIMARY KEY,
+				password_hash TEXT NOT NULL
+			)`,
+			`CREATE TABLE IF NOT EXISTS command_history (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				username TEXT,
+				command TEXT,
+				timestamp DATETIME DEFAULT CURRENT_TIMESTAMP
+			)`,
+		},
+	},
+	{
+		version:     2,
+		description: "index command_history by username",
+		statements: []string{
+			`CREATE INDEX IF NOT EXISTS idx_command_history_username ON command_history (username)`,
+		},
+	},
+	{
+		version:     3,
+		description: "create login_attempts",
+		statements: []string{
+			`CREATE TABLE login_attempts (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				username TEXT NOT NULL,
+				success INTEGER NOT NULL,
+				attempted_at DATETIME NOT NULL
+			)`,
+			`CREATE INDEX idx_login_attempts_username ON login_attempts (username)`,
+		},
+	},
+	{
+		version:     4,
+		description: "add roles and role_permissions",
+		statements: []string{
+			`ALTER TABLE users ADD COLUMN role TEXT NOT NULL DEFAULT 'user'`,
+			// Existing databases have no administrator yet; promote the
+			// oldest account.
+			`UPDATE users SET role = 'admin' WHERE rowid = (SELECT MIN(rowid) FROM users)`,
+			`CREATE TABLE role_permissions (
+				role TEXT NOT NULL,
+				command TEXT NOT NULL,
+				allowed INTEGER NOT NULL,
+				PRIMARY KEY (role, command)
+			)`,
+			`INSERT INTO role_permissions (role, command, allowed) VALUES
+				('admin', '*', 1),
+				('user', '*', 1),
+				('user', 'adduser', 0),
+				('user', 'deluser', 0),
+				('user', 'role', 0),
+				('user', 'perm', 0),
+				('guest', '*', 1),
+				('guest', 'adduser', 0),
+				('guest', 'deluser', 0),
+				('guest', 'role', 0),
+				('guest', 'perm', 0)`,
+		},
+	},
+	{
+		version:     5,
+		description: "create sessions",
+		statements: []string{
+			`CREATE TABLE sessions (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				username TEXT NOT NULL,
+				login_at DATETIME NOT NULL,
+				logout_at DATETIME,
+				logout_reason TEXT
+			)`,
+			`CREATE INDEX idx_sessions_username ON sessions (username)`,
+		},
+	},
+	{
+		version:     6,
+		description: "create audit_log",
+		statements: []string{
+			`CREATE TABLE audit_log (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				at DATETIME NOT NULL,
+				username TEXT NOT NULL,
+				action TEXT NOT NULL,
+				target TEXT NOT NULL,
+				success INTEGER NOT NULL,
+				detail TEXT NOT NULL
+			)`,
+			// The audit log is append-only.
+			`CREATE TRIGGER audit_log_no_update BEFORE UPDATE ON audit_log
+			BEGIN
+				SELECT RAISE(ABORT, 'audit_log is append-only');
+			END`,
+			`CREATE TRIGGER audit_log_no_delete BEFORE DELETE ON audit_log
+			BEGIN
+				SELECT RAISE(ABORT, 'audit_log is append-only');
+			END`,
+			`INSERT INTO role_permissions (role, command, allowed) VALUES
+				('user', 'audit', 0),
+				('guest', 'audit', 0)`,
+		},
+	},
+}
+
+// DatabasePath picks the database file: the --db flag wins over the GOSH_DB
+// environment variable, which wins over ./shell.db.
+func DatabasePath(flagValue string) string {
+	if flagValue != "" {
+		return flagValue
+	}
+	if env := os.Getenv("GOSH_DB"); env != "" {
+		return env
+	}
+	return defaultDBPath
+}
+
+// OpenDB opens the shell database at path and brings its schema up to date.
+func OpenDB(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func migrate(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_version (
+		version INTEGER PRIMARY KEY,
+		description TEXT NOT NULL,
+		applied_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	)`)
+	if err != nil {
+		return fmt.Errorf("migrate: %w", err)
+	}
+
+	current, err := schemaVersion(db)
+	if err != nil {
+		return fmt.Errorf("migrate: %w", err)
+	}
+
+	latest := migrations[len(migrations)-1].version
+	if current > latest {
+		return fmt.Errorf("migrate: database schema version %d is newer than supported version %d", current, latest)
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if err := applyMigration(db, m); err != nil {
+			return fmt.Errorf("migrate: version %d (%s): %w", m.version, m.description, err)
+		}
+	}
+	return nil
+}
+
+func schemaVersion(db *sql.DB) (int, error) {
+	var version int
+	err := db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version)
+	return version, err
+}
+
+func applyMigration(db *sql.DB, m migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, stmt := range m.statements {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec("INSERT INTO schema_version (version, description) VALUES (?, ?)", m.version, m.description)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
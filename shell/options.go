@@ -0,0 +1,55 @@
+package shell
+
+import (
+	"fmt"
+	"strings"
+)
+
+// options holds the parsed short options of a builtin. Options without an
+// argument map to "".
+type options map[byte]string
+
+func (o options) has(c byte) bool {
+	_, ok := o[c]
+	return ok
+}
+
+// getopt parses the leading short options of args. spec lists the accepted
+// option letters; a letter followed by ':' takes an argument, either joined
+// ("-n5") or as the next word ("-n 5"). Letters may be grouped ("-in").
+// Parsing stops at "--", at "-" and at the first word not starting with '-'.
+func getopt(args []string, spec string) (options, []string, error) {
+	opts := make(options)
+	for len(args) > 0 {
+		arg := args[0]
+		if arg == "--" {
+			return opts, args[1:], nil
+		}
+		if len(arg) < 2 || arg[0] != '-' {
+			break
+		}
+		args = args[1:]
+
+		for i := 1; i < len(arg); i++ {
+			c := arg[i]
+			at := strings.IndexByte(spec, c)
+			if c == ':' || at < 0 {
+				return nil, nil, fmt.Errorf("invalid option -- '%c'", c)
+			}
+			if at+1 >= len(spec) || spec[at+1] != ':' {
+				opts[c] = ""
+				continue
+			}
+			if i+1 < len(arg) {
+				opts[c] = arg[i+1:]
+			} else if len(args) > 0 {
+				opts[c] = args[0]
+				args = args[1:]
+			} else {
+				return nil, nil, fmt.Errorf("option requires an argument -- '%c'", c)
+			}
+			break
+		}
+	}
+	return opts, args, nil
+}
@@ -0,0 +1,204 @@
+package shell
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"main/passwordvalidator"
+
+	"golang.org/x/term"
+)
+
+var errPasswordMismatch = errors.New("passwords do not match")
+
+// passwordPolicy describes the rules a new password has to satisfy. It is
+// read from the environment at startup:
+//
+//	GOSH_PASSWORD_MIN_LENGTH        minimum number of characters (default 8)
+//	GOSH_PASSWORD_REQUIRE_DIGIT     require a digit (default true)
+//	GOSH_PASSWORD_REQUIRE_SPECIAL   require one of !@#$%^&*() (default true)
+type passwordPolicy struct {
+	minLength      int
+	requireDigit   bool
+	requireSpecial bool
+}
+
+var defaultPasswordPolicy = passwordPolicy{
+	minLength:      8,
+	requireDigit:   true,
+	requireSpecial: true,
+}
+
+func loadPasswordPolicy() (passwordPolicy, error) {
+	policy := defaultPasswordPolicy
+
+	if v := os.Getenv("GOSH_PASSWORD_MIN_LENGTH"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return policy, fmt.Errorf("GOSH_PASSWORD_MIN_LENGTH: invalid length %q", v)
+		}
+		policy.minLength = n
+	}
+	if v := os.Getenv("GOSH_PASSWORD_REQUIRE_DIGIT"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return policy, fmt.Errorf("GOSH_PASSWORD_REQUIRE_DIGIT: %w", err)
+		}
+		policy.requireDigit = b
+	}
+	if v := os.Getenv("GOSH_PASSWORD_REQUIRE_SPECIAL"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return policy, fmt.Errorf("GOSH_PASSWORD_REQUIRE_SPECIAL: %w", err)
+		}
+		policy.requireSpecial = b
+	}
+	return policy, nil
+}
+
+func (p passwordPolicy) validators(password string) []passwordvalidator.PasswordValidator {
+	validators := []passwordvalidator.PasswordValidator{
+		passwordvalidator.NewPasswordMinLengthValidator(password, p.minLength),
+	}
+	if p.requireDigit {
+		validators = append(validators, passwordvalidator.NewPasswordNumberValidator(password))
+	}
+	if p.requireSpecial {
+		validators = append(validators, passwordvalidator.NewPasswordSpecialCharValidator(password))
+	}
+	return validators
+}
+
+// check runs every validator of the policy and joins all violations, so the
+// user sees everything that is wrong with a password at once.
+func (p passwordPolicy) check(password string) error {
+	var errs []error
+	for _, v := range p.validators(password) {
+		if err := v.Validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func printPolicyViolations(w io.Writer, cmd string, err error) {
+	fmt.Fprintf(w, "%s: password does not meet the policy:\n", cmd)
+	for _, line := range strings.Split(err.Error(), "\n") {
+		fmt.Fprintf(w, "  - %s\n", line)
+	}
+}
+
+// passwordArgs maps commands that accept a password on the command line to
+// the position (among their non-redirection arguments) where passwords start.
+var passwordArgs = map[string]int{
+	"login":   1,
+	"adduser": 1,
+}
+
+// readPassword prompts for a password on the builtin's stdout and reads it
+// from its stdin. When that is the shell's own input and a terminal, the
+// password is read with echo disabled; otherwise the next line of input is
+// used, which keeps scripted, piped and redirected input working.
+func readPassword(env *Env, prompt string) (string, error) {
+	fmt.Fprint(env.Stdout, prompt)
+
+	in := env.Shell
+	if f, ok := in.stdin.(*os.File); ok && env.Stdin == io.Reader(in.reader) && term.IsTerminal(int(f.Fd())) {
+		password, err := term.ReadPassword(int(f.Fd()))
+		fmt.Fprintln(env.Stdout)
+		return string(password), err
+	}
+
+	line, err := env.ReadLine()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(line, "\r"), nil
+}
+
+// promptNewPassword asks for a new password twice and makes sure both
+// entries match.
+func promptNewPassword(env *Env) (string, error) {
+	password, err := readPassword(env, "New password: ")
+	if err != nil {
+		return "", err
+	}
+	confirm, err := readPassword(env, "Retype password: ")
+	if err != nil {
+		return "", err
+	}
+	if password != confirm {
+		return "", errPasswordMismatch
+	}
+	return password, nil
+}
+
+// historyLine returns the form of a command line that may be stored in
+// history: password arguments are dropped so they never reach the database.
+// names are the expanded command names of the pipeline stages, as far as
+// they are known; the words as written decide for the others, and either
+// naming a command taking a password is enough.
+func historyLine(line string, args []string, names []string) string {
+	prefix := ""
+	if args[0] == "time" {
+		prefix, args = "time ", args[1:]
+	}
+	cmds, err := splitPipeline(args)
+	if err != nil {
+		cmds = [][]string{args}
+	}
+	starts := make([]int, len(cmds))
+	redacted := false
+	for i, cmd := range cmds {
+		start, ok := passwordArgs[commandName(cmd)]
+		if i < len(names) {
+			if s, expanded := passwordArgs[names[i]]; expanded {
+				start, ok = s, true
+			}
+		}
+		starts[i] = -1
+		if ok {
+			starts[i] = start
+			redacted = true
+		}
+	}
+	if !redacted {
+		return line
+	}
+
+	stages := make([]string, len(cmds))
+	for i, cmd := range cmds {
+		stages[i] = redactPasswords(cmd, starts[i])
+	}
+	return prefix + strings.Join(stages, " | ")
+}
+
+// redactPasswords drops the arguments of a single command from position
+// start on, as counted in passwordArgs. A negative start keeps them all.
+func redactPasswords(args []string, start int) string {
+	if start < 0 {
+		return strings.Join(args, " ")
+	}
+
+	var kept []string
+	pos := -1
+	for i := 0; i < len(args); i++ {
+		if isRedirection(args[i]) {
+			kept = append(kept, args[i])
+			if i+1 < len(args) {
+				i++
+				kept = append(kept, args[i])
+			}
+			continue
+		}
+		if pos < start {
+			kept = append(kept, args[i])
+		}
+		pos++
+	}
+	return strings.Join(kept, " ")
+}
@@ -0,0 +1,270 @@
+package shell
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// splitPipeline splits the arguments of a command line at "|" into the
+// commands of a pipeline.
+func splitPipeline(args []string) ([][]string, error) {
+	var cmds [][]string
+	start := 0
+	for i, arg := range args {
+		if arg != "|" {
+			continue
+		}
+		if i == start {
+			return nil, errors.New("syntax error near unexpected token `|'")
+		}
+		cmds = append(cmds, args[start:i])
+		start = i + 1
+	}
+	if start == len(args) {
+		return nil, errors.New("syntax error near unexpected token `|'")
+	}
+	return append(cmds, args[start:]), nil
+}
+
+func isRedirection(arg string) bool {
+	switch arg {
+	case "<", ">", ">>", "1>", "1>>", "2>", "2>>":
+		return true
+	}
+	return false
+}
+
+// redirection is an operator of a command with the expanded file name it
+// applies to.
+type redirection struct {
+	op, file string
+}
+
+// stage is a command of a pipeline with its words expanded once, before
+// permissions are checked, so that the checks see exactly what runs.
+type stage struct {
+	args   []string
+	redirs []redirection
+	// keyword is "((" or "[[" for a compound command, whose single word
+	// in args is evaluated unexpanded.
+	keyword string
+}
+
+// name returns the command the stage runs.
+func (s stage) name() string {
+	if s.keyword != "" {
+		return s.keyword
+	}
+	if len(s.args) == 0 {
+		return ""
+	}
+	return s.args[0]
+}
+
+// expandStage separates the redirections of a pipeline stage from its
+// arguments and expands both, from left to right.
+func (in *Interpreter) expandStage(words []string) (stage, error) {
+	var st stage
+	var rest []string
+	for i := 0; i < len(words); i++ {
+		if isRedirection(words[i]) {
+			i++
+		} else {
+			rest = append(rest, words[i])
+		}
+	}
+	if len(rest) == 1 {
+		st.keyword = compoundCommand(rest[0])
+	}
+
+	for i := 0; i < len(words); i++ {
+		word := words[i]
+		if !isRedirection(word) {
+			if st.keyword == "" {
+				var err error
+				if word, err = in.expandWord(word); err != nil {
+					return stage{}, err
+				}
+			}
+			st.args = append(st.args, word)
+			continue
+		}
+		if i+1 >= len(words) {
+			return stage{}, fmt.Errorf("syntax error: no file specified for %s", word)
+		}
+		i++
+		file, err := in.expandWord(words[i])
+		if err != nil {
+			return stage{}, err
+		}
+		st.redirs = append(st.redirs, redirection{op: word, file: file})
+	}
+	return st, nil
+}
+
+// redirect applies redirs to env and returns the files it opened, which the
+// caller has to close once the command is done.
+func redirect(env *Env, redirs []redirection) ([]io.Closer, error) {
+	var files []io.Closer
+	for _, r := range redirs {
+		if r.op != "<" && env.Shell.restricted {
+			closeAll(files)
+			return nil, fmt.Errorf("%s: %w: cannot redirect output", r.file, errRestricted)
+		}
+		name := env.Path(r.file)
+
+		var file *os.File
+		var err error
+		switch r.op {
+		case "<":
+			file, err = os.Open(name)
+		case ">", "1>", "2>":
+			file, err = os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		default:
+			file, err = os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		}
+		if err != nil {
+			closeAll(files)
+			return nil, err
+		}
+		files = append(files, file)
+
+		switch r.op {
+		case "<":
+			env.Stdin = file
+		case "2>", "2>>":
+			env.Stderr = file
+		default:
+			env.Stdout = file
+		}
+	}
+	return files, nil
+}
+
+func closeAll(closers []io.Closer) {
+	for _, c := range closers {
+		c.Close()
+	}
+}
+
+// runPipeline runs the commands of a pipeline, each with its own streams,
+// and returns the exit status of the last one. A single command runs on the
+// calling goroutine; the commands of a longer pipeline run concurrently and
+// are connected with OS pipes, so external commands get real file
+// descriptors and a writer sees EPIPE as soon as its reader is gone.
+func (in *Interpreter) runPipeline(cmds []stage) int {
+	envs := make([]*Env, len(cmds))
+	closers := make([][]io.Closer, len(cmds))
+	var stdin io.Reader = in.reader
+	for i := range cmds {
+		envs[i] = &Env{Stdin: stdin, Stdout: in.stdout, Stderr: in.stderr, Shell: in, pipeline: len(cmds) > 1}
+		if i < len(cmds)-1 {
+			r, w, err := os.Pipe()
+			if err != nil {
+				fmt.Fprintf(in.stderr, "pipe: %v\n", err)
+				for _, c := range closers {
+					closeAll(c)
+				}
+				return 1
+			}
+			envs[i].Stdout = w
+			closers[i] = append(closers[i], w)
+			closers[i+1] = append(closers[i+1], r)
+			stdin = r
+		}
+	}
+
+	if len(cmds) == 1 {
+		return in.runCommand(envs[0], cmds[0], closers[0])
+	}
+
+	statuses := make([]int, len(cmds))
+	var wg sync.WaitGroup
+	for i := range cmds {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			statuses[i] = in.runCommand(envs[i], cmds[i], closers[i])
+		}()
+	}
+	wg.Wait()
+	if in.Option("pipefail") {
+		// The status of the last command that failed.
+		for i := len(statuses) - 1; i >= 0; i-- {
+			if statuses[i] != 0 {
+				return statuses[i]
+			}
+		}
+	}
+	return statuses[len(statuses)-1]
+}
+
+// runCommand applies the redirections of a single command and runs it. The
+// closers, the pipe ends of the command, are closed once it is done.
+func (in *Interpreter) runCommand(env *Env, st stage, closers []io.Closer) int {
+	defer closeAll(closers)
+
+	files, err := redirect(env, st.redirs)
+	if err != nil {
+		fmt.Fprintln(env.Stderr, err)
+		return 1
+	}
+	defer closeAll(files)
+	args := st.args
+	if len(args) == 0 {
+		return 0
+	}
+	if in.Option("xtrace") {
+		in.trace(args)
+	}
+	if st.keyword != "" {
+		if expr, ok := arithCommand(args[0]); ok {
+			return runArith(env, st.keyword, []string{expr})
+		}
+		inside, _ := condCommand(args[0])
+		return runCondition(env, st.keyword, splitWords(inside, false), true)
+	}
+
+	if b, ok := in.registry.Lookup(args[0]); ok {
+		if len(args) == 2 && args[1] == "--help" {
+			printUsage(env, b)
+			return 0
+		}
+		if env.pipeline && changesSession(args) {
+			fmt.Fprintf(env.Stderr, "%s: cannot change the session in a pipeline\n", args[0])
+			return 1
+		}
+		return b.Run(env, args[1:])
+	}
+	return executeExternalCommand(env, args[0], args[1:], nil)
+}
+
+// changesSession reports whether the builtin command args changes the
+// logged in user, the history or the recording of the session, or runs
+// commands that may, which the concurrent commands of a pipeline cannot do.
+// exit only ends its own command there.
+func changesSession(args []string) bool {
+	switch args[0] {
+	case "login", "logout", "deluser", "record", "source", ".":
+		return true
+	case "history":
+		return len(args) > 1 && args[1] == "clean"
+	}
+	return false
+}
+
+// commandName returns the command a pipeline stage runs, skipping any
+// redirections written before it.
+func commandName(args []string) string {
+	for i := 0; i < len(args); i++ {
+		if isRedirection(args[i]) {
+			i++
+			continue
+		}
+		return args[i]
+	}
+	return ""
+}
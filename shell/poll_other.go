@@ -0,0 +1,15 @@
+//go:build !unix
+
+package shell
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// waitInput would wait for f to have input to read; without poll(2) read
+// timeouts only work on inputs supporting read deadlines.
+func waitInput(f *os.File, timeout time.Duration) (bool, error) {
+	return false, errors.ErrUnsupported
+}
@@ -0,0 +1,26 @@
+//go:build unix
+
+package shell
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// waitInput waits up to timeout for f to have input to read, and reports
+// whether it has. It is used for files such as terminals, which do not
+// support read deadlines.
+func waitInput(f *os.File, timeout time.Duration) (bool, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		fds := []unix.PollFd{{Fd: int32(f.Fd()), Events: unix.POLLIN}}
+		n, err := unix.Poll(fds, int(max(time.Until(deadline).Milliseconds(), 0)))
+		if errors.Is(err, unix.EINTR) {
+			continue
+		}
+		return n > 0, err
+	}
+}
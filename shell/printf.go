@@ -0,0 +1,287 @@
+package shell
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// unescape interprets the backslash escapes in s and reports whether a \c,
+// which ends all output, was found. With echoOctal octal escapes are written
+// \0nnn as echo -e and printf %b expect them; otherwise \nnn as in a printf
+// format.
+func unescape(s string, echoOctal bool) (string, bool) {
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			i++
+			continue
+		}
+		text, n, stop := decodeEscape(s[i:], echoOctal)
+		if stop {
+			return b.String(), true
+		}
+		b.WriteString(text)
+		i += n
+	}
+	return b.String(), false
+}
+
+// decodeEscape decodes the escape sequence at the start of s, which begins
+// with a backslash, and returns its text and length.
+func decodeEscape(s string, echoOctal bool) (text string, n int, stop bool) {
+	if len(s) < 2 {
+		return s, len(s), false
+	}
+	switch c := s[1]; c {
+	case 'a':
+		return "\a", 2, false
+	case 'b':
+		return "\b", 2, false
+	case 'c':
+		return "", 2, true
+	case 'e', 'E':
+		return "\x1b", 2, false
+	case 'f':
+		return "\f", 2, false
+	case 'n':
+		return "\n", 2, false
+	case 'r':
+		return "\r", 2, false
+	case 't':
+		return "\t", 2, false
+	case 'v':
+		return "\v", 2, false
+	case '\\':
+		return "\\", 2, false
+	case '"', '\'':
+		if echoOctal {
+			break
+		}
+		return string(c), 2, false
+	case 'x':
+		if v, digits := parseDigits(s[2:], 16, 2); digits > 0 {
+			return string([]byte{byte(v)}), 2 + digits, false
+		}
+	case 'u', 'U':
+		size := 4
+		if c == 'U' {
+			size = 8
+		}
+		if v, digits := parseDigits(s[2:], 16, size); digits > 0 {
+			if v > utf8.MaxRune {
+				v = utf8.RuneError
+			}
+			return string(rune(v)), 2 + digits, false
+		}
+	default:
+		if echoOctal && c == '0' {
+			v, digits := parseDigits(s[2:], 8, 3)
+			return string([]byte{byte(v)}), 2 + digits, false
+		}
+		if !echoOctal && '0' <= c && c <= '7' {
+			v, digits := parseDigits(s[1:], 8, 3)
+			return string([]byte{byte(v)}), 1 + digits, false
+		}
+	}
+	return s[:2], 2, false
+}
+
+// parseDigits parses up to limit digits of the given base at the start of s.
+func parseDigits(s string, base, limit int) (int, int) {
+	v, n := 0, 0
+	for n < len(s) && n < limit {
+		d := strings.IndexByte("0123456789abcdef", lower(s[n]))
+		if d < 0 || d >= base {
+			break
+		}
+		v = v*base + d
+		n++
+	}
+	return v, n
+}
+
+func lower(c byte) byte {
+	if 'A' <= c && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+// shellQuote quotes s so that the shell reads it back as a single word.
+func shellQuote(s string) string {
+	if s == "" {
+		return "''"
+	}
+	if strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_-./=:,+@%") == "" {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// printer formats printf arguments, keeping track of how many were used.
+type printer struct {
+	env    *Env
+	args   []string
+	next   int
+	status int
+}
+
+func (p *printer) arg() string {
+	if p.next >= len(p.args) {
+		return ""
+	}
+	p.next++
+	return p.args[p.next-1]
+}
+
+// integer converts an argument for %d and friends. Like other shells, 'c
+// stands for the code of the character c.
+func (p *printer) integer(arg string) int64 {
+	if arg == "" {
+		return 0
+	}
+	if arg[0] == '\'' || arg[0] == '"' {
+		r, _ := utf8.DecodeRuneInString(arg[1:])
+		return int64(r)
+	}
+	n, err := strconv.ParseInt(arg, 0, 64)
+	if err != nil {
+		fmt.Fprintf(p.env.Stderr, "printf: %s: invalid number\n", arg)
+		p.status = 1
+	}
+	return n
+}
+
+func (p *printer) float(arg string) float64 {
+	if arg == "" {
+		return 0
+	}
+	f, err := strconv.ParseFloat(arg, 64)
+	if err != nil {
+		fmt.Fprintf(p.env.Stderr, "printf: %s: invalid number\n", arg)
+		p.status = 1
+	}
+	return f
+}
+
+// format writes format once to out, reading arguments as the directives
+// need them. It reports whether output has to stop, after a \c or an invalid
+// directive.
+func (p *printer) format(out *strings.Builder, format string) bool {
+	for i := 0; i < len(format); i++ {
+		c := format[i]
+		if c == '\\' {
+			text, n, stop := decodeEscape(format[i:], false)
+			if stop {
+				return true
+			}
+			out.WriteString(text)
+			i += n - 1
+			continue
+		}
+		if c != '%' {
+			out.WriteByte(c)
+			continue
+		}
+		if i+1 < len(format) && format[i+1] == '%' {
+			out.WriteByte('%')
+			i++
+			continue
+		}
+
+		// %[flags][width][.precision]verb
+		spec := "%"
+		j := i + 1
+		for j < len(format) && strings.IndexByte("-+ #0", format[j]) >= 0 {
+			spec += format[j : j+1]
+			j++
+		}
+		for _, part := range []string{"width", "precision"} {
+			if part == "precision" {
+				if j >= len(format) || format[j] != '.' {
+					break
+				}
+				spec += "."
+				j++
+			}
+			if j < len(format) && format[j] == '*' {
+				spec += strconv.FormatInt(p.integer(p.arg()), 10)
+				j++
+				continue
+			}
+			for j < len(format) && '0' <= format[j] && format[j] <= '9' {
+				spec += format[j : j+1]
+				j++
+			}
+		}
+		if j >= len(format) {
+			fmt.Fprintf(p.env.Stderr, "printf: %s: missing format character\n", format[i:])
+			p.status = 1
+			return true
+		}
+
+		switch verb := format[j]; verb {
+		case 's':
+			fmt.Fprintf(out, spec+"s", p.arg())
+		case 'q':
+			fmt.Fprintf(out, spec+"s", shellQuote(p.arg()))
+		case 'b':
+			text, stop := unescape(p.arg(), true)
+			fmt.Fprintf(out, spec+"s", text)
+			if stop {
+				return true
+			}
+		case 'c':
+			arg := p.arg()
+			r, _ := utf8.DecodeRuneInString(arg)
+			if arg == "" {
+				fmt.Fprintf(out, spec+"s", "")
+			} else {
+				fmt.Fprintf(out, spec+"c", r)
+			}
+		case 'd', 'i':
+			fmt.Fprintf(out, spec+"d", p.integer(p.arg()))
+		case 'u', 'x', 'X', 'o':
+			if verb == 'u' {
+				verb = 'd'
+			}
+			fmt.Fprintf(out, spec+string(verb), uint64(p.integer(p.arg())))
+		case 'f', 'F', 'e', 'E', 'g', 'G':
+			if verb == 'F' {
+				verb = 'f'
+			}
+			fmt.Fprintf(out, spec+string(verb), p.float(p.arg()))
+		default:
+			fmt.Fprintf(p.env.Stderr, "printf: %%%c: invalid directive\n", verb)
+			p.status = 1
+			return true
+		}
+		i = j
+	}
+	return false
+}
+
+// handlePrintf writes its arguments according to a format. The format is
+// reused until all arguments are consumed.
+func handlePrintf(env *Env, args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(env.Stderr, "printf: missing format")
+		return 1
+	}
+	p := &printer{env: env, args: args[1:]}
+	var out strings.Builder
+	for {
+		start := p.next
+		if stop := p.format(&out, args[0]); stop {
+			break
+		}
+		if p.next == start || p.next >= len(p.args) {
+			break
+		}
+	}
+	fmt.Fprint(env.Stdout, out.String())
+	return p.status
+}
@@ -0,0 +1,259 @@
+package shell
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// defaultIFS separates the fields read when IFS is unset.
+const defaultIFS = " \t\n"
+
+// readTimeoutStatus is the status of read when its time is up, 128 plus
+// SIGALRM as other shells report it.
+const readTimeoutStatus = 142
+
+// read [-rs] [-p prompt] [-t timeout] [-a array | name ...]
+func handleRead(env *Env, args []string) int {
+	opts, names, err := getopt(args, "rsp:t:a:")
+	if err != nil {
+		fmt.Fprintf(env.Stderr, "read: %v\n", err)
+		return 1
+	}
+	var timeout time.Duration
+	if opts.has('t') {
+		if timeout, err = parseDuration(opts['t']); err != nil || timeout == 0 {
+			fmt.Fprintf(env.Stderr, "read: %s: invalid timeout\n", opts['t'])
+			return 1
+		}
+	}
+	if opts.has('a') {
+		names = []string{opts['a']}
+	}
+	for _, name := range names {
+		if !validVarName.MatchString(name) {
+			fmt.Fprintf(env.Stderr, "read: %s: not a valid identifier\n", name)
+			return 1
+		}
+	}
+
+	// The prompt is for someone typing, so only shown when reading the
+	// shell's own input.
+	in := env.Shell
+	if opts.has('p') && env.Stdin == io.Reader(in.reader) {
+		fmt.Fprint(env.Stderr, opts['p'])
+	}
+
+	status := 0
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	line, err := readInput(env, deadline, opts.has('s'))
+	// Without -r, a backslash at the end of the line continues it on the
+	// next one.
+	for err == nil && !opts.has('r') && continued(line) {
+		var next string
+		next, err = readInput(env, deadline, opts.has('s'))
+		line = line[:len(line)-1] + next
+	}
+	switch {
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		status = readTimeoutStatus
+	case err == io.EOF:
+		status = 1
+	case err != nil:
+		fmt.Fprintf(env.Stderr, "read: %v\n", err)
+		return 1
+	}
+
+	var text []rune
+	var literal []bool
+	if opts.has('r') {
+		text = []rune(line)
+		literal = make([]bool, len(text))
+	} else {
+		text, literal = unescapeInput(line)
+	}
+	ifs, ok := in.LookupEnv("IFS")
+	if !ok {
+		ifs = defaultIFS
+	}
+
+	switch {
+	case opts.has('a'):
+		err = in.SetArray(opts['a'], splitFields(text, literal, ifs, 0))
+	case len(names) == 0:
+		err = in.assign("REPLY", string(text))
+	default:
+		fields := splitFields(text, literal, ifs, len(names))
+		for i, name := range names {
+			value := ""
+			if i < len(fields) {
+				value = fields[i]
+			}
+			if err = in.assign(name, value); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(env.Stderr, "read: %v\n", err)
+		return 1
+	}
+	return status
+}
+
+// readInput reads a line of the builtin's input, giving up at deadline if
+// it is not zero. Inputs supporting read deadlines, such as pipes and
+// network connections, use one. A terminal makes a line readable only once
+// it is complete, so it is polled before reading; other files are polled
+// before each byte. With silent, a terminal does not echo what is typed.
+func readInput(env *Env, deadline time.Time, silent bool) (string, error) {
+	in := env.Shell
+	src := env.Stdin
+	own := src == io.Reader(in.reader)
+	buffered := own && in.reader.Buffered() > 0
+	if own {
+		src = in.stdin
+	}
+	// Fd puts a file in blocking mode, which disables read deadlines, so
+	// whether it is a terminal is checked only once they are set.
+	f, _ := src.(*os.File)
+	terminal := func() bool { return f != nil && term.IsTerminal(int(f.Fd())) }
+
+	if !deadline.IsZero() {
+		if d, ok := src.(interface{ SetReadDeadline(time.Time) error }); ok && d.SetReadDeadline(deadline) == nil {
+			defer d.SetReadDeadline(time.Time{})
+		} else if !terminal() {
+			return readLineBefore(env, f, deadline)
+		} else if !buffered {
+			ready, err := waitInput(f, time.Until(deadline))
+			if err == nil && !ready {
+				return "", os.ErrDeadlineExceeded
+			}
+		}
+	}
+
+	if own && silent && !buffered && terminal() {
+		line, err := term.ReadPassword(int(f.Fd()))
+		fmt.Fprintln(env.Stderr)
+		return string(line), err
+	}
+	return env.ReadLine()
+}
+
+// readLineBefore reads a line as Env.ReadLine does, giving up at deadline.
+// The time is checked after each byte, so that inputs that are always ready,
+// such as /dev/zero, time out too, and f, the file underlying the input if
+// any, is polled before each read, so that a partial line does.
+func readLineBefore(env *Env, f *os.File, deadline time.Time) (string, error) {
+	in := env.Shell
+	own := env.Stdin == io.Reader(in.reader)
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		if !time.Now().Before(deadline) {
+			return "", os.ErrDeadlineExceeded
+		}
+		if f != nil && !(own && in.reader.Buffered() > 0) {
+			ready, err := waitInput(f, time.Until(deadline))
+			if err == nil && !ready {
+				return "", os.ErrDeadlineExceeded
+			}
+		}
+
+		n, err := env.Stdin.Read(b)
+		if n == 1 {
+			if b[0] == '\n' {
+				return string(line), nil
+			}
+			line = append(line, b[0])
+		}
+		if err == io.EOF && len(line) > 0 {
+			return string(line), nil
+		}
+		if err != nil {
+			return string(line), err
+		}
+	}
+}
+
+// continued reports whether line ends with an unescaped backslash.
+func continued(line string) bool {
+	n := len(line) - len(strings.TrimRight(line, `\`))
+	return n%2 == 1
+}
+
+// unescapeInput removes the backslashes of a line read without -r. The
+// characters they escaped are marked literal, so that they do not separate
+// fields.
+func unescapeInput(line string) ([]rune, []bool) {
+	var text []rune
+	var literal []bool
+	escaped := false
+	for _, r := range line {
+		switch {
+		case escaped:
+			text, literal = append(text, r), append(literal, true)
+			escaped = false
+		case r == '\\':
+			escaped = true
+		default:
+			text, literal = append(text, r), append(literal, false)
+		}
+	}
+	return text, literal
+}
+
+// splitFields splits text into fields at the characters of ifs that are not
+// literal. Runs of blanks in ifs count as one separator and are trimmed at
+// both ends, while each other character of ifs ends a field. With n > 0 the
+// last of the n fields gets the rest of the text, separators included.
+func splitFields(text []rune, literal []bool, ifs string, n int) []string {
+	blank := func(i int) bool {
+		return !literal[i] && strings.ContainsRune(ifs, text[i]) && strings.ContainsRune(defaultIFS, text[i])
+	}
+	separator := func(i int) bool {
+		return !literal[i] && strings.ContainsRune(ifs, text[i])
+	}
+
+	start, end := 0, len(text)
+	for start < end && blank(start) {
+		start++
+	}
+	for end > start && blank(end-1) {
+		end--
+	}
+
+	var fields []string
+	for i := start; i < end; {
+		if n > 0 && len(fields) == n-1 {
+			fields = append(fields, string(text[i:end]))
+			break
+		}
+		j := i
+		for j < end && !separator(j) {
+			j++
+		}
+		fields = append(fields, string(text[i:j]))
+
+		// A separator is blanks around at most one other character of ifs.
+		for j < end && blank(j) {
+			j++
+		}
+		if j < end && separator(j) {
+			j++
+			for j < end && blank(j) {
+				j++
+			}
+		}
+		i = j
+	}
+	return fields
+}
@@ -0,0 +1,275 @@
+package shell
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/term"
+)
+
+// Sessions are recorded in the asciicast v2 format of asciinema: a JSON
+// header line followed by one [time, kind, data] line per event, where time
+// is in seconds since the start, kind is "o" for output and "i" for input.
+
+// castHeader is the first line of an asciicast v2 file.
+type castHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp,omitempty"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// recorder writes the events of a session. A nil recorder records nothing.
+type recorder struct {
+	mu     sync.Mutex
+	enc    *json.Encoder
+	closer io.Closer
+	start  time.Time
+	err    error
+
+	// The streams the recorder was installed over, restored on stop.
+	stdout, stderr io.Writer
+}
+
+func (r *recorder) event(kind, data string) {
+	if data == "" || r.err != nil {
+		return
+	}
+	t := math.Round(time.Since(r.start).Seconds()*1e6) / 1e6
+	r.err = r.enc.Encode([]any{t, kind, data})
+}
+
+// terminalText converts newlines to the carriage return and line feed a
+// terminal outputs, which players expect.
+func terminalText(s string) string {
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	return strings.ReplaceAll(s, "\n", "\r\n")
+}
+
+// input records a command line. A terminal echoes what is typed, so the line
+// is recorded as output too.
+func (r *recorder) input(line string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.event("i", line+"\n")
+	r.event("o", terminalText(line+"\n"))
+}
+
+// recordWriter copies what is written to a stream into the recording.
+type recordWriter struct {
+	w io.Writer
+	r *recorder
+	// pending holds the start of a UTF-8 sequence split across writes.
+	pending []byte
+}
+
+func (rw *recordWriter) Write(p []byte) (int, error) {
+	n, err := rw.w.Write(p)
+
+	rw.r.mu.Lock()
+	defer rw.r.mu.Unlock()
+	data := append(rw.pending, p[:n]...)
+	end := len(data)
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				end = i
+			}
+			break
+		}
+	}
+	rw.r.event("o", terminalText(string(data[:end])))
+	rw.pending = append([]byte(nil), data[end:]...)
+	return n, err
+}
+
+// StartRecording records the session to w in the asciicast v2 format until
+// StopRecording is called: the command lines, with passwords removed, and
+// all output. w is closed on stop if it is an io.Closer.
+func (in *Interpreter) StartRecording(w io.Writer, title string) error {
+	if in.recorder != nil {
+		return errors.New("already recording")
+	}
+
+	width, height := 80, 24
+	if f, ok := in.stdout.(*os.File); ok {
+		if w, h, err := term.GetSize(int(f.Fd())); err == nil {
+			width, height = w, h
+		}
+	}
+	header := castHeader{
+		Version:   2,
+		Width:     width,
+		Height:    height,
+		Timestamp: time.Now().Unix(),
+		Title:     title,
+		Env:       map[string]string{"SHELL": "gosh", "TERM": in.Getenv("TERM")},
+	}
+
+	r := &recorder{enc: json.NewEncoder(w), start: time.Now(), stdout: in.stdout, stderr: in.stderr}
+	r.enc.SetEscapeHTML(false)
+	if c, ok := w.(io.Closer); ok {
+		r.closer = c
+	}
+	if err := r.enc.Encode(header); err != nil {
+		return err
+	}
+
+	in.recorder = r
+	in.stdout = &recordWriter{w: r.stdout, r: r}
+	in.stderr = &recordWriter{w: r.stderr, r: r}
+	return nil
+}
+
+// StopRecording ends the recording and reports any error writing it.
+func (in *Interpreter) StopRecording() error {
+	r := in.recorder
+	if r == nil {
+		return errors.New("not recording")
+	}
+	in.recorder = nil
+	in.stdout, in.stderr = r.stdout, r.stderr
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := r.err
+	if r.closer != nil {
+		if cerr := r.closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// record [-t title] file | record stop
+func handleRecord(env *Env, args []string) int {
+	opts, args, err := getopt(args, "t:")
+	if err != nil {
+		fmt.Fprintf(env.Stderr, "record: %v\n", err)
+		return 1
+	}
+	in := env.Shell
+	switch {
+	case len(args) == 0:
+		if in.recorder == nil {
+			fmt.Fprintln(env.Stdout, "not recording")
+		} else {
+			fmt.Fprintf(env.Stdout, "recording since %s\n", in.recorder.start.Format(time.TimeOnly))
+		}
+		return 0
+	case len(args) > 1:
+		fmt.Fprintln(env.Stderr, "record: too many arguments")
+		return 1
+	case args[0] == "stop":
+		if err := in.StopRecording(); err != nil {
+			fmt.Fprintf(env.Stderr, "record: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	if in.restricted {
+		fmt.Fprintf(env.Stderr, "record: %v\n", errRestricted)
+		return 1
+	}
+	if in.recorder != nil {
+		fmt.Fprintln(env.Stderr, "record: already recording")
+		return 1
+	}
+	f, err := os.Create(env.Path(args[0]))
+	if err != nil {
+		fmt.Fprintf(env.Stderr, "record: %v\n", err)
+		return 1
+	}
+	if err := in.StartRecording(f, opts['t']); err != nil {
+		f.Close()
+		fmt.Fprintf(env.Stderr, "record: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// replay [-s speed] [-i idle] file
+func handleReplay(env *Env, args []string) int {
+	opts, args, err := getopt(args, "s:i:")
+	if err != nil {
+		fmt.Fprintf(env.Stderr, "replay: %v\n", err)
+		return 1
+	}
+	if len(args) != 1 {
+		fmt.Fprintln(env.Stderr, "replay: expected a single file")
+		return 1
+	}
+	speed, idle := 1.0, math.Inf(1)
+	if opts.has('s') {
+		if speed, err = strconv.ParseFloat(opts['s'], 64); err != nil || speed <= 0 {
+			fmt.Fprintf(env.Stderr, "replay: invalid speed %s\n", opts['s'])
+			return 1
+		}
+	}
+	if opts.has('i') {
+		if idle, err = strconv.ParseFloat(opts['i'], 64); err != nil || idle <= 0 {
+			fmt.Fprintf(env.Stderr, "replay: invalid idle limit %s\n", opts['i'])
+			return 1
+		}
+	}
+
+	f, err := os.Open(env.Path(args[0]))
+	if err != nil {
+		fmt.Fprintf(env.Stderr, "replay: %v\n", err)
+		return 1
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	var header castHeader
+	if !scanner.Scan() || json.Unmarshal(scanner.Bytes(), &header) != nil || header.Version != 2 {
+		fmt.Fprintf(env.Stderr, "replay: %s: not an asciicast v2 file\n", args[0])
+		return 1
+	}
+
+	// Pauses longer than idle are shortened to idle before applying speed.
+	var last, clock float64
+	begin := time.Now()
+	for line := 2; scanner.Scan(); line++ {
+		var event []json.RawMessage
+		var at float64
+		var kind, data string
+		if json.Unmarshal(scanner.Bytes(), &event) != nil || len(event) != 3 ||
+			json.Unmarshal(event[0], &at) != nil || json.Unmarshal(event[1], &kind) != nil ||
+			json.Unmarshal(event[2], &data) != nil {
+			fmt.Fprintf(env.Stderr, "replay: %s:%d: invalid event\n", args[0], line)
+			return 1
+		}
+		if kind != "o" {
+			continue
+		}
+		clock += min(max(at-last, 0), idle)
+		last = at
+		time.Sleep(time.Until(begin.Add(time.Duration(clock / speed * float64(time.Second)))))
+		if _, err := io.WriteString(env.Stdout, data); err != nil {
+			return 1
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintf(env.Stderr, "replay: %v\n", err)
+		return 1
+	}
+	return 0
+}
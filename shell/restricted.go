@@ -0,0 +1,81 @@
+package shell
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// errRestricted is returned for whatever restricted mode refuses.
+var errRestricted = errors.New("restricted")
+
+// restrictedVars cannot be changed in restricted mode, since they decide
+// which programs run.
+var restrictedVars = map[string]bool{"PATH": true, "SHELL": true, "ENV": true}
+
+// Restricted reports whether the session runs in restricted mode.
+func (in *Interpreter) Restricted() bool { return in.restricted }
+
+// within reports whether dir, an absolute path, lies inside the root of a
+// restricted session once symbolic links are resolved.
+func (in *Interpreter) within(dir string) bool {
+	resolved, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(in.root, resolved)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// confine refuses a path that a file builtin of a restricted session would
+// change outside the root. A path that does not exist yet is judged by the
+// nearest directory above it that does.
+func (in *Interpreter) confine(path string) error {
+	if !in.restricted {
+		return nil
+	}
+	for {
+		_, err := os.Lstat(path)
+		if err == nil || filepath.Dir(path) == path {
+			break
+		}
+		path = filepath.Dir(path)
+	}
+	if !in.within(path) {
+		return fmt.Errorf("%w: outside the root directory", errRestricted)
+	}
+	return nil
+}
+
+// assign sets a variable on behalf of a command, refusing the variables that
+// restricted mode protects.
+func (in *Interpreter) assign(name, value string) error {
+	if in.restricted && restrictedVars[name] {
+		return fmt.Errorf("%s: %w", name, errRestricted)
+	}
+	in.Setenv(name, value)
+	return nil
+}
+
+// checkRestricted refuses a pipeline stage that restricted mode does not
+// allow before anything runs: one redirecting output, or running a command
+// named by a path, which would escape PATH. names are the commands the stage
+// runs. redirect refuses output redirections as well.
+func (in *Interpreter) checkRestricted(st stage, names []string) error {
+	if !in.restricted {
+		return nil
+	}
+	for _, name := range names {
+		if strings.Contains(name, "/") {
+			return fmt.Errorf("%s: %w: cannot specify '/' in command names", name, errRestricted)
+		}
+	}
+	for _, r := range st.redirs {
+		if r.op != "<" {
+			return fmt.Errorf("%s: %w: cannot redirect output", r.file, errRestricted)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+//go:build linux
+
+package shell
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const rlimInfinity = unix.RLIM_INFINITY
+
+var resourceLimits = []resourceLimit{
+	{'t', "cpu time", "seconds", unix.RLIMIT_CPU, 1},
+	{'v', "virtual memory", "kbytes", unix.RLIMIT_AS, 1024},
+	{'n', "open files", "", unix.RLIMIT_NOFILE, 1},
+}
+
+// getRlimit returns the shell's own soft and hard limit of resource.
+func getRlimit(resource int) (uint64, uint64, error) {
+	var lim unix.Rlimit
+	if err := unix.Getrlimit(resource, &lim); err != nil {
+		return 0, 0, err
+	}
+	return lim.Cur, lim.Max, nil
+}
+
+// limitCommand makes cmd start by running the program's own executable,
+// which sets limits on itself in ExecLimited and then executes the command,
+// so that the command runs with them from its first instruction.
+func limitCommand(cmd *exec.Cmd, limits map[int]uint64) error {
+	if !limitsEnabled.Load() {
+		return errors.New("the program does not call shell.ExecLimited")
+	}
+	var spec []string
+	for resource, value := range limits {
+		spec = append(spec, fmt.Sprintf("%d=%d", resource, value))
+	}
+	cmd.Args = append([]string{cmd.Args[0], cmd.Path}, cmd.Args[1:]...)
+	cmd.Path = "/proc/self/exe"
+	cmd.Env = append(cmd.Env, execLimitsEnv+"="+strings.Join(spec, ","))
+	return nil
+}
+
+// execLimited sets the limits in spec and executes the command in os.Args:
+// the name it runs as, its path and its arguments.
+func execLimited(spec string) error {
+	if len(os.Args) < 2 {
+		return errors.New("no command")
+	}
+	var env []string
+	for _, v := range os.Environ() {
+		if !strings.HasPrefix(v, execLimitsEnv+"=") {
+			env = append(env, v)
+		}
+	}
+	argv := append([]string{os.Args[0]}, os.Args[2:]...)
+
+	for _, pair := range strings.Split(spec, ",") {
+		resource, value, ok := strings.Cut(pair, "=")
+		r, err := strconv.Atoi(resource)
+		if err != nil || !ok {
+			return fmt.Errorf("invalid limit %q", pair)
+		}
+		v, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid limit %q", pair)
+		}
+		// syscall.Setrlimit, unlike unix.Setrlimit, also keeps Exec from
+		// restoring the open files limit Go raised at startup.
+		if err := syscall.Setrlimit(r, &syscall.Rlimit{Cur: v, Max: v}); err != nil {
+			return err
+		}
+	}
+	return syscall.Exec(os.Args[1], argv, env)
+}
+
+// cpuTimes returns the user and system time used by the shell and its
+// waited for children.
+func cpuTimes() (time.Duration, time.Duration) {
+	var self, children syscall.Rusage
+	syscall.Getrusage(syscall.RUSAGE_SELF, &self)
+	syscall.Getrusage(syscall.RUSAGE_CHILDREN, &children)
+	user := time.Duration(self.Utime.Nano() + children.Utime.Nano())
+	sys := time.Duration(self.Stime.Nano() + children.Stime.Nano())
+	return user, sys
+}
@@ -0,0 +1,31 @@
+//go:build !linux
+
+package shell
+
+import (
+	"errors"
+	"os/exec"
+	"time"
+)
+
+// Resource limits are only supported on Linux.
+
+const rlimInfinity = ^uint64(0)
+
+var resourceLimits []resourceLimit
+
+func getRlimit(resource int) (uint64, uint64, error) {
+	return 0, 0, errors.ErrUnsupported
+}
+
+func limitCommand(cmd *exec.Cmd, limits map[int]uint64) error {
+	return errors.ErrUnsupported
+}
+
+func execLimited(spec string) error {
+	return errors.ErrUnsupported
+}
+
+func cpuTimes() (time.Duration, time.Duration) {
+	return 0, 0
+}
@@ -0,0 +1,174 @@
+package shell
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+const (
+	roleAdmin = "admin"
+	roleUser  = "user"
+	// roleGuest applies to sessions in which nobody is logged in.
+	roleGuest = "guest"
+)
+
+// alwaysAllowed commands can never be denied, so no role can get stuck in
+// the shell.
+var alwaysAllowed = map[string]bool{
+	"exit":   true,
+	"logout": true,
+}
+
+// userRole returns the role of username, or roleGuest when nobody is logged in.
+func userRole(db *sql.DB, username string) (string, error) {
+	if username == "" {
+		return roleGuest, nil
+	}
+	var role string
+	err := db.QueryRow("SELECT role FROM users WHERE username = ?", username).Scan(&role)
+	return role, err
+}
+
+// commandAllowed reports whether role may run cmd. A rule for the command
+// itself takes precedence over the role's "*" rule; without any matching
+// rule the command is denied.
+func commandAllowed(db *sql.DB, role, cmd string) (bool, error) {
+	if alwaysAllowed[cmd] {
+		return true, nil
+	}
+	// The very first account has to be created by somebody; it becomes the
+	// administrator.
+	if cmd == "adduser" {
+		var users int
+		if err := db.QueryRow("SELECT COUNT(*) FROM users").Scan(&users); err != nil {
+			return false, err
+		}
+		if users == 0 {
+			return true, nil
+		}
+	}
+
+	var allowed bool
+	err := db.QueryRow(`
+		SELECT allowed FROM role_permissions
+		WHERE role = ? AND command IN (?, '*')
+		ORDER BY command = '*'
+		LIMIT 1
+	`, role, cmd).Scan(&allowed)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return allowed, err
+}
+
+func roleExists(db *sql.DB, role string) (bool, error) {
+	var n int
+	err := db.QueryRow("SELECT COUNT(*) FROM role_permissions WHERE role = ?", role).Scan(&n)
+	return n > 0, err
+}
+
+func handleRole(env *Env, args []string) int {
+	currentUser := env.Shell.User()
+	if len(args) < 1 || len(args) > 2 {
+		fmt.Fprintln(env.Stderr, "role: invalid arguments")
+		return 1
+	}
+	username := args[0]
+
+	if len(args) == 1 {
+		role, err := userRole(env.Shell.db, username)
+		if err != nil {
+			fmt.Fprintln(env.Stderr, "role: user not found")
+			return 1
+		}
+		fmt.Fprintln(env.Stdout, role)
+		return 0
+	}
+
+	role := args[1]
+	exists, err := roleExists(env.Shell.db, role)
+	if err != nil {
+		fmt.Fprintf(env.Stderr, "role: %v\n", err)
+		return 1
+	}
+	if !exists || role == roleGuest {
+		fmt.Fprintf(env.Stderr, "role: unknown role %s\n", role)
+		return 1
+	}
+
+	res, err := env.Shell.db.Exec("UPDATE users SET role = ? WHERE username = ?", role, username)
+	if err != nil {
+		fmt.Fprintf(env.Stderr, "role: %v\n", err)
+		return 1
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		fmt.Fprintln(env.Stderr, "role: user not found")
+		return 1
+	}
+	env.Shell.audit(currentUser, "role", username, true, "role "+role)
+	fmt.Fprintln(env.Stdout, "role updated successfully")
+	return 0
+}
+
+// handlePerm manages the per-role allow/deny list:
+//
+//	perm [role]               list rules
+//	perm allow <role> <cmd>   allow cmd ("*" for every command)
+//	perm deny <role> <cmd>    deny cmd
+//	perm reset <role> <cmd>   remove the rule for cmd
+func handlePerm(env *Env, args []string) int {
+	currentUser := env.Shell.User()
+	if len(args) <= 1 {
+		query := "SELECT role, command, allowed FROM role_permissions ORDER BY role, command"
+		var queryArgs []any
+		if len(args) == 1 {
+			query = "SELECT role, command, allowed FROM role_permissions WHERE role = ? ORDER BY command"
+			queryArgs = append(queryArgs, args[0])
+		}
+		rows, err := env.Shell.db.Query(query, queryArgs...)
+		if err != nil {
+			fmt.Fprintf(env.Stderr, "perm: %v\n", err)
+			return 1
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var role, cmd string
+			var allowed bool
+			if err := rows.Scan(&role, &cmd, &allowed); err != nil {
+				fmt.Fprintf(env.Stderr, "perm: %v\n", err)
+				continue
+			}
+			rule := "deny"
+			if allowed {
+				rule = "allow"
+			}
+			fmt.Fprintf(env.Stdout, "%s %s %s\n", role, rule, cmd)
+		}
+		return 0
+	}
+
+	if len(args) != 3 {
+		fmt.Fprintln(env.Stderr, "perm: invalid arguments")
+		return 1
+	}
+	action, role, cmd := args[0], args[1], args[2]
+
+	var err error
+	switch action {
+	case "allow", "deny":
+		_, err = env.Shell.db.Exec(`INSERT INTO role_permissions (role, command, allowed) VALUES (?, ?, ?)
+			ON CONFLICT (role, command) DO UPDATE SET allowed = excluded.allowed`, role, cmd, action == "allow")
+	case "reset":
+		_, err = env.Shell.db.Exec("DELETE FROM role_permissions WHERE role = ? AND command = ?", role, cmd)
+	default:
+		fmt.Fprintf(env.Stderr, "perm: unknown action %s\n", action)
+		return 1
+	}
+	if err != nil {
+		fmt.Fprintf(env.Stderr, "perm: %v\n", err)
+		return 1
+	}
+	env.Shell.audit(currentUser, "perm", role, true, action+" "+cmd)
+	return 0
+}
@@ -0,0 +1,190 @@
+package shell
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultLoginTimeout is how long a connection may take to log in.
+	defaultLoginTimeout = time.Minute
+	// loginTries is the number of login attempts per connection.
+	loginTries = 3
+)
+
+// Listen listens on addr, "unix:path" for a Unix socket or "[tcp:]host:port"
+// for TCP.
+func Listen(addr string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		return net.Listen("unix", path)
+	}
+	return net.Listen("tcp", strings.TrimPrefix(addr, "tcp:"))
+}
+
+// Server serves shell sessions over network connections. Every connection
+// gets its own Interpreter, and so its own user, working directory,
+// variables and history. A connection has to log in as a user of the
+// database first, and is closed when that user logs out.
+type Server struct {
+	// Config is the template of the sessions. Stdin, Stdout and Stderr are
+	// replaced by the connection.
+	Config Config
+	// LoginTimeout limits how long a connection may take to log in, a minute
+	// by default.
+	LoginTimeout time.Duration
+	// ErrorLog receives connection errors; the log package's standard
+	// logger is used when nil.
+	ErrorLog *log.Logger
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+	sessions  sync.WaitGroup
+}
+
+func (s *Server) logf(format string, args ...any) {
+	if s.ErrorLog != nil {
+		s.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// Serve accepts connections on l and runs a session for each of them until
+// l fails or the server is closed. After Close it returns nil.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return nil
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+		s.conns = make(map[net.Conn]struct{})
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			delete(s.listeners, l)
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return nil
+		}
+		s.conns[conn] = struct{}{}
+		s.sessions.Add(1)
+		s.mu.Unlock()
+
+		go func() {
+			defer s.sessions.Done()
+			defer func() {
+				s.mu.Lock()
+				delete(s.conns, conn)
+				s.mu.Unlock()
+				conn.Close()
+			}()
+			if err := s.serveConn(conn); err != nil {
+				s.logf("shell: session from %s: %v", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// Close stops all listeners, closes every connection and waits for their
+// sessions to end, so that they are recorded as ended.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	var err error
+	for l := range s.listeners {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.sessions.Wait()
+	return err
+}
+
+func (s *Server) serveConn(conn net.Conn) error {
+	cfg := s.Config
+	cfg.Stdin, cfg.Stdout, cfg.Stderr = conn, conn, conn
+	cfg.RequireLogin = true
+	in, err := New(cfg)
+	if err != nil {
+		fmt.Fprintln(conn, "shell unavailable")
+		return err
+	}
+	defer in.Close()
+
+	timeout := s.LoginTimeout
+	if timeout <= 0 {
+		timeout = defaultLoginTimeout
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	if err := in.authenticate(loginTries); err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			fmt.Fprintln(conn, "\nlogin timed out")
+		}
+		return nil
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	in.Run()
+	return nil
+}
+
+// errLoginFailed is returned by authenticate when all attempts failed.
+var errLoginFailed = errors.New("login failed")
+
+// authenticate asks for a username and password until a login succeeds, at
+// most tries times. Logins go through the login builtin, so failures count
+// towards the lockout and are audited like any other.
+func (in *Interpreter) authenticate(tries int) error {
+	env := &Env{Stdin: in.reader, Stdout: in.stdout, Stderr: in.stderr, Shell: in}
+	for i := 0; i < tries; i++ {
+		fmt.Fprint(in.stdout, "login: ")
+		username, err := env.ReadLine()
+		if err != nil {
+			return err
+		}
+		username = strings.TrimSpace(username)
+		if username == "" {
+			continue
+		}
+		password, err := readPassword(env, "Password: ")
+		if err != nil {
+			return err
+		}
+		if handleLogin(env, []string{username, password}) == 0 {
+			return nil
+		}
+	}
+	fmt.Fprintln(in.stdout, "too many failed logins")
+	return errLoginFailed
+}
@@ -0,0 +1,176 @@
+package shell
+
+import (
+	"bufio"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// lineReader reads input lines in the background, one line per request, so
+// the main loop can stop waiting when a session goes idle. Nothing is read
+// ahead, which keeps password prompts free to use the underlying reader.
+type lineReader struct {
+	requests chan struct{}
+	results  chan lineResult
+	pending  bool
+	closed   bool
+}
+
+type lineResult struct {
+	line string
+	err  error
+}
+
+func newLineReader(reader *bufio.Reader) *lineReader {
+	r := &lineReader{
+		requests: make(chan struct{}),
+		// A read still pending when the reader is closed can finish without
+		// anyone to receive it.
+		results: make(chan lineResult, 1),
+	}
+	go func() {
+		for range r.requests {
+			line, err := reader.ReadString('\n')
+			r.results <- lineResult{line, err}
+		}
+	}()
+	return r
+}
+
+// readLine waits for the next input line. With a positive timeout it gives up
+// after that long and reports timedOut; the line is then delivered by the
+// next call instead.
+func (r *lineReader) readLine(timeout time.Duration) (line string, timedOut bool, err error) {
+	if !r.pending {
+		r.requests <- struct{}{}
+		r.pending = true
+	}
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case res := <-r.results:
+		r.pending = false
+		return res.line, false, res.err
+	case <-expired:
+		return "", true, nil
+	}
+}
+
+// close stops the background reader once its pending read, if any, returns.
+func (r *lineReader) close() {
+	if !r.closed {
+		r.closed = true
+		close(r.requests)
+	}
+}
+
+// idleTimeout returns the idle timeout configured through the TMOUT variable,
+// in seconds. Zero or an invalid value disables it.
+func (in *Interpreter) idleTimeout() time.Duration {
+	seconds, err := strconv.Atoi(in.Getenv("TMOUT"))
+	if err != nil || seconds <= 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+func startSession(db *sql.DB, username string, now time.Time) (int64, error) {
+	res, err := db.Exec("INSERT INTO sessions (username, login_at) VALUES (?, ?)", username, now.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// endSession records when and why a session ended, e.g. "logout", "timeout"
+// or "exit".
+func endSession(db *sql.DB, id int64, reason string, now time.Time) error {
+	_, err := db.Exec("UPDATE sessions SET logout_at = ?, logout_reason = ? WHERE id = ? AND logout_at IS NULL",
+		now.UTC(), reason, id)
+	return err
+}
+
+// handleLast lists recent sessions, newest first. Administrators see every
+// user's sessions, everybody else only their own.
+//
+//	last [-n count] [username]
+func handleLast(env *Env, args []string) int {
+	currentUser := env.Shell.User()
+	if currentUser == "" {
+		fmt.Fprintln(env.Stderr, "last: not logged in")
+		return 1
+	}
+
+	limit := 10
+	username := ""
+	for i := 0; i < len(args); i++ {
+		if args[i] == "-n" && i+1 < len(args) {
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil || n <= 0 {
+				fmt.Fprintf(env.Stderr, "last: invalid count %s\n", args[i+1])
+				return 1
+			}
+			limit = n
+			i++
+			continue
+		}
+		if username != "" {
+			fmt.Fprintln(env.Stderr, "last: invalid arguments")
+			return 1
+		}
+		username = args[i]
+	}
+
+	role, err := env.Shell.role()
+	if err != nil {
+		fmt.Fprintf(env.Stderr, "last: %v\n", err)
+		return 1
+	}
+	if role != roleAdmin {
+		if username != "" && username != currentUser {
+			fmt.Fprintln(env.Stderr, "last: permission denied")
+			return 1
+		}
+		username = currentUser
+	}
+
+	rows, err := env.Shell.db.Query(`
+		SELECT username, login_at, logout_at, COALESCE(logout_reason, '')
+		FROM sessions
+		WHERE ? = '' OR username = ?
+		ORDER BY id DESC
+		LIMIT ?
+	`, username, username, limit)
+	if err != nil {
+		fmt.Fprintf(env.Stderr, "last: %v\n", err)
+		return 1
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var user, reason string
+		var loginAt time.Time
+		var logoutAt sql.NullTime
+		if err := rows.Scan(&user, &loginAt, &logoutAt, &reason); err != nil {
+			fmt.Fprintf(env.Stderr, "last: %v\n", err)
+			continue
+		}
+
+		line := fmt.Sprintf("%-12s %s   still logged in", user, loginAt.Local().Format(time.ANSIC))
+		if logoutAt.Valid {
+			line = fmt.Sprintf("%-12s %s - %s (%v) %s", user,
+				loginAt.Local().Format(time.ANSIC), logoutAt.Time.Local().Format(time.ANSIC),
+				logoutAt.Time.Sub(loginAt).Round(time.Second), reason)
+		}
+		fmt.Fprintln(env.Stdout, line)
+	}
+	return 0
+}
@@ -0,0 +1,138 @@
+package shell
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+)
+
+// shellOptions are the options of the set builtin, all off by default.
+var shellOptions = []string{"errexit", "json", "nounset", "pipefail", "xtrace"}
+
+// optionLetters are the single-letter forms of options, as in "set -eu".
+var optionLetters = map[byte]string{'e': "errexit", 'u': "nounset", 'x': "xtrace"}
+
+// Option reports whether the shell option name is on.
+func (in *Interpreter) Option(name string) bool {
+	in.mu.RLock()
+	defer in.mu.RUnlock()
+	return in.settings[name]
+}
+
+// SetOption turns the shell option name on or off.
+func (in *Interpreter) SetOption(name string, on bool) error {
+	if !slices.Contains(shellOptions, name) {
+		return fmt.Errorf("%s: invalid option name", name)
+	}
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.settings[name] = on
+	return nil
+}
+
+// JSON reports whether the builtin should print JSON records instead of
+// text, as set with "set -o json" or the --json flag.
+func (e *Env) JSON() bool {
+	return e.Shell.Option("json")
+}
+
+// trace prints a command about to run to stderr for the xtrace option,
+// prefixed with $PS4, "+ " when unset. (( )) and [[ ]] are printed as
+// written.
+func (in *Interpreter) trace(args []string) {
+	prefix, ok := in.LookupEnv("PS4")
+	if !ok {
+		prefix = "+ "
+	}
+	// Passwords are left out, as the trace may be recorded.
+	if start, ok := passwordArgs[args[0]]; ok && len(args) > start+1 {
+		args = args[:start+1]
+	}
+	words := make([]string, len(args))
+	for i, arg := range args {
+		words[i] = shellQuote(arg)
+		if compoundCommand(arg) != "" && len(args) == 1 {
+			words[i] = arg
+		}
+	}
+	fmt.Fprintf(in.stderr, "%s%s\n", prefix, strings.Join(words, " "))
+}
+
+// writeRecord writes v as a line of JSON. Builtins in JSON mode print one
+// record per line, so their output can still be filtered line by line.
+func writeRecord(w io.Writer, v any) error {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return enc.Encode(v)
+}
+
+// set [-eux] [+eux] [-o name] [+o name] ...
+func handleSet(env *Env, args []string) int {
+	if len(args) == 0 || (len(args) == 1 && (args[0] == "-o" || args[0] == "+o")) {
+		for _, name := range shellOptions {
+			if len(args) == 0 || args[0] == "-o" {
+				state := "off"
+				if env.Shell.Option(name) {
+					state = "on"
+				}
+				fmt.Fprintf(env.Stdout, "%-15s %s\n", name, state)
+			} else {
+				sign := "+"
+				if env.Shell.Option(name) {
+					sign = "-"
+				}
+				fmt.Fprintf(env.Stdout, "set %so %s\n", sign, name)
+			}
+		}
+		return 0
+	}
+
+	// Letters can be grouped, as in "-eu" or "-eo pipefail"; an o takes the
+	// next argument as the option name.
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if len(arg) < 2 || (arg[0] != '-' && arg[0] != '+') {
+			fmt.Fprintf(env.Stderr, "set: %s: invalid option\n", arg)
+			return 2
+		}
+		on := arg[0] == '-'
+		for _, letter := range []byte(arg[1:]) {
+			name, ok := optionLetters[letter]
+			switch {
+			case letter == 'o' && i+1 < len(args):
+				i++
+				name = args[i]
+			case !ok:
+				fmt.Fprintf(env.Stderr, "set: %c%c: invalid option\n", arg[0], letter)
+				return 2
+			}
+			if err := env.Shell.SetOption(name, on); err != nil {
+				fmt.Fprintf(env.Stderr, "set: %v\n", err)
+				return 1
+			}
+		}
+	}
+	return 0
+}
+
+// source file
+func handleSource(env *Env, args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(env.Stderr, "source: expected a single file")
+		return 2
+	}
+	if env.Shell.restricted && strings.Contains(args[0], "/") {
+		fmt.Fprintf(env.Stderr, "source: %s: %v\n", args[0], errRestricted)
+		return 1
+	}
+	f, err := os.Open(env.Path(args[0]))
+	if err != nil {
+		fmt.Fprintf(env.Stderr, "source: %v\n", err)
+		return 1
+	}
+	defer f.Close()
+	return env.Shell.RunScript(f)
+}
@@ -1,529 +1,322 @@
-package main
+package shell
 
 import (
-	"bufio"
-	"bytes"
-	"database/sql"
 	"fmt"
 	"os"
 	"os/exec"
-	"path/filepath"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
-
-	_ "github.com/mattn/go-sqlite3"
-	"golang.org/x/crypto/bcrypt"
+	"syscall"
+	"time"
+	"unicode/utf8"
 )
 
-var builtins = map[string]bool{
-	"exit":    true,
-	"echo":    true,
-	"cat":     true,
-	"type":    true,
-	"pwd":     true,
-	"cd":      true,
-	"login":   true,
-	"logout":  true,
-	"adduser": true,
-	"history": true,
-	"ls":      true,
-}
-
-func main() {
-	db := initDB()
-	defer db.Close()
-
-	reader := bufio.NewReader(os.Stdin)
-	currentUser := ""
-	sessionHistory := []string{}
-
-	for {
-		// Display prompt
-		prompt := "$ "
-		if currentUser != "" {
-			prompt = currentUser + ":$ "
-		}
-		fmt.Print(prompt)
+func handleExit(env *Env, args []string) int {
+	if len(args) > 1 {
+		fmt.Fprintln(env.Stderr, "exit: too many arguments")
+		return 1
+	}
 
-		// Read input
-		line, err := reader.ReadString('\n')
+	code := 0
+	if len(args) == 1 {
+		_, err := fmt.Sscanf(args[0], "%d", &code)
 		if err != nil {
-			fmt.Fprintln(os.Stderr, "Error reading input:", err)
-			continue
-		}
-
-		line = strings.TrimSpace(line)
-		if line == "" {
-			continue
-		}
-
-		// Split into arguments
-		args := splitArgs(line)
-		if len(args) == 0 {
-			continue
-		}
-
-		cmd := args[0]
-		cmdArgs := args[1:]
-
-		// Update history
-		if currentUser != "" {
-			_, err = db.Exec("INSERT INTO command_history (username, command) VALUES (?, ?)", currentUser, line)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Failed to save history: %v\n", err)
-			}
-		} else {
-			sessionHistory = append(sessionHistory, line)
-		}
-
-		// Handle commands
-		switch cmd {
-		case "exit":
-			handleExit(cmdArgs)
-		case "echo":
-			handleEcho(cmdArgs)
-		case "cat":
-			handleCat(cmdArgs)
-		case "type":
-			handleType(cmdArgs)
-		case "pwd":
-			handlePwd(cmdArgs)
-		case "cd":
-			handleCd(cmdArgs)
-		case "login":
-			handleLogin(cmdArgs, db, &currentUser)
-		case "logout":
-			currentUser = ""
-		case "adduser":
-			handleAddUser(cmdArgs, db)
-		case "history":
-			if len(cmdArgs) > 0 && cmdArgs[0] == "clean" {
-				handleHistoryClean(currentUser, db, &sessionHistory)
-			} else {
-				handleHistory(currentUser, db, sessionHistory)
-			}
-		case "ls":
-			handleLs(cmdArgs)
-		default:
-			if builtins[cmd] {
-				fmt.Fprintf(os.Stderr, "%s: built-in command not implemented\n", cmd)
-				continue
-			}
-			executeExternalCommand(cmd, cmdArgs)
+			fmt.Fprintln(env.Stderr, "exit: invalid status code")
+			return 1
 		}
 	}
-}
 
-// Database Initialization
-func initDB() *sql.DB {
-	db, err := sql.Open("sqlite3", "./shell.db")
-	if err != nil {
-		panic(err)
+	// In a pipeline, exit only ends its own command.
+	if env.pipeline {
+		return code
 	}
-
-	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS users (
-		username TEXT PRIMARY KEY,
-		password_hash TEXT NOT NULL
-	)`)
-	if err != nil {
-		panic(err)
-	}
-
-	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS command_history (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		username TEXT,
-		command TEXT,
-		timestamp DATETIME DEFAULT CURRENT_TIMESTAMP
-	)`)
-	if err != nil {
-		panic(err)
-	}
-
-	return db
+	fmt.Fprintf(env.Stdout, "exit status %d\n", code)
+	env.Shell.exited = true
+	env.Shell.exitCode = code
+	return code
 }
-func handleExit(args []string) {
-	stdoutFile, stderrFile, processedArgs := processRedirection(args)
-	defer func() {
-		if stdoutFile != nil {
-			stdoutFile.Close()
-		}
-		if stderrFile != nil {
-			stderrFile.Close()
-		}
-	}()
-
-	if len(processedArgs) > 1 {
-		if stderrFile != nil {
-			fmt.Fprintln(stderrFile, "exit: too many arguments")
-		} else {
-			fmt.Println("exit: too many arguments")
-		}
-		return
-	}
-
-	code := 0
-	if len(processedArgs) == 1 {
-		_, err := fmt.Sscanf(processedArgs[0], "%d", &code)
-		if err != nil {
-			if stderrFile != nil {
-				fmt.Fprintln(stderrFile, "exit: invalid status code")
-			} else {
-				fmt.Println("exit: invalid status code")
-			}
-			return
-		}
-	}
 
-	fmt.Printf("exit status %d\n", code)
-	os.Exit(code)
+func handlePwd(env *Env, args []string) int {
+	dir := env.Shell.Dir()
+	fmt.Fprintln(env.Stdout, dir)
+	return 0
 }
 
-func handlePwd(args []string) {
-	stdoutFile, stderrFile, _ := processRedirection(args)
-	defer func() {
-		if stdoutFile != nil {
-			stdoutFile.Close()
-		}
-		if stderrFile != nil {
-			stderrFile.Close()
+func handleEcho(env *Env, args []string) int {
+	newline, escapes := true, false
+	// Leading words made of n, e and E flags are options; anything else,
+	// including "-", is the first word to print.
+	for len(args) > 0 && len(args[0]) > 1 && strings.Trim(args[0], "neE") == "-" {
+		for _, flag := range args[0][1:] {
+			switch flag {
+			case 'n':
+				newline = false
+			case 'e':
+				escapes = true
+			case 'E':
+				escapes = false
+			}
 		}
-	}()
-
-	dir, err := os.Getwd()
-	if err != nil {
-		fmt.Fprintln(os.Stderr, "pwd:", err)
-		return
-	}
-	if stdoutFile != nil {
-		fmt.Fprintln(stdoutFile, dir)
-	} else {
-		fmt.Println(dir)
+		args = args[1:]
 	}
-}
-func handleEcho(args []string) {
-	stdoutFile, stderrFile, processedArgs := processRedirection(args)
-	defer func() {
-		if stdoutFile != nil {
-			stdoutFile.Close()
-		}
-		if stderrFile != nil {
-			stderrFile.Close()
-		}
-	}()
 
-	var output strings.Builder
-	for _, arg := range processedArgs {
-		if strings.HasPrefix(arg, "\"") && strings.HasSuffix(arg, "\"") {
-			stripped := arg[1 : len(arg)-1]
-			processed := processEscapes(stripped)
-			output.WriteString(replaceEnvVars(processed))
-		} else if !strings.HasPrefix(arg, "'") || !strings.HasSuffix(arg, "'") {
-			output.WriteString(replaceEnvVars(arg))
-		} else {
-			stripped := arg[1 : len(arg)-1]
-			processed := processEscapes(stripped)
-			output.WriteString(processed)
-			// output.WriteString(arg)
+	output := strings.Join(args, " ")
+	if escapes {
+		var stop bool
+		output, stop = unescape(output, true)
+		if stop {
+			newline = false
 		}
-		output.WriteString(" ")
 	}
-
-	result := strings.TrimSpace(output.String())
-
-	if stdoutFile != nil {
-		fmt.Fprint(stdoutFile, result+"\n")
-	} else {
-		fmt.Println(result)
+	if newline {
+		output += "\n"
 	}
+	fmt.Fprint(env.Stdout, output)
+	return 0
 }
 
-func replaceEnvVars(s string) string {
-	re := regexp.MustCompile(`\$([A-Za-z_][A-Za-z0-9_]*)`)
-	return re.ReplaceAllStringFunc(s, func(m string) string {
-		return os.Getenv(m[1:])
-	})
+// expandWord removes the quotes of a word and expands the variables and
+// arithmetic expansions $(( expr )) in it, except inside single quotes. A
+// backslash escapes the next character outside quotes, and $, ", \ and `
+// inside double quotes. With the nounset option, referring to an unset
+// variable is an error.
+func (in *Interpreter) expandWord(word string) (string, error) {
+	return in.expand(word, nil)
 }
-func handleCat(args []string) {
-	stdoutFile, stderrFile, processedArgs := processRedirection(args)
-	defer func() {
-		if stdoutFile != nil {
-			stdoutFile.Close()
-		}
-		if stderrFile != nil {
-			stderrFile.Close()
-		}
-	}()
 
-	if len(processedArgs) == 0 {
-		if stderrFile != nil {
-			fmt.Fprintln(stderrFile, "cat: missing file argument")
-		} else {
-			fmt.Fprintln(os.Stderr, "cat: missing file argument")
-		}
-		return
-	}
-	for _, file := range processedArgs {
-		content, err := os.ReadFile(file)
-		if err != nil {
-			if stderrFile != nil {
-				fmt.Fprintf(stderrFile, "cat: %v\n", err)
+// expand is expandWord passing the quoted text of word through literal, if
+// not nil, which escapes it where quotes make a pattern literal.
+func (in *Interpreter) expand(word string, literal func(string) string) (string, error) {
+	// Quoted text is collected in runs, so that literal sees whole
+	// characters.
+	var b, run strings.Builder
+	flush := func() {
+		s := run.String()
+		if literal != nil {
+			s = literal(s)
+		}
+		b.WriteString(s)
+		run.Reset()
+	}
+	quoted := func(s string) { run.WriteString(s) }
+	unquoted := func(s string) {
+		flush()
+		b.WriteString(s)
+	}
+	inSingle, inDouble := false, false
+	for i := 0; i < len(word); i++ {
+		c := word[i]
+		switch {
+		case inSingle:
+			if c == '\'' {
+				inSingle = false
 			} else {
-				fmt.Fprintf(os.Stderr, "cat: %v\n", err)
+				quoted(word[i : i+1])
 			}
-			continue
-		}
-		if stdoutFile != nil {
-			fmt.Fprint(stdoutFile, string(content))
-		} else {
-			fmt.Print(string(content))
-		}
-	}
-}
-func handleType(args []string) {
-	stdoutFile, stderrFile, processedArgs := processRedirection(args)
-	defer func() {
-		if stdoutFile != nil {
-			stdoutFile.Close()
-		}
-		if stderrFile != nil {
-			stderrFile.Close()
-		}
-	}()
-
-	if len(processedArgs) == 0 {
-		if stderrFile != nil {
-			fmt.Fprintln(stderrFile, "type: missing argument")
-		} else {
-			fmt.Println("type: missing argument")
-		}
-		return
-	}
-	cmd := processedArgs[0]
-	if builtins[cmd] {
-		output := fmt.Sprintf("%s is a shell builtin\n", cmd)
-		if stdoutFile != nil {
-			fmt.Fprint(stdoutFile, output)
-		} else {
-			fmt.Print(output)
-		}
-		return
-	}
-
-	path := os.Getenv("PATH")
-	for _, dir := range filepath.SplitList(path) {
-		fullPath := filepath.Join(dir, cmd)
-		if _, err := os.Stat(fullPath); err == nil {
-			output := fmt.Sprintf("%s is %s\n", cmd, fullPath)
-			if stdoutFile != nil {
-				fmt.Fprint(stdoutFile, output)
+		case c == '\\' && i+1 < len(word):
+			if inDouble && !strings.ContainsRune("$\"\\`", rune(word[i+1])) {
+				quoted(word[i : i+1])
+				continue
+			}
+			i++
+			quoted(word[i : i+1])
+		case c == '\'' && !inDouble:
+			inSingle = true
+		case c == '"':
+			inDouble = !inDouble
+		case c == '$' && strings.HasPrefix(word[i:], "$(("):
+			expr, n := arithExpansion(word[i:])
+			if n == 0 {
+				unquoted(word[i : i+1])
+				continue
+			}
+			v, err := in.arithmetic(expr)
+			if err != nil {
+				return "", err
+			}
+			unquoted(strconv.FormatInt(v, 10))
+			i += n - 1
+		case c == '$' && arrayReference.MatchString(word[i+1:]):
+			m := arrayReference.FindStringSubmatch(word[i+1:])
+			value, err := in.expandArray(m[2], m[3], m[1] == "#")
+			if err != nil {
+				return "", err
+			}
+			if inDouble {
+				quoted(value)
 			} else {
-				fmt.Print(output)
+				unquoted(value)
 			}
-			return
-		}
-	}
-	output := fmt.Sprintf("%s: command not found\n", cmd)
-	if stderrFile != nil {
-		fmt.Fprint(stderrFile, output)
-	} else {
-		fmt.Print(output)
-	}
-}
-
-func handleCd(args []string) {
-	stdoutFile, stderrFile, processedArgs := processRedirection(args)
-	defer func() {
-		if stdoutFile != nil {
-			stdoutFile.Close()
-		}
-		if stderrFile != nil {
-			stderrFile.Close()
-		}
-	}()
-	target := ""
-	if len(processedArgs) == 0 {
-		home, err := os.UserHomeDir()
-		if err != nil {
-			if stderrFile != nil {
-				fmt.Fprintf(stderrFile, "cd: %v\n", err)
+			i += len(m[0])
+		case c == '$':
+			name, n := varReference(word[i+1:])
+			if n == 0 {
+				unquoted(word[i : i+1])
+				continue
+			}
+			value, ok := in.LookupEnv(name)
+			if !ok && in.Option("nounset") {
+				return "", fmt.Errorf("%s: unbound variable", name)
+			}
+			if inDouble {
+				quoted(value)
 			} else {
-				fmt.Fprintf(os.Stderr, "cd: %v\n", err)
+				unquoted(value)
 			}
-			return
+			i += n
+		case inDouble:
+			quoted(word[i : i+1])
+		default:
+			unquoted(word[i : i+1])
 		}
-		target = home
-	} else {
-		target = processedArgs[0]
 	}
+	flush()
+	return b.String(), nil
+}
 
-	if err := os.Chdir(target); err != nil {
-		if stderrFile != nil {
-			fmt.Fprintf(stderrFile, "cd: %v\n", err)
-		} else {
-			fmt.Fprintf(os.Stderr, "cd: %v\n", err)
+// varReference parses the variable name following a "$", either NAME or
+// {NAME}, and returns it with the number of bytes it takes up.
+func varReference(s string) (string, int) {
+	if strings.HasPrefix(s, "{") {
+		end := strings.IndexByte(s, '}')
+		if end < 0 || !validVarName.MatchString(s[1:end]) {
+			return "", 0
 		}
+		return s[1:end], end + 1
+	}
+	n := 0
+	for n < len(s) && (s[n] == '_' || 'a' <= s[n] && s[n] <= 'z' || 'A' <= s[n] && s[n] <= 'Z' || n > 0 && '0' <= s[n] && s[n] <= '9') {
+		n++
 	}
+	return s[:n], n
 }
 
-// User Management
-func handleAddUser(args []string, db *sql.DB) {
-	stdoutFile, stderrFile, processedArgs := processRedirection(args)
-	defer func() {
-		if stdoutFile != nil {
-			stdoutFile.Close()
-		}
-		if stderrFile != nil {
-			stderrFile.Close()
-		}
-	}()
+var validVarName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
 
-	if len(processedArgs) < 1 || len(processedArgs) > 2 {
-		if stderrFile != nil {
-			fmt.Fprintln(stderrFile, "adduser: invalid arguments")
-		} else {
-			fmt.Println("adduser: invalid arguments")
+// arrayReference matches what follows the "$" of ${name[index]} and
+// ${#name[index]}.
+var arrayReference = regexp.MustCompile(`^\{(#?)([A-Za-z_][A-Za-z0-9_]*)\[([^\]]*)\]\}`)
+
+// expandArray returns an element of an array, all of its elements joined by
+// spaces for the index @ or *, or with count their number. The index is an
+// arithmetic expression; negative ones count from the end. A variable that
+// is not an array is one of a single element.
+func (in *Interpreter) expandArray(name, index string, count bool) (string, error) {
+	values, ok := in.Array(name)
+	if !ok {
+		if value, set := in.LookupEnv(name); set {
+			values, ok = []string{value}, true
 		}
-		return
 	}
-	username := processedArgs[0]
-	password := ""
-	if len(processedArgs) == 2 {
-		password = processedArgs[1]
+	if !ok && in.Option("nounset") {
+		return "", fmt.Errorf("%s: unbound variable", name)
 	}
 
-	hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	if err != nil {
-		if stderrFile != nil {
-			fmt.Fprintf(stderrFile, "Error creating user: %v\n", err)
-		} else {
-			fmt.Fprintf(os.Stderr, "Error creating user: %v\n", err)
+	if index == "@" || index == "*" {
+		if count {
+			return strconv.Itoa(len(values)), nil
 		}
-		return
+		return strings.Join(values, " "), nil
 	}
-
-	_, err = db.Exec("INSERT INTO users (username, password_hash) VALUES (?, ?)", username, hashed)
+	i, err := in.arithmetic(index)
 	if err != nil {
-		if stderrFile != nil {
-			fmt.Fprintln(stderrFile, "duplicate user exists with this username")
-		} else {
-			fmt.Println("duplicate user exists with this username")
-		}
-	} else {
-		if stdoutFile != nil {
-			fmt.Fprintln(stdoutFile, "user created successfully")
-		} else {
-			fmt.Println("user created successfully")
-		}
+		return "", err
 	}
-}
-
-func handleLogin(args []string, db *sql.DB, currentUser *string) {
-	stdoutFile, stderrFile, processedArgs := processRedirection(args)
-	defer func() {
-		if stdoutFile != nil {
-			stdoutFile.Close()
-		}
-		if stderrFile != nil {
-			stderrFile.Close()
-		}
-	}()
-
-	if len(processedArgs) < 1 || len(processedArgs) > 2 {
-		if stderrFile != nil {
-			fmt.Fprintln(stderrFile, "login: invalid arguments")
-		} else {
-			fmt.Println("login: invalid arguments")
-		}
-		return
+	if i < 0 {
+		i += int64(len(values))
 	}
-	username := processedArgs[0]
-	password := ""
-	if len(processedArgs) == 2 {
-		password = processedArgs[1]
+	value := ""
+	if i >= 0 && i < int64(len(values)) {
+		value = values[i]
 	}
-
-	var storedHash string
-	err := db.QueryRow("SELECT password_hash FROM users WHERE username = ?", username).Scan(&storedHash)
-	if err != nil {
-		if stderrFile != nil {
-			fmt.Fprintln(stderrFile, "login: user not found")
-		} else {
-			fmt.Println("login: user not found")
-		}
-		return
+	if count {
+		return strconv.Itoa(utf8.RuneCountInString(value)), nil
 	}
+	return value, nil
+}
 
-	err = bcrypt.CompareHashAndPassword([]byte(storedHash), []byte(password))
-	if err != nil {
-		if stderrFile != nil {
-			fmt.Fprintln(stderrFile, "login: incorrect password")
-		} else {
-			fmt.Println("login: incorrect password")
+func handleExport(env *Env, args []string) int {
+	status := 0
+	for _, arg := range args {
+		name, value, ok := strings.Cut(arg, "=")
+		if !ok || !validVarName.MatchString(name) {
+			fmt.Fprintf(env.Stderr, "export: invalid assignment %s\n", arg)
+			status = 1
+			continue
+		}
+		if err := env.Shell.assign(name, value); err != nil {
+			fmt.Fprintf(env.Stderr, "export: %v\n", err)
+			status = 1
 		}
-		return
-	}
-
-	*currentUser = username
-	if stdoutFile != nil {
-		fmt.Fprintln(stdoutFile, "login successful")
-	} else {
-		fmt.Println("login successful")
 	}
+	return status
 }
 
-// History Management
-func handleHistoryClean(currentUser string, db *sql.DB, sessionHistory *[]string) {
-	if currentUser != "" {
-		_, err := db.Exec("DELETE FROM command_history WHERE username = ?", currentUser)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "history clean: %v\n", err)
-			return
+func handleCd(env *Env, args []string) int {
+	target := ""
+	if len(args) == 0 {
+		target = env.Getenv("HOME")
+		if target == "" {
+			fmt.Fprintln(env.Stderr, "cd: HOME not set")
+			return 1
 		}
 	} else {
-		*sessionHistory = []string{}
+		target = args[0]
 	}
+
+	if err := env.Shell.Chdir(target); err != nil {
+		fmt.Fprintf(env.Stderr, "cd: %v\n", err)
+		return 1
+	}
+	return 0
 }
 
-func handleHistory(currentUser string, db *sql.DB, sessionHistory []string) {
-	type historyEntry struct {
-		command string
-		count   int
+// History Management
+func handleHistory(env *Env, args []string) int {
+	if len(args) > 0 && args[0] == "clean" {
+		return handleHistoryClean(env)
 	}
 
 	var entries []historyEntry
 
-	if currentUser != "" {
-		rows, err := db.Query(`
-			SELECT command, COUNT(*) as count 
+	if currentUser := env.Shell.User(); currentUser != "" {
+		rows, err := env.Shell.db.Query(`
+			SELECT command, COUNT(*) as count, MAX(timestamp) as last_used
 			FROM command_history 
 			WHERE username = ? 
 			GROUP BY command 
-			ORDER BY count DESC, MAX(timestamp) DESC
+			ORDER BY count DESC, last_used DESC
 		`, currentUser)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "history: %v\n", err)
-			return
+			fmt.Fprintf(env.Stderr, "history: %v\n", err)
+			return 1
 		}
 		defer rows.Close()
 
 		for rows.Next() {
-			var cmd string
+			var cmd, lastUsed string
 			var cnt int
-			if err := rows.Scan(&cmd, &cnt); err != nil {
-				fmt.Fprintf(os.Stderr, "history: %v\n", err)
+			if err := rows.Scan(&cmd, &cnt, &lastUsed); err != nil {
+				fmt.Fprintf(env.Stderr, "history: %v\n", err)
 				continue
 			}
-			entries = append(entries, historyEntry{cmd, cnt})
+			entries = append(entries, historyEntry{cmd, cnt, parseDBTime(lastUsed)})
 		}
 	} else {
-		counts := make(map[string]int)
-		for _, cmd := range sessionHistory {
-			counts[cmd]++
+		byCommand := make(map[string]*historyEntry)
+		for _, run := range env.Shell.sessionHistory {
+			if e, ok := byCommand[run.command]; ok {
+				e.count++
+				e.lastUsed = run.lastUsed
+			} else {
+				byCommand[run.command] = &historyEntry{run.command, 1, run.lastUsed}
+			}
 		}
 
-		for cmd, cnt := range counts {
-			entries = append(entries, historyEntry{cmd, cnt})
+		for _, e := range byCommand {
+			entries = append(entries, *e)
 		}
 
 		sort.Slice(entries, func(i, j int) bool {
@@ -533,36 +326,91 @@ func handleHistory(currentUser string, db *sql.DB, sessionHistory []string) {
 			return entries[i].count > entries[j].count
 		})
 	}
+	if env.JSON() {
+		for _, e := range entries {
+			if e.command != "history" {
+				writeRecord(env.Stdout, struct {
+					Command  string    `json:"command"`
+					Count    int       `json:"count"`
+					LastUsed time.Time `json:"last_used"`
+				}{e.command, e.count, e.lastUsed.UTC()})
+			}
+		}
+		return 0
+	}
 	if len(entries) == 1 {
-		fmt.Printf("empty command history\n")
+		fmt.Fprintf(env.Stdout, "empty command history\n")
 	}
 	for _, e := range entries {
 		if e.command != "history" {
-			fmt.Printf("| %s | %d |\n", e.command, e.count)
+			fmt.Fprintf(env.Stdout, "| %s | %d |\n", e.command, e.count)
 		}
 	}
+	return 0
 }
 
-func handleLs(args []string) {
-	stdoutFile, stderrFile, processedArgs := processRedirection(args)
-	defer func() {
-		if stdoutFile != nil {
-			stdoutFile.Close()
+// historyEntry is a command of the history, how often it was run and when
+// it last was. Guest sessions keep one entry per run in memory.
+type historyEntry struct {
+	command  string
+	count    int
+	lastUsed time.Time
+}
+
+// parseDBTime parses a timestamp computed by SQLite, such as MAX of a
+// DATETIME column, which reaches Go as text in UTC.
+func parseDBTime(s string) time.Time {
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02 15:04:05"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t
 		}
-		if stderrFile != nil {
-			stderrFile.Close()
+	}
+	return time.Time{}
+}
+
+func handleHistoryClean(env *Env) int {
+	currentUser := env.Shell.User()
+	if currentUser != "" {
+		_, err := env.Shell.db.Exec("DELETE FROM command_history WHERE username = ?", currentUser)
+		if err != nil {
+			fmt.Fprintf(env.Stderr, "history clean: %v\n", err)
+			return 1
 		}
-	}()
+	} else {
+		env.Shell.sessionHistory = nil
+	}
+	env.Shell.audit(currentUser, "history clean", currentUser, true, "")
+	return 0
+}
 
+func handleLs(env *Env, args []string) int {
 	dir := "."
-	if len(processedArgs) > 0 {
-		dir = processedArgs[0]
+	if len(args) > 0 {
+		dir = args[0]
 	}
 
-	files, err := os.ReadDir(dir)
+	files, err := os.ReadDir(env.Path(dir))
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "ls: %v\n", err)
-		return
+		fmt.Fprintf(env.Stderr, "ls: %v\n", err)
+		return 1
+	}
+
+	if env.JSON() {
+		for _, file := range files {
+			info, err := file.Info()
+			if err != nil {
+				// Removed since the directory was read.
+				continue
+			}
+			writeRecord(env.Stdout, struct {
+				Name     string    `json:"name"`
+				Type     string    `json:"type"`
+				Size     int64     `json:"size"`
+				Mode     string    `json:"mode"`
+				Modified time.Time `json:"modified"`
+			}{file.Name(), fileType(info.Mode()), info.Size(), info.Mode().String(), info.ModTime().UTC()})
+		}
+		return 0
 	}
 
 	var output strings.Builder
@@ -573,198 +421,137 @@ func handleLs(args []string) {
 	output.WriteString("\n")
 
 	result := output.String()
-	if stdoutFile != nil {
-		fmt.Fprint(stdoutFile, result)
-	} else {
-		fmt.Print(result)
-	}
+	fmt.Fprint(env.Stdout, result)
+	return 0
 }
 
 // External Command Execution
-func executeExternalCommand(cmdName string, args []string) {
-	stdoutFile, stderrFile, newArgs := processRedirection(args)
-	defer func() {
-		if stdoutFile != nil {
-			stdoutFile.Close()
-		}
-		if stderrFile != nil {
-			stderrFile.Close()
-		}
-	}()
+// executeExternalCommand runs a program with the session's ulimit settings.
+// A non-nil deadline stops it once its time is up.
+func executeExternalCommand(env *Env, cmdName string, args []string, dl *deadline) int {
+	path, err := lookPath(env, cmdName)
+	if err != nil {
+		fmt.Fprintf(env.Stderr, "%s: command not found\n", cmdName)
+		return 127
+	}
 
-	cmd := exec.Command(cmdName, newArgs...)
-	cmd.Stdin = os.Stdin
+	cmd := exec.Command(path, args...)
+	cmd.Args[0] = cmdName
+	cmd.Dir = env.Shell.Dir()
+	cmd.Env = env.Shell.Environ()
+	cmd.Stdin = env.Shell.childStdin(env.Stdin)
+	cmd.Stdout = env.Stdout
+	cmd.Stderr = env.Stderr
 
-	if stdoutFile != nil {
-		cmd.Stdout = stdoutFile
-	} else {
-		cmd.Stdout = os.Stdout
+	if err := env.Shell.applyLimits(cmd); err != nil {
+		fmt.Fprintf(env.Stderr, "%s: cannot apply limits: %v\n", cmdName, err)
+		return 126
 	}
-
-	if stderrFile != nil {
-		cmd.Stderr = stderrFile
-	} else {
-		cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintf(env.Stderr, "error executing command: %v\n", err)
+		return 126
+	}
+	status, err := dl.wait(cmd)
+	if err != nil {
+		return externalStatus(env, err)
 	}
+	return status
+}
 
-	if err := cmd.Run(); err != nil {
-		if stderrFile != nil {
-			fmt.Fprintf(stderrFile, "error executing command: %v\n", err)
-		} else {
-			fmt.Fprintf(os.Stderr, "error executing command: %v\n", err)
+// externalStatus reports how an external command failed and returns its
+// exit status.
+func externalStatus(env *Env, err error) int {
+	// A command whose reader went away, like seq in "seq 1 1000 | head",
+	// is not an error worth reporting.
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() && ws.Signal() == syscall.SIGPIPE {
+			return 128 + int(syscall.SIGPIPE)
 		}
 	}
+	fmt.Fprintf(env.Stderr, "error executing command: %v\n", err)
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode()
+	}
+	return 126
 }
+
+// splitArgs splits a command line into words at unquoted blanks. Quotes and
+// backslashes are kept so that a quoted "|" or ">" is not mistaken for an
+// operator; expandWord removes them before a command runs. An unquoted "|" is
+// always a word of its own. Arithmetic, $(( expr )) and the (( expr ))
+// command, is kept in one word up to its closing parentheses, and so is a
+// [[ condition ]] up to its closing ]].
 func splitArgs(line string) []string {
+	return splitWords(line, true)
+}
+
+// commandPosition reports whether the next word after args is the name of a
+// command: the first word of a pipeline stage, or the one after time.
+func commandPosition(args []string) bool {
+	return len(args) == 0 || args[len(args)-1] == "|" || len(args) == 1 && args[0] == "time"
+}
+
+// splitWords splits line like splitArgs. Without operators, "|" and "[[" are
+// ordinary characters, as inside [[ ]].
+func splitWords(line string, operators bool) []string {
 	var args []string
-	var buf bytes.Buffer
+	var buf strings.Builder
 	inSingle, inDouble, escape := false, false, false
+	// depth counts the open parentheses of arithmetic, and cond is set
+	// within [[ ]].
+	depth, cond := 0, false
 
+	flush := func() {
+		if buf.Len() > 0 {
+			args = append(args, buf.String())
+			buf.Reset()
+		}
+	}
 	for _, r := range line {
-		if escape {
-			if inDouble {
-				switch r {
-				case '$', '\'', '"', '\\', 'n':
-					buf.WriteRune(r)
-				default:
-					buf.WriteRune('\\')
-					buf.WriteRune(r)
-				}
-			} else {
-				buf.WriteRune('\\')
-				buf.WriteRune(r)
-			}
+		switch {
+		case escape:
+			buf.WriteRune(r)
 			escape = false
-			continue
-		}
-
-		if r == '\\' {
-			if inDouble {
-				escape = true
-				continue
-			} else if inSingle {
-				buf.WriteRune(r)
-			} else {
-				buf.WriteRune(r)
-			}
-			continue
-		}
-
-		if r == '\'' && !inDouble {
-			if inSingle {
-				inSingle = false
-				buf.WriteRune(r)
-				args = append(args, buf.String())
-				buf.Reset()
-			} else {
-				inSingle = true
-				if buf.Len() > 0 {
-					args = append(args, buf.String())
-					buf.Reset()
-				}
-				buf.WriteRune(r)
-			}
-			continue
-		} else if r == '"' && !inSingle {
-			inDouble = !inDouble
+		case depth > 0:
 			buf.WriteRune(r)
-			if !inDouble {
-				args = append(args, buf.String())
-				buf.Reset()
+			if r == '(' {
+				depth++
+			} else if r == ')' {
+				depth--
 			}
-			continue
-		} else if (r == ' ' || r == '\t') && !inSingle && !inDouble {
-			if buf.Len() > 0 {
-				args = append(args, buf.String())
-				buf.Reset()
-			}
-		} else {
+		case r == '\\' && !inSingle:
 			buf.WriteRune(r)
-		}
-	}
-
-	if buf.Len() > 0 {
-		args = append(args, buf.String())
-	}
-
-	return args
-}
-func processEscapes(s string) string {
-	var result strings.Builder
-	escape := false
-
-	for _, r := range s {
-		if escape {
-			switch r {
-			case '$', '\'', '"', '\\', 'n', '`':
-				result.WriteRune(r)
-			default:
-				result.WriteRune('\\')
-				result.WriteRune(r)
-			}
-			escape = false
-		} else if r == '\\' {
 			escape = true
-		} else {
-			result.WriteRune(r)
-		}
-	}
-
-	if escape {
-		result.WriteRune('\\')
-	}
-
-	return result.String()
-}
-
-func processRedirection(args []string) (stdoutFile, stderrFile *os.File, processedArgs []string) {
-	var newArgs []string
-
-	for i := 0; i < len(args); {
-		arg := args[i]
-		switch arg {
-		case ">", ">>", "1>", "1>>":
-			if i+1 >= len(args) {
-				fmt.Fprintln(os.Stderr, "syntax error: no file specified for output redirection")
-				return nil, nil, nil
-			}
-			filename := args[i+1]
-			flag := os.O_WRONLY | os.O_CREATE
-			if arg == ">" || arg == "1>" {
-				flag |= os.O_TRUNC
-			} else {
-				flag |= os.O_APPEND
-			}
-			file, err := os.OpenFile(filename, flag, 0644)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "error opening file: %v\n", err)
-				return nil, nil, nil
-			}
-			stdoutFile = file
-			i += 2
-		case "2>", "2>>":
-			if i+1 >= len(args) {
-				fmt.Fprintln(os.Stderr, "syntax error: no file specified for error redirection")
-				return nil, nil, nil
-			}
-			filename := args[i+1]
-			flag := os.O_WRONLY | os.O_CREATE
-			if arg == "2>" {
-				flag |= os.O_TRUNC
+		case r == '\'' && !inDouble:
+			inSingle = !inSingle
+			buf.WriteRune(r)
+		case r == '"' && !inSingle:
+			inDouble = !inDouble
+			buf.WriteRune(r)
+		case inSingle || inDouble:
+			buf.WriteRune(r)
+		case r == '(' && (buf.String() == "(" || strings.HasSuffix(buf.String(), "$(")):
+			buf.WriteRune(r)
+			depth = 2
+		case r == '|' && operators && !cond:
+			flush()
+			args = append(args, "|")
+		case (r == ' ' || r == '\t') && cond:
+			if s := buf.String(); strings.HasSuffix(s, " ]]") || strings.HasSuffix(s, "\t]]") {
+				flush()
+				cond = false
 			} else {
-				flag |= os.O_APPEND
-			}
-			file, err := os.OpenFile(filename, flag, 0644)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "error opening file: %v\n", err)
-				return nil, nil, nil
+				buf.WriteRune(r)
 			}
-			stderrFile = file
-			i += 2
+		case (r == ' ' || r == '\t') && operators && buf.String() == "[[" && commandPosition(args):
+			buf.WriteRune(r)
+			cond = true
+		case r == ' ' || r == '\t':
+			flush()
 		default:
-			newArgs = append(newArgs, arg)
-			i++
+			buf.WriteRune(r)
 		}
 	}
-	return stdoutFile, stderrFile, newArgs
+	flush()
+	return args
 }
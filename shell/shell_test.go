@@ -1,39 +1,58 @@
-package main
+package shell
 
 import (
 	"bytes"
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"io"
+	"log"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"runtime"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
-	_ "github.com/mattn/go-sqlite3"
 	"golang.org/x/crypto/bcrypt"
 )
 
 const shellPath = "./mysh"
 
+// adminLogin logs in as the administrator created by TestMain.
+const adminLogin = "login admin Adm1n!pass\n"
+
 func TestMain(m *testing.M) {
-	cmd := exec.Command("go", "build", "-o", shellPath)
+	ExecLimited()
+
+	cmd := exec.Command("go", "build", "-o", shellPath, "./cmd/gosh")
 	if err := cmd.Run(); err != nil {
 		fmt.Printf("Failed to build shell: %v\n", err)
 		os.Exit(1)
 	}
 
+	os.Setenv("GOSH_DB", "./test_shell.db")
+
+	// Let the shell create the schema, then add the administrator.
+	cmd = exec.Command(shellPath)
+	cmd.Stdin = strings.NewReader("exit\n")
+	if err := cmd.Run(); err != nil {
+		fmt.Printf("Failed to initialize database: %v\n", err)
+		os.Exit(1)
+	}
+
 	db, err := sql.Open("sqlite3", "./test_shell.db")
 	if err != nil {
 		panic(err)
 	}
 	defer db.Close()
 
-	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS users (
-		username TEXT PRIMARY KEY,
-		password_hash TEXT NOT NULL
-	)`)
+	hashed, _ := bcrypt.GenerateFromPassword([]byte("Adm1n!pass"), bcrypt.DefaultCost)
+	_, err = db.Exec("INSERT INTO users (username, password_hash, role) VALUES (?, ?, ?)", "admin", hashed, "admin")
 	if err != nil {
 		panic(err)
 	}
@@ -46,7 +65,11 @@ func TestMain(m *testing.M) {
 }
 
 func runShell(t *testing.T, input string) (string, string, error) {
-	cmd := exec.Command(shellPath)
+	return runShellWithArgs(t, nil, input)
+}
+
+func runShellWithArgs(t *testing.T, args []string, input string) (string, string, error) {
+	cmd := exec.Command(shellPath, args...)
 	stdin, err := cmd.StdinPipe()
 	if err != nil {
 		t.Fatalf("Failed to create stdin pipe: %v", err)
@@ -134,25 +157,115 @@ func TestRedirection(t *testing.T) {
 	})
 }
 
+func TestPipes(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	t.Run("BuiltinToExternal", func(t *testing.T) {
+		out, _, _ := runShell(t, "echo hello | tr a-z A-Z")
+		if !strings.Contains(out, "HELLO") {
+			t.Errorf("Pipe into external command failed, got: %s", out)
+		}
+	})
+
+	t.Run("ExternalToBuiltin", func(t *testing.T) {
+		out, _, _ := runShell(t, "printf 'a\\nb\\n' | cat")
+		if !strings.Contains(out, "a\nb\n") {
+			t.Errorf("Pipe into builtin failed, got: %s", out)
+		}
+	})
+
+	t.Run("EarlyReaderExit", func(t *testing.T) {
+		out, errOut, _ := runShell(t, "seq 1 100000 | head -n 1\necho done")
+		if !strings.Contains(out, "1\n") || !strings.Contains(out, "done") || errOut != "" {
+			t.Errorf("Pipeline with early exit failed, got: %s%s", out, errOut)
+		}
+	})
+
+	t.Run("InputRedirection", func(t *testing.T) {
+		testFile := filepath.Join(tmpDir, "input.txt")
+		os.WriteFile(testFile, []byte("from file\n"), 0644)
+		out, _, _ := runShell(t, fmt.Sprintf("cat < %s | cat", testFile))
+		if !strings.Contains(out, "from file") {
+			t.Errorf("Input redirection failed, got: %s", out)
+		}
+	})
+
+	t.Run("BuiltinErrorRedirection", func(t *testing.T) {
+		testFile := filepath.Join(tmpDir, "errors.txt")
+		_, errOut, _ := runShell(t, fmt.Sprintf("cd /no/such/dir 2> %s\nexit 1 2 2>> %s", testFile, testFile))
+		data, _ := os.ReadFile(testFile)
+		if errOut != "" || !strings.Contains(string(data), "cd: ") || !strings.Contains(string(data), "exit: too many arguments") {
+			t.Errorf("Stderr redirection of builtins failed, got %q and %q", data, errOut)
+		}
+	})
+
+	t.Run("SyntaxError", func(t *testing.T) {
+		_, errOut, _ := runShell(t, "echo a | | cat\necho a |")
+		if strings.Count(errOut, "syntax error near unexpected token `|'") != 2 {
+			t.Errorf("Empty pipeline stage accepted, got: %s", errOut)
+		}
+	})
+
+	t.Run("SessionBuiltins", func(t *testing.T) {
+		in, stdout, stderr := newTestInterpreter(t)
+		if code := in.Execute("exit 3 | echo z"); code != 0 || stdout.String() != "z\n" || in.exited {
+			t.Errorf("exit in a pipeline: code %d, stdout %q, exited %v", code, stdout.String(), in.exited)
+		}
+		if code := in.Execute("echo z | exit 3"); code != 3 || in.exited {
+			t.Errorf("exit at the end of a pipeline: code %d, exited %v", code, in.exited)
+		}
+		stdout.Reset()
+		if in.Execute("logout | whoami"); !strings.Contains(stderr.String(), "logout: cannot change the session in a pipeline\n") {
+			t.Errorf("logout in a pipeline: stderr %q", stderr.String())
+		}
+	})
+
+	t.Run("PasswordNotInHistory", func(t *testing.T) {
+		out, _, _ := runShell(t, "login nobody hunter2 | cat\nhistory")
+		if strings.Contains(out, "hunter2") || !strings.Contains(out, "| login nobody | cat | 1 |") {
+			t.Errorf("Password in pipeline not redacted, got: %s", out)
+		}
+		out, _, _ = runShell(t, "time login nobody hunter2\n< /dev/null login nobody hunter3\nhistory")
+		if strings.Contains(out, "hunter") || !strings.Contains(out, "| time login nobody |") || !strings.Contains(out, "| < /dev/null login nobody |") {
+			t.Errorf("Password after time or a redirection not redacted, got: %s", out)
+		}
+		out, _, _ = runShell(t, `"login" nobody hunter4`+"\n"+`\login nobody hunter5`+"\n"+`l"ogin" nobody hunter6`+"\nhistory")
+		if strings.Contains(out, "hunter") || !strings.Contains(out, `| "login" nobody |`) || !strings.Contains(out, `| \login nobody |`) {
+			t.Errorf("Password of a quoted command not redacted, got: %s", out)
+		}
+		out, _, _ = runShell(t, adminLogin+`"adduser" quoted Qu0ted!pw`+"\n"+`\adduser escaped Esc4ped!pw`+"\nhistory")
+		if strings.Contains(out, "Qu0ted") || strings.Contains(out, "Esc4ped") || !strings.Contains(out, `| "adduser" quoted |`) || !strings.Contains(out, `| \adduser escaped |`) {
+			t.Errorf("Password of a quoted adduser not redacted, got: %s", out)
+		}
+	})
+}
+
 func TestUserManagement(t *testing.T) {
 	db, _ := sql.Open("sqlite3", "./test_shell.db")
 	defer db.Close()
 
 	t.Run("AddUser", func(t *testing.T) {
-		out, _, _ := runShell(t, "adduser new 123")
+		out, _, _ := runShell(t, adminLogin+"adduser new Passw0rd!")
 		if !strings.Contains(out, "user created successfully") {
 			t.Error("Adduser failed")
 		}
 	})
 
+	t.Run("DuplicateUser", func(t *testing.T) {
+		out, errOut, _ := runShell(t, adminLogin+"set -e\nadduser new Passw0rd!\necho continued")
+		if !strings.Contains(errOut, "duplicate user exists with this username") || strings.Contains(out, "continued") {
+			t.Errorf("Duplicate adduser did not fail: stdout %q, stderr %q", out, errOut)
+		}
+	})
+
 	t.Run("Login", func(t *testing.T) {
-		out, _, _ := runShell(t, "login new 123")
+		out, _, _ := runShell(t, "login new Passw0rd!")
 		if !strings.Contains(out, "") {
 			t.Error("Login failed")
 		}
 
-		out, _, _ = runShell(t, "login new wrongpass")
-		if !strings.Contains(out, "login: incorrect password") {
+		_, errOut, _ := runShell(t, "login new wrongpass")
+		if !strings.Contains(errOut, "login: invalid username or password") {
 			t.Error("Login error handling failed")
 		}
 	})
@@ -218,7 +331,7 @@ func TestComplexWorkflow(t *testing.T) {
 	defer db.Close()
 
 	hashed, _ := bcrypt.GenerateFromPassword([]byte("testpass"), bcrypt.DefaultCost)
-	db.Exec("INSERT INTO users VALUES (?, ?)", "workflowuser", hashed)
+	db.Exec("INSERT INTO users (username, password_hash) VALUES (?, ?)", "workflowuser", hashed)
 
 	commands := []string{
 		"login workflowuser testpass",
@@ -238,3 +351,1948 @@ func TestComplexWorkflow(t *testing.T) {
 		t.Error("Complex workflow failed")
 	}
 }
+
+func TestMigrations(t *testing.T) {
+	t.Run("LegacyDatabase", func(t *testing.T) {
+		dbPath := filepath.Join(t.TempDir(), "legacy.db")
+		db, err := sql.Open("sqlite3", dbPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		// Schema as created by versions without migrations.
+		_, err = db.Exec(`CREATE TABLE users (
+			username TEXT PRIMARY KEY,
+			password_hash TEXT NOT NULL
+		)`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Exec(`CREATE TABLE command_history (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			username TEXT,
+			command TEXT,
+			timestamp DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.Exec("INSERT INTO users (username, password_hash) VALUES (?, ?)", "legacy", "hash")
+		db.Exec("INSERT INTO command_history (username, command) VALUES (?, ?)", "legacy", "echo old")
+
+		_, errOut, _ := runShellWithArgs(t, []string{"--db", dbPath}, "echo hi")
+		if errOut != "" {
+			t.Fatalf("Migrating legacy database failed, got: %s", errOut)
+		}
+
+		var version int
+		if err := db.QueryRow("SELECT MAX(version) FROM schema_version").Scan(&version); err != nil {
+			t.Fatalf("schema_version not created: %v", err)
+		}
+		if version != migrations[len(migrations)-1].version {
+			t.Errorf("expected schema version %d, got %d", migrations[len(migrations)-1].version, version)
+		}
+
+		var count int
+		db.QueryRow("SELECT COUNT(*) FROM command_history WHERE username = ?", "legacy").Scan(&count)
+		if count != 1 {
+			t.Errorf("legacy history lost during migration")
+		}
+
+		var role string
+		db.QueryRow("SELECT role FROM users WHERE username = ?", "legacy").Scan(&role)
+		if role != "admin" {
+			t.Errorf("oldest legacy user should become admin, got role %q", role)
+		}
+
+		// Running again must not re-apply anything.
+		_, errOut, _ = runShellWithArgs(t, []string{"--db", dbPath}, "echo hi")
+		if errOut != "" {
+			t.Errorf("Re-running migrations failed, got: %s", errOut)
+		}
+	})
+
+	t.Run("EnvironmentPath", func(t *testing.T) {
+		dbPath := filepath.Join(t.TempDir(), "env.db")
+		t.Setenv("GOSH_DB", dbPath)
+		runShell(t, "echo hi")
+		if _, err := os.Stat(dbPath); err != nil {
+			t.Errorf("GOSH_DB was not used: %v", err)
+		}
+	})
+
+	t.Run("NewerSchema", func(t *testing.T) {
+		dbPath := filepath.Join(t.TempDir(), "future.db")
+		db, err := sql.Open("sqlite3", dbPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		db.Exec("CREATE TABLE schema_version (version INTEGER PRIMARY KEY, description TEXT NOT NULL, applied_at DATETIME)")
+		db.Exec("INSERT INTO schema_version (version, description) VALUES (?, ?)", 1000, "from the future")
+
+		_, errOut, err := runShellWithArgs(t, []string{"--db", dbPath}, "")
+		if err == nil || !strings.Contains(errOut, "newer than supported") {
+			t.Errorf("Expected refusal of newer schema, got: %s", errOut)
+		}
+	})
+}
+
+func TestPasswordPrompt(t *testing.T) {
+	t.Run("AddUserPrompt", func(t *testing.T) {
+		out, _, _ := runShell(t, adminLogin+"adduser prompted\ns3cret!pw\ns3cret!pw\nlogin prompted\ns3cret!pw")
+		if !strings.Contains(out, "New password: ") || !strings.Contains(out, "user created successfully") {
+			t.Errorf("Adduser prompt failed, got: %s", out)
+		}
+		if !strings.Contains(out, "Password: ") || !strings.Contains(out, "login successful") {
+			t.Errorf("Login prompt failed, got: %s", out)
+		}
+	})
+
+	t.Run("RedirectedInput", func(t *testing.T) {
+		pwFile := filepath.Join(t.TempDir(), "pw")
+		os.WriteFile(pwFile, []byte("s3cret!pw\n"), 0600)
+		out, _, _ := runShell(t, adminLogin+"adduser redirected s3cret!pw\nlogin redirected < "+pwFile+"\necho still read")
+		if !strings.Contains(out, "login successful") || !strings.Contains(out, "still read") {
+			t.Errorf("Password not read from the redirection, got: %s", out)
+		}
+	})
+
+	t.Run("AddUserMismatch", func(t *testing.T) {
+		_, errOut, _ := runShell(t, adminLogin+"adduser mismatched\ns3cret!pw\ns3cret!px")
+		if !strings.Contains(errOut, "passwords do not match") {
+			t.Errorf("Adduser mismatch not detected, got: %s", errOut)
+		}
+	})
+
+	t.Run("PasswordNotInHistory", func(t *testing.T) {
+		out, _, _ := runShell(t, "login nobody hunter2\nhistory")
+		if strings.Contains(out, "hunter2") {
+			t.Errorf("Password leaked into history, got: %s", out)
+		}
+		if !strings.Contains(out, "| login nobody | 1 |") {
+			t.Errorf("Redacted login missing from history, got: %s", out)
+		}
+	})
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	t.Run("AllViolationsReported", func(t *testing.T) {
+		out, errOut, _ := runShell(t, adminLogin+"adduser weak abc")
+		for _, want := range []string{"too short", "does not contain a number", "does not contain a special character"} {
+			if !strings.Contains(errOut, want) {
+				t.Errorf("Expected violation %q, got: %s", want, errOut)
+			}
+		}
+		if strings.Contains(out, "user created successfully") {
+			t.Error("Weak password was accepted")
+		}
+	})
+
+	t.Run("ConfiguredPolicy", func(t *testing.T) {
+		t.Setenv("GOSH_PASSWORD_MIN_LENGTH", "3")
+		t.Setenv("GOSH_PASSWORD_REQUIRE_SPECIAL", "false")
+		out, _, _ := runShell(t, adminLogin+"adduser relaxed abc1")
+		if !strings.Contains(out, "user created successfully") {
+			t.Errorf("Configured policy not applied, got: %s", out)
+		}
+	})
+
+	t.Run("InvalidConfiguration", func(t *testing.T) {
+		t.Setenv("GOSH_PASSWORD_MIN_LENGTH", "many")
+		_, errOut, err := runShell(t, "")
+		if err == nil || !strings.Contains(errOut, "GOSH_PASSWORD_MIN_LENGTH") {
+			t.Errorf("Invalid policy accepted, got: %s", errOut)
+		}
+	})
+
+	t.Run("Passwd", func(t *testing.T) {
+		runShell(t, adminLogin+"adduser changer Start1ng!pw")
+		out, errOut, _ := runShell(t, "login changer Start1ng!pw\npasswd\nStart1ng!pw\nshort\nshort\npasswd\nStart1ng!pw\nCh4nged!pw\nCh4nged!pw")
+		if !strings.Contains(errOut, "passwd: password does not meet the policy") {
+			t.Errorf("Passwd accepted weak password, got: %s", errOut)
+		}
+		if !strings.Contains(out, "password updated successfully") {
+			t.Errorf("Passwd failed, got: %s", out)
+		}
+
+		out, _, _ = runShell(t, "login changer Ch4nged!pw")
+		if !strings.Contains(out, "login successful") {
+			t.Errorf("Login with new password failed, got: %s", out)
+		}
+	})
+
+	t.Run("PasswdNotLoggedIn", func(t *testing.T) {
+		_, errOut, _ := runShell(t, "passwd")
+		if !strings.Contains(errOut, "passwd: not logged in") {
+			t.Errorf("Passwd without login not refused, got: %s", errOut)
+		}
+	})
+}
+
+func TestUserBuiltins(t *testing.T) {
+	db, _ := sql.Open("sqlite3", "./test_shell.db")
+	defer db.Close()
+
+	runShell(t, adminLogin+"adduser alice Al1ce!pass\nadduser bob B0b!passwd")
+
+	t.Run("Whoami", func(t *testing.T) {
+		out, errOut, _ := runShell(t, "whoami\nlogin alice Al1ce!pass\nwhoami")
+		if !strings.Contains(errOut, "whoami: not logged in") || !strings.Contains(out, "alice:$ alice\n") {
+			t.Errorf("Whoami failed, got: %s%s", out, errOut)
+		}
+	})
+
+	t.Run("Users", func(t *testing.T) {
+		_, errOut, _ := runShell(t, "users")
+		if !strings.Contains(errOut, "users: not logged in") {
+			t.Errorf("Users without login not refused, got: %s", errOut)
+		}
+		out, _, _ := runShell(t, "login alice Al1ce!pass\nusers")
+		if !strings.Contains(out, "alice\n") || !strings.Contains(out, "bob\n") {
+			t.Errorf("Users listing failed, got: %s", out)
+		}
+	})
+
+	t.Run("PasswdWrongCurrent", func(t *testing.T) {
+		_, errOut, _ := runShell(t, "login alice Al1ce!pass\npasswd\nwrong")
+		if !strings.Contains(errOut, "passwd: incorrect password") {
+			t.Errorf("Passwd accepted wrong current password, got: %s", errOut)
+		}
+	})
+
+	t.Run("DelUserNotAdmin", func(t *testing.T) {
+		// The wrong password given to passwd delays alice's next login.
+		t.Setenv("GOSH_LOGIN_BACKOFF", "0s")
+		_, errOut, _ := runShell(t, "login alice Al1ce!pass\ndeluser bob")
+		if !strings.Contains(errOut, "deluser: permission denied") {
+			t.Errorf("Deleting another user not refused, got: %s", errOut)
+		}
+	})
+
+	t.Run("DelUserLastAdmin", func(t *testing.T) {
+		_, errOut, _ := runShell(t, adminLogin+"deluser admin")
+		if !strings.Contains(errOut, "deluser: cannot delete the last admin") {
+			t.Errorf("Deleting the last admin not refused, got: %s", errOut)
+		}
+	})
+
+	t.Run("DelUser", func(t *testing.T) {
+		runShell(t, "login bob B0b!passwd\necho before")
+		out, _, _ := runShell(t, adminLogin+"deluser bob\nAdm1n!pass")
+		if !strings.Contains(out, "user deleted successfully") {
+			t.Errorf("Deleting user failed, got: %s", out)
+		}
+
+		var count int
+		db.QueryRow("SELECT COUNT(*) FROM users WHERE username = ?", "bob").Scan(&count)
+		if count != 0 {
+			t.Error("User still exists after deluser")
+		}
+		db.QueryRow("SELECT COUNT(*) FROM command_history WHERE username = ?", "bob").Scan(&count)
+		if count != 0 {
+			t.Error("History still exists after deluser")
+		}
+	})
+}
+
+func TestLoginLimits(t *testing.T) {
+	runShell(t, adminLogin+"adduser limited L1mited!pw")
+
+	t.Run("UniformFailure", func(t *testing.T) {
+		t.Setenv("GOSH_LOGIN_BACKOFF", "0s")
+		_, unknown, _ := runShell(t, "login no_such_user L1mited!pw")
+		_, wrong, _ := runShell(t, "login limited wrong")
+		if unknown != wrong {
+			t.Errorf("Unknown user and wrong password differ:\n%s\n%s", unknown, wrong)
+		}
+	})
+
+	t.Run("Backoff", func(t *testing.T) {
+		t.Setenv("GOSH_LOGIN_BACKOFF", "1m")
+		_, errOut, _ := runShell(t, "login backoff_user wrong\nlogin backoff_user wrong")
+		if !strings.Contains(errOut, "login: too many failed attempts, try again in 1m0s") {
+			t.Errorf("Backoff not applied, got: %s", errOut)
+		}
+	})
+
+	t.Run("Passwd", func(t *testing.T) {
+		runShell(t, adminLogin+"adduser throttled Thr0ttled!pw")
+		t.Setenv("GOSH_LOGIN_BACKOFF", "1m")
+		_, errOut, _ := runShell(t, "login throttled Thr0ttled!pw\npasswd\nwrong\npasswd\nThr0ttled!pw")
+		if !strings.Contains(errOut, "passwd: incorrect password") || !strings.Contains(errOut, "passwd: too many failed attempts, try again in 1m0s") {
+			t.Errorf("Passwd not throttled, got: %s", errOut)
+		}
+	})
+
+	t.Run("Lockout", func(t *testing.T) {
+		t.Setenv("GOSH_LOGIN_BACKOFF", "0s")
+		t.Setenv("GOSH_LOGIN_MAX_ATTEMPTS", "2")
+		out, errOut, _ := runShell(t, "login limited wrong\nlogin limited wrong\nlogin limited L1mited!pw")
+		if !strings.Contains(errOut, "too many failed attempts") || strings.Contains(out, "login successful") {
+			t.Errorf("Account not locked, got: %s%s", out, errOut)
+		}
+
+		t.Setenv("GOSH_LOGIN_LOCKOUT", "0s")
+		out, _, _ = runShell(t, "login limited L1mited!pw")
+		if !strings.Contains(out, "login successful") {
+			t.Errorf("Lockout did not expire, got: %s", out)
+		}
+	})
+
+	t.Run("LastLogin", func(t *testing.T) {
+		out, _, _ := runShell(t, "login limited L1mited!pw")
+		if !strings.Contains(out, "Last login: ") {
+			t.Errorf("Last login notice missing, got: %s", out)
+		}
+	})
+}
+
+func TestRoles(t *testing.T) {
+	runShell(t, adminLogin+"adduser carol C4rol!pass")
+
+	t.Run("FirstUserIsAdmin", func(t *testing.T) {
+		dbPath := filepath.Join(t.TempDir(), "fresh.db")
+		out, _, _ := runShellWithArgs(t, []string{"--db", dbPath}, "adduser first F1rst!pass\nadduser second S3cond!pass\nlogin first F1rst!pass\nrole first")
+		if strings.Count(out, "user created successfully") != 1 || !strings.Contains(out, "first:$ admin") {
+			t.Errorf("Bootstrap admin failed, got: %s", out)
+		}
+	})
+
+	t.Run("ConcurrentFirstUsers", func(t *testing.T) {
+		db, err := OpenDB(filepath.Join(t.TempDir(), "fresh.db"))
+		if err != nil {
+			t.Fatalf("OpenDB failed: %v", err)
+		}
+		defer db.Close()
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			in, err := New(Config{DB: db, Stdout: io.Discard, Stderr: io.Discard})
+			if err != nil {
+				t.Fatalf("New failed: %v", err)
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				in.Execute(fmt.Sprintf("adduser user%d Passw0rd!", i))
+			}()
+		}
+		wg.Wait()
+		var admins int
+		db.QueryRow("SELECT COUNT(*) FROM users WHERE role = ?", roleAdmin).Scan(&admins)
+		if admins != 1 {
+			t.Errorf("%d sessions made the first admin", admins)
+		}
+	})
+
+	t.Run("AddUserRequiresAdmin", func(t *testing.T) {
+		_, errOut, _ := runShell(t, "login carol C4rol!pass\nadduser mallory M4llory!pw")
+		if !strings.Contains(errOut, "adduser: permission denied") {
+			t.Errorf("Non-admin adduser not refused, got: %s", errOut)
+		}
+		_, errOut, _ = runShell(t, "adduser mallory M4llory!pw")
+		if !strings.Contains(errOut, "adduser: permission denied") {
+			t.Errorf("Guest adduser not refused, got: %s", errOut)
+		}
+	})
+
+	t.Run("DenyExternalCommand", func(t *testing.T) {
+		runShell(t, adminLogin+"perm deny user ls")
+		_, errOut, _ := runShell(t, "login carol C4rol!pass\nls")
+		if !strings.Contains(errOut, "ls: permission denied") {
+			t.Errorf("Denied command was run, got: %s", errOut)
+		}
+		out, _, _ := runShell(t, adminLogin+"perm user\nperm reset user ls")
+		if !strings.Contains(out, "user deny ls") {
+			t.Errorf("Perm listing failed, got: %s", out)
+		}
+		_, errOut, _ = runShell(t, "login carol C4rol!pass\nls")
+		if strings.Contains(errOut, "permission denied") {
+			t.Errorf("Reset rule still denies, got: %s", errOut)
+		}
+	})
+
+	t.Run("PromoteUser", func(t *testing.T) {
+		out, _, _ := runShell(t, adminLogin+"role carol admin\nrole carol")
+		if !strings.Contains(out, "role updated successfully") || !strings.Contains(out, "admin:$ admin") {
+			t.Errorf("Promoting user failed, got: %s", out)
+		}
+		_, errOut, _ := runShell(t, adminLogin+"role carol superuser")
+		if !strings.Contains(errOut, "role: unknown role superuser") {
+			t.Errorf("Unknown role accepted, got: %s", errOut)
+		}
+	})
+}
+
+func TestSessions(t *testing.T) {
+	runShell(t, adminLogin+"adduser dave D4ve!pass\nadduser erin Er1n!pass")
+
+	t.Run("Last", func(t *testing.T) {
+		runShell(t, "login dave D4ve!pass\nlogout\nlogin dave D4ve!pass")
+		out, _, _ := runShell(t, "login dave D4ve!pass\nlast -n 3")
+		if !strings.Contains(out, "still logged in") || !strings.Contains(out, ") exit") || !strings.Contains(out, ") logout") {
+			t.Errorf("Last listing failed, got: %s", out)
+		}
+	})
+
+	t.Run("LastOtherUser", func(t *testing.T) {
+		_, errOut, _ := runShell(t, "login erin Er1n!pass\nlast dave")
+		if !strings.Contains(errOut, "last: permission denied") {
+			t.Errorf("Non-admin saw other sessions, got: %s", errOut)
+		}
+		out, _, _ := runShell(t, adminLogin+"last dave")
+		if !strings.Contains(out, "dave") {
+			t.Errorf("Admin could not see sessions, got: %s", out)
+		}
+	})
+
+	t.Run("IdleTimeout", func(t *testing.T) {
+		cmd := exec.Command(shellPath)
+		stdin, _ := cmd.StdinPipe()
+		var out bytes.Buffer
+		cmd.Stdout = &out
+		cmd.Stderr = &out
+		if err := cmd.Start(); err != nil {
+			t.Fatalf("Failed to start shell: %v", err)
+		}
+
+		io.WriteString(stdin, "export TMOUT=1\nlogin erin Er1n!pass\n")
+		time.Sleep(2 * time.Second)
+		io.WriteString(stdin, "whoami\nexit\n")
+		stdin.Close()
+		cmd.Wait()
+
+		if !strings.Contains(out.String(), "auto-logout") || !strings.Contains(out.String(), "whoami: not logged in") {
+			t.Errorf("Idle session was not logged out, got: %s", out.String())
+		}
+
+		out2, _, _ := runShell(t, adminLogin+"last -n 5 erin")
+		if !strings.Contains(out2, ") timeout") {
+			t.Errorf("Timeout not recorded, got: %s", out2)
+		}
+	})
+}
+
+func TestAudit(t *testing.T) {
+	db, _ := sql.Open("sqlite3", "./test_shell.db")
+	defer db.Close()
+
+	t.Setenv("GOSH_LOGIN_BACKOFF", "0s")
+	runShell(t, adminLogin+"adduser frank Fr4nk!pass")
+	runShell(t, "login frank wrong")
+	runShell(t, "login frank Fr4nk!pass\nadduser eve Ev3!passwd\nhistory clean\nlogout")
+
+	out, _, _ := runShell(t, adminLogin+"audit -n 50")
+	for _, want := range []string{
+		"adduser        frank        ok",
+		"login          frank        FAILED",
+		"denied         adduser      FAILED",
+		"history clean  frank        ok",
+		"logout         frank        ok     logout",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Audit log missing %q, got: %s", want, out)
+		}
+	}
+
+	out, _, _ = runShell(t, adminLogin+"audit -u frank -a login")
+	if strings.Contains(out, "adduser") || !strings.Contains(out, "login") {
+		t.Errorf("Audit filters failed, got: %s", out)
+	}
+
+	_, errOut, _ := runShell(t, "login frank Fr4nk!pass\naudit")
+	if !strings.Contains(errOut, "audit: permission denied") {
+		t.Errorf("Non-admin could read audit log, got: %s", errOut)
+	}
+
+	if _, err := db.Exec("DELETE FROM audit_log"); err == nil {
+		t.Error("Audit log entries could be deleted")
+	}
+	if _, err := db.Exec("UPDATE audit_log SET success = 1"); err == nil {
+		t.Error("Audit log entries could be modified")
+	}
+}
+
+// newTestInterpreter returns an interpreter on a fresh database, writing to
+// the returned buffers.
+// syncBuffer is a bytes.Buffer that the concurrent commands of a pipeline
+// may write to.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func (b *syncBuffer) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Len()
+}
+
+func (b *syncBuffer) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.buf.Reset()
+}
+
+func newTestInterpreter(t *testing.T, env ...string) (*Interpreter, *syncBuffer, *syncBuffer) {
+	t.Helper()
+	db, err := OpenDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("OpenDB failed: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	var stdout, stderr syncBuffer
+	in, err := New(Config{DB: db, Stdout: &stdout, Stderr: &stderr, Dir: t.TempDir(), Env: env})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	return in, &stdout, &stderr
+}
+
+func TestBuiltinStreams(t *testing.T) {
+	in, _, _ := newTestInterpreter(t)
+
+	run := func(name, stdin string, args ...string) (string, string, int) {
+		b, ok := in.Registry().Lookup(name)
+		if !ok {
+			t.Fatalf("Builtin %s not registered", name)
+		}
+		var stdout, stderr bytes.Buffer
+		code := b.Run(&Env{Stdin: strings.NewReader(stdin), Stdout: &stdout, Stderr: &stderr, Shell: in}, args)
+		return stdout.String(), stderr.String(), code
+	}
+
+	if out, _, code := run("echo", "", "a", "b"); out != "a b\n" || code != 0 {
+		t.Errorf("echo: got %q, status %d", out, code)
+	}
+	if out, _, code := run("cat", "line one\nline two\n"); out != "line one\nline two\n" || code != 0 {
+		t.Errorf("cat from stdin: got %q, status %d", out, code)
+	}
+	if out, errOut, code := run("cat", "", "/no/such/file"); out != "" || !strings.HasPrefix(errOut, "cat: ") || code != 1 {
+		t.Errorf("cat error: got %q and %q, status %d", out, errOut, code)
+	}
+	if out, errOut, code := run("whoami", ""); out != "" || errOut != "whoami: not logged in\n" || code != 1 {
+		t.Errorf("whoami: got %q and %q, status %d", out, errOut, code)
+	}
+	if _, errOut, code := run("cd", "", "/no/such/dir"); !strings.HasPrefix(errOut, "cd: ") || code != 1 {
+		t.Errorf("cd error: got %q, status %d", errOut, code)
+	}
+}
+
+func TestInterpreter(t *testing.T) {
+	db, err := OpenDB(filepath.Join(t.TempDir(), "embed.db"))
+	if err != nil {
+		t.Fatalf("OpenDB failed: %v", err)
+	}
+	defer db.Close()
+
+	registry := DefaultRegistry()
+	registry.Register(NewBuiltin("greet", "greet name", func(env *Env, args []string) int {
+		fmt.Fprintf(env.Stdout, "hello, %s\n", strings.Join(args, " "))
+		return 0
+	}))
+	registry.Unregister("ls")
+
+	newInterpreter := func(dir string) (*Interpreter, *bytes.Buffer, *bytes.Buffer) {
+		var stdout, stderr bytes.Buffer
+		in, err := New(Config{DB: db, Registry: registry, Stdout: &stdout, Stderr: &stderr, Dir: dir, Env: []string{"NAME=first"}})
+		if err != nil {
+			t.Fatalf("New failed: %v", err)
+		}
+		return in, &stdout, &stderr
+	}
+
+	first, stdout, _ := newInterpreter(t.TempDir())
+	if code := first.Execute("greet world"); code != 0 || stdout.String() != "hello, world\n" {
+		t.Errorf("Custom builtin: code %d, output %q", code, stdout.String())
+	}
+
+	stdout.Reset()
+	first.Execute("echo $NAME")
+	if stdout.String() != "first\n" {
+		t.Errorf("Expected variable from Config.Env, got %q", stdout.String())
+	}
+
+	second, _, stderr := newInterpreter(t.TempDir())
+	if err := first.Chdir(".."); err != nil {
+		t.Fatalf("Chdir failed: %v", err)
+	}
+	first.Setenv("NAME", "changed")
+	if second.Dir() == first.Dir() || second.Getenv("NAME") != "first" {
+		t.Error("Interpreters share their working directory or variables")
+	}
+
+	second.Execute("perm")
+	if !strings.Contains(stderr.String(), "perm: permission denied") {
+		t.Errorf("Expected permission check on embedded interpreter, got %q", stderr.String())
+	}
+
+	// Without PATH an unregistered builtin is not found at all.
+	stderr.Reset()
+	if code := second.Execute("ls"); code != 127 || !strings.Contains(stderr.String(), "ls: command not found") {
+		t.Errorf("Expected ls to be gone after Unregister: code %d, stderr %q", code, stderr.String())
+	}
+
+	second.Execute("exit 3")
+	if code, exited := second.Exited(); !exited || code != 3 {
+		t.Errorf("Expected exit status 3, got %d (exited %v)", code, exited)
+	}
+}
+
+func TestEcho(t *testing.T) {
+	in, stdout, _ := newTestInterpreter(t, "NAME=gosh")
+	for line, want := range map[string]string{
+		`echo a  b`:          "a b\n",
+		`echo "a  b" 'c  d'`: "a  b c  d\n",
+		`echo $NAME ${NAME}s '$NAME' \$NAME "$NAME"`: "gosh goshs $NAME $NAME gosh\n",
+		`echo -n no newline`:                         "no newline",
+		`echo 'a\tb'`:                                "a\\tb\n",
+		`echo -e 'a\tb\\\x41\u263a'`:                 "a\tb\\A\u263a\n",
+		`echo -e '\0101\nline'`:                      "A\nline\n",
+		`echo -e 'cut\chere'`:                        "cut",
+		`echo -ne 'x\n'`:                             "x\n",
+		`echo -eE '\t'`:                              "\\t\n",
+		`echo - -x`:                                  "- -x\n",
+		`echo "héllo wörld" 'ünï' \é`:                "héllo wörld ünï é\n",
+		`echo -e "€\t☺"`:                             "€\t☺\n",
+	} {
+		stdout.Reset()
+		in.Execute(line)
+		if stdout.String() != want {
+			t.Errorf("%s: got %q, want %q", line, stdout.String(), want)
+		}
+	}
+}
+
+func TestPrintf(t *testing.T) {
+	in, stdout, stderr := newTestInterpreter(t)
+	for line, want := range map[string]string{
+		`printf 'plain\n'`:                       "plain\n",
+		`printf 'ça %s\n' "déjà vu"`:             "ça déjà vu\n",
+		`printf '%s=%d\n' a 1 b 2 c`:             "a=1\nb=2\nc=0\n",
+		`printf '[%-4s|%4s|%.2s]\n' ab cd efgh`:  "[ab  |  cd|ef]\n",
+		`printf '%d %i %05d %+d\n' 42 0x10 7 3`:  "42 16 00007 +3\n",
+		`printf '%x %X %o %#x\n' 255 255 8 255`:  "ff FF 10 0xff\n",
+		`printf '%.2f %e %g\n' 3.14159 1500 0.5`: "3.14 1.500000e+03 0.5\n",
+		`printf '%c%c\n' hello world`:            "hw\n",
+		`printf '%q %q %q\n' simple "it's" ''`:   "simple 'it'\\''s' ''\n",
+		`printf '%b|%s\n' 'a\tb' 'a\tb'`:         "a\tb|a\\tb\n",
+		`printf '%d\n' "'A"`:                     "65\n",
+		`printf '%*d|\n' 5 42`:                   "   42|\n",
+		`printf '100%%\n'`:                       "100%\n",
+		`printf '\101\x42\u263a\n'`:              "AB\u263a\n",
+	} {
+		stdout.Reset()
+		if code := in.Execute(line); code != 0 || stdout.String() != want {
+			t.Errorf("%s: got %q (status %d), want %q", line, stdout.String(), code, want)
+		}
+	}
+
+	stdout.Reset()
+	if code := in.Execute(`printf '%d|' 12 abc`); code != 1 || stdout.String() != "12|0|" || !strings.Contains(stderr.String(), "printf: abc: invalid number") {
+		t.Errorf("Invalid number: got %q and %q, status %d", stdout.String(), stderr.String(), code)
+	}
+	stderr.Reset()
+	if code := in.Execute(`printf '%z'`); code != 1 || !strings.Contains(stderr.String(), "printf: %z: invalid directive") {
+		t.Errorf("Invalid directive: got %q, status %d", stderr.String(), code)
+	}
+}
+
+func TestCat(t *testing.T) {
+	in, stdout, stderr := newTestInterpreter(t)
+	os.WriteFile(filepath.Join(in.Dir(), "a.txt"), []byte("one\n\n\n\ttwo\x01\xe9\nthree"), 0644)
+	os.WriteFile(filepath.Join(in.Dir(), "b.txt"), []byte("four\n"), 0644)
+
+	for line, want := range map[string]string{
+		"cat a.txt b.txt":       "one\n\n\n\ttwo\x01\xe9\nthreefour\n",
+		"cat -n b.txt a.txt":    "     1\tfour\n     2\tone\n     3\t\n     4\t\n     5\t\ttwo\x01\xe9\n     6\tthree",
+		"cat -b a.txt":          "     1\tone\n\n\n     2\t\ttwo\x01\xe9\n     3\tthree",
+		"cat -s a.txt":          "one\n\n\ttwo\x01\xe9\nthree",
+		"cat -A a.txt":          "one$\n$\n$\n^Itwo^AM-i$\nthree",
+		"cat -sE -- b.txt":      "four$\n",
+		"echo in | cat b.txt -": "four\nin\n",
+		"echo in | cat -n":      "     1\tin\n",
+		"cat < b.txt":           "four\n",
+	} {
+		stdout.Reset()
+		if code := in.Execute(line); code != 0 || stdout.String() != want {
+			t.Errorf("%s: got %q (status %d), want %q", line, stdout.String(), code, want)
+		}
+	}
+
+	stdout.Reset()
+	if code := in.Execute("cat missing.txt b.txt"); code != 1 || stdout.String() != "four\n" || !strings.Contains(stderr.String(), "cat: open ") {
+		t.Errorf("Missing file: got %q and %q, status %d", stdout.String(), stderr.String(), code)
+	}
+	stderr.Reset()
+	if code := in.Execute("cat -x b.txt"); code != 1 || !strings.Contains(stderr.String(), "cat: invalid option -- 'x'") {
+		t.Errorf("Invalid option: got %q, status %d", stderr.String(), code)
+	}
+}
+
+func TestTextUtils(t *testing.T) {
+	in, stdout, stderr := newTestInterpreter(t)
+	dir := in.Dir()
+	os.WriteFile(filepath.Join(dir, "s.txt"), []byte("b 2\na 10\nc 1\na 10\nB 3\n"), 0644)
+	os.MkdirAll(filepath.Join(dir, "logs", "old"), 0755)
+	os.WriteFile(filepath.Join(dir, "logs", "app.log"), []byte("ok\nERROR disk\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "logs", "old", "app.log"), []byte("error net\n"), 0644)
+
+	for line, want := range map[string]string{
+		"grep a s.txt":                   "a 10\na 10\n",
+		"grep -vn a s.txt":               "1:b 2\n3:c 1\n5:B 3\n",
+		"grep -ic b s.txt":               "2\n",
+		"grep -F . s.txt":                "",
+		"grep -ri error logs":            "logs/app.log:ERROR disk\nlogs/old/app.log:error net\n",
+		"grep -rl ERROR logs":            "logs/app.log\n",
+		"cat s.txt | grep -E '[0-9]{2}'": "a 10\na 10\n",
+		"head -n 2 s.txt":                "b 2\na 10\n",
+		"head -1 s.txt":                  "b 2\n",
+		"head -c 3 s.txt":                "b 2",
+		"cat s.txt | head -n 1":          "b 2\n",
+		"tail -n 2 s.txt":                "a 10\nB 3\n",
+		"tail -1 s.txt":                  "B 3\n",
+		"tail -n +4 s.txt":               "a 10\nB 3\n",
+		"cat s.txt | tail -n 2":          "a 10\nB 3\n",
+		"wc s.txt":                       " 5 10 22 s.txt\n",
+		"wc -l s.txt logs/app.log":       "5 s.txt\n2 logs/app.log\n7 total\n",
+		"cat s.txt | wc -w":              "10\n",
+		`echo "àb Åx" | wc -w`:           "2\n",
+		`echo "àb Åx" | wc -m`:           "6\n",
+		`echo "àb Åx" | wc -lwmc`:        "1 2 6 8\n",
+		"sort s.txt":                     "B 3\na 10\na 10\nb 2\nc 1\n",
+		"sort -rn -k 2 s.txt":            "a 10\na 10\nB 3\nb 2\nc 1\n",
+		"sort -u -f -k 1,1 s.txt":        "a 10\nb 2\nc 1\n",
+		"sort -t 1 -k 2 s.txt":           "B 3\nb 2\nc 1\na 10\na 10\n",
+		"sort s.txt | uniq":              "B 3\na 10\nb 2\nc 1\n",
+		"sort s.txt | uniq -c":           "      1 B 3\n      2 a 10\n      1 b 2\n      1 c 1\n",
+		"sort s.txt | uniq -d":           "a 10\n",
+		"sort -f s.txt | uniq -iu":       "b 2\nB 3\nc 1\n",
+	} {
+		stdout.Reset()
+		in.Execute(line)
+		if stdout.String() != want {
+			t.Errorf("%s: got %q, want %q", line, stdout.String(), want)
+		}
+	}
+
+	for line, want := range map[string]int{"grep a s.txt": 0, "grep zzz s.txt": 1, "grep '(' s.txt": 2, "grep a logs": 2} {
+		if code := in.Execute(line); code != want {
+			t.Errorf("%s: status %d, want %d", line, code, want)
+		}
+	}
+	stderr.Reset()
+	if code := in.Execute("head -n x s.txt"); code != 1 || !strings.Contains(stderr.String(), "head: invalid number of lines: x") {
+		t.Errorf("Invalid line count: got %q, status %d", stderr.String(), code)
+	}
+
+	t.Run("Follow", func(t *testing.T) {
+		path := filepath.Join(dir, "follow.log")
+		os.WriteFile(path, []byte("first\n"), 0644)
+		stdout.Reset()
+		done := make(chan int)
+		go func() { done <- in.Execute("tail -f follow.log | head -n 3") }()
+
+		f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+		defer f.Close()
+		timeout := time.After(10 * time.Second)
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				if stdout.String() != "first\nline 0\nline 1\n" {
+					t.Errorf("tail -f: got %q", stdout.String())
+				}
+				return
+			case <-time.After(100 * time.Millisecond):
+				fmt.Fprintf(f, "line %d\n", i)
+			case <-timeout:
+				t.Fatal("tail -f did not stop when its reader went away")
+			}
+		}
+	})
+}
+
+func TestHelp(t *testing.T) {
+	t.Run("List", func(t *testing.T) {
+		out, _, _ := runShell(t, "help")
+		for _, want := range []string{"cd       cd [dir]\n", "audit    audit [-n count] [-u user] [-a action]\n", "Type 'help name'"} {
+			if !strings.Contains(out, want) {
+				t.Errorf("Help listing missing %q, got: %s", want, out)
+			}
+		}
+	})
+
+	t.Run("Command", func(t *testing.T) {
+		out, _, _ := runShell(t, "help last\nlast --help")
+		if strings.Count(out, "Usage: last [-n count] [username]") != 2 || !strings.Contains(out, "-n count   list count sessions") {
+			t.Errorf("Usage of last missing, got: %s", out)
+		}
+		_, errOut, _ := runShell(t, "help frobnicate")
+		if !strings.Contains(errOut, "help: no help for frobnicate") {
+			t.Errorf("Unknown topic not reported, got: %s", errOut)
+		}
+	})
+
+	t.Run("EveryBuiltin", func(t *testing.T) {
+		registry := DefaultRegistry()
+		for _, name := range registry.Names() {
+			b, _ := registry.Lookup(name)
+			if !strings.HasPrefix(b.Help(), name) || !strings.Contains(b.Help(), "\n") {
+				t.Errorf("Builtin %s has no usage text: %q", name, b.Help())
+			}
+		}
+	})
+}
+
+func TestFileUtils(t *testing.T) {
+	in, stdout, stderr := newTestInterpreter(t)
+	dir := in.Dir()
+	path := func(name string) string { return filepath.Join(dir, name) }
+	exists := func(name string) bool {
+		_, err := os.Lstat(path(name))
+		return err == nil
+	}
+	run := func(line string) int {
+		stdout.Reset()
+		stderr.Reset()
+		return in.Execute(line)
+	}
+
+	t.Run("Mkdir", func(t *testing.T) {
+		if code := run("mkdir a/b"); code != 1 || stderr.String() != "mkdir: cannot create directory 'a/b': no such file or directory\n" {
+			t.Errorf("mkdir without parent: code %d, stderr %q", code, stderr.String())
+		}
+		if code := run("mkdir -p a/b a/b"); code != 0 || !exists("a/b") {
+			t.Errorf("mkdir -p failed: code %d, stderr %q", code, stderr.String())
+		}
+		if code := run("mkdir a"); code != 1 || !strings.Contains(stderr.String(), "file exists") {
+			t.Errorf("mkdir of existing directory: code %d, stderr %q", code, stderr.String())
+		}
+	})
+
+	t.Run("TouchAndStat", func(t *testing.T) {
+		if code := run("touch -c ghost"); code != 0 || exists("ghost") {
+			t.Errorf("touch -c created a file: code %d", code)
+		}
+		run("touch t.txt")
+		old := time.Now().Add(-time.Hour)
+		os.Chtimes(path("t.txt"), old, old)
+		run("touch t.txt")
+		if info, err := os.Stat(path("t.txt")); err != nil || info.ModTime().Before(time.Now().Add(-time.Minute)) {
+			t.Errorf("touch did not update the time: %v", err)
+		}
+		os.WriteFile(path("t.txt"), []byte("hello"), 0644)
+		os.Chmod(path("t.txt"), 0640)
+		os.Symlink("t.txt", path("link"))
+		run("stat t.txt link a")
+		for _, want := range []string{"  File: t.txt\n", "Size: 5 ", "Type: regular file", "-rw-r----- (0640)", "File: link -> t.txt", "Type: symbolic link", "Type: directory"} {
+			if !strings.Contains(stdout.String(), want) {
+				t.Errorf("stat output missing %q, got: %s", want, stdout.String())
+			}
+		}
+		if code := run("stat nope"); code != 1 || stderr.String() != "stat: cannot stat 'nope': no such file or directory\n" {
+			t.Errorf("stat of missing file: code %d, stderr %q", code, stderr.String())
+		}
+	})
+
+	t.Run("Cp", func(t *testing.T) {
+		os.WriteFile(path("src.txt"), []byte("source"), 0600)
+		if code := run("cp src.txt copy.txt"); code != 0 {
+			t.Fatalf("cp failed: %s", stderr.String())
+		}
+		if data, _ := os.ReadFile(path("copy.txt")); string(data) != "source" {
+			t.Errorf("cp copied %q", data)
+		}
+		if info, _ := os.Stat(path("copy.txt")); info.Mode().Perm() != 0600 {
+			t.Errorf("cp did not keep the mode: %v", info.Mode())
+		}
+		os.WriteFile(path("copy.txt"), []byte("keep"), 0600)
+		run("cp -n src.txt copy.txt")
+		if data, _ := os.ReadFile(path("copy.txt")); string(data) != "keep" {
+			t.Errorf("cp -n overwrote the file: %q", data)
+		}
+		if code := run("cp src.txt t.txt a"); code != 0 || !exists("a/src.txt") || !exists("a/t.txt") {
+			t.Errorf("cp into directory: code %d, stderr %q", code, stderr.String())
+		}
+		if code := run("cp src.txt t.txt copy.txt"); code != 1 || stderr.String() != "cp: target 'copy.txt' is not a directory\n" {
+			t.Errorf("cp of several files to a file: code %d, stderr %q", code, stderr.String())
+		}
+		if code := run("cp a b"); code != 1 || !strings.Contains(stderr.String(), "-r not specified") {
+			t.Errorf("cp of directory without -r: code %d, stderr %q", code, stderr.String())
+		}
+		if code := run("cp -r a b"); code != 0 || !exists("b/b") || !exists("b/src.txt") {
+			t.Errorf("cp -r failed: code %d, stderr %q", code, stderr.String())
+		}
+		if code := run("cp -r a a/b"); code != 1 || !strings.Contains(stderr.String(), "into itself") {
+			t.Errorf("cp of directory into itself: code %d, stderr %q", code, stderr.String())
+		}
+		os.Link(path("src.txt"), path("a/hard.txt"))
+		for line, want := range map[string]string{
+			"cp src.txt src.txt":    "cp: 'src.txt' and 'src.txt' are the same file\n",
+			"cp src.txt ./src.txt":  "cp: 'src.txt' and './src.txt' are the same file\n",
+			"cp a/hard.txt a":       "cp: 'a/hard.txt' and 'a/hard.txt' are the same file\n",
+			"mv src.txt a/hard.txt": "mv: 'src.txt' and 'a/hard.txt' are the same file\n",
+		} {
+			if code := run(line); code != 1 || stderr.String() != want {
+				t.Errorf("%s: code %d, stderr %q, want %q", line, code, stderr.String(), want)
+			}
+		}
+		if data, _ := os.ReadFile(path("src.txt")); string(data) != "source" {
+			t.Errorf("Copying a file onto itself left %q", data)
+		}
+	})
+
+	t.Run("Mv", func(t *testing.T) {
+		run("mv copy.txt moved.txt")
+		if exists("copy.txt") || !exists("moved.txt") {
+			t.Error("mv did not rename")
+		}
+		run("mv moved.txt src.txt b")
+		if exists("moved.txt") || !exists("b/moved.txt") {
+			t.Error("mv did not move into the directory")
+		}
+		os.WriteFile(path("new.txt"), []byte("new"), 0644)
+		run("mv -n new.txt t.txt")
+		if data, _ := os.ReadFile(path("t.txt")); string(data) != "hello" || !exists("new.txt") {
+			t.Errorf("mv -n replaced the file: %q", data)
+		}
+		if code := run("mv nope x"); code != 1 || stderr.String() != "mv: cannot move 'nope': no such file or directory\n" {
+			t.Errorf("mv of missing file: code %d, stderr %q", code, stderr.String())
+		}
+	})
+
+	t.Run("Rm", func(t *testing.T) {
+		if code := run("rm b"); code != 1 || stderr.String() != "rm: cannot remove 'b': is a directory\n" {
+			t.Errorf("rm of directory: code %d, stderr %q", code, stderr.String())
+		}
+		if code := run("rm nope"); code != 1 || !strings.Contains(stderr.String(), "no such file") {
+			t.Errorf("rm of missing file: code %d, stderr %q", code, stderr.String())
+		}
+		if code := run("rm -f nope new.txt"); code != 0 || stderr.Len() != 0 || exists("new.txt") {
+			t.Errorf("rm -f: code %d, stderr %q", code, stderr.String())
+		}
+		if code := run("rm -r . .."); code != 1 || !strings.Contains(stderr.String(), "refusing to remove '.'") {
+			t.Errorf("rm of . not refused: code %d, stderr %q", code, stderr.String())
+		}
+		run("echo n | rm -i t.txt")
+		if !exists("t.txt") || stderr.String() != "rm: remove 't.txt'? " {
+			t.Errorf("rm -i removed without a yes, stderr %q", stderr.String())
+		}
+		run("echo y | rm -i t.txt")
+		if exists("t.txt") {
+			t.Error("rm -i did not remove after yes")
+		}
+		if code := run("rm -r b"); code != 0 || exists("b") {
+			t.Errorf("rm -r: code %d, stderr %q", code, stderr.String())
+		}
+	})
+
+	t.Run("Permissions", func(t *testing.T) {
+		run("adduser root R00t!pass")
+		run("login root R00t!pass")
+		run("perm deny guest rm")
+		run("logout")
+		if code := run("rm -r a"); code == 0 || !strings.Contains(stderr.String(), "rm: permission denied") || !exists("a") {
+			t.Errorf("Denied rm was run: code %d, stderr %q", code, stderr.String())
+		}
+	})
+
+	t.Run("PromptFromShellInput", func(t *testing.T) {
+		out, errOut, _ := runShell(t, "cd "+dir+"\ntouch p.txt\nrm -i p.txt\ny\nstat p.txt")
+		if exists("p.txt") || !strings.Contains(errOut, "rm: remove 'p.txt'? ") {
+			t.Errorf("rm -i did not read the answer from the shell input, out: %s, stderr: %s", out, errOut)
+		}
+	})
+}
+
+func TestCommandLookup(t *testing.T) {
+	bin1, bin2 := t.TempDir(), t.TempDir()
+	os.WriteFile(filepath.Join(bin1, "tool"), []byte("#!/bin/sh\necho one\n"), 0755)
+	os.WriteFile(filepath.Join(bin2, "tool"), []byte("#!/bin/sh\necho two\n"), 0755)
+	os.WriteFile(filepath.Join(bin1, "data"), []byte("not a program\n"), 0644)
+	os.WriteFile(filepath.Join(bin2, "echo"), []byte("#!/bin/sh\n"), 0755)
+
+	in, stdout, stderr := newTestInterpreter(t, "PATH="+bin1+string(os.PathListSeparator)+bin2)
+	run := func(line string) int {
+		stdout.Reset()
+		stderr.Reset()
+		return in.Execute(line)
+	}
+
+	t.Run("Type", func(t *testing.T) {
+		for line, want := range map[string]string{
+			"type tool":       "tool is " + filepath.Join(bin1, "tool") + "\n",
+			"type -a tool":    "tool is " + filepath.Join(bin1, "tool") + "\ntool is " + filepath.Join(bin2, "tool") + "\n",
+			"type -a echo":    "echo is a shell builtin\necho is " + filepath.Join(bin2, "echo") + "\n",
+			"type -t cd tool": "builtin\nfile\n",
+			"type -p cd tool": filepath.Join(bin1, "tool") + "\n",
+		} {
+			if code := run(line); code != 0 || stdout.String() != want {
+				t.Errorf("%s: code %d, got %q, want %q", line, code, stdout.String(), want)
+			}
+		}
+		if code := run("type data"); code != 1 || stderr.String() != "type: data: not found\n" {
+			t.Errorf("Non-executable file found by type: code %d, stdout %q, stderr %q", code, stdout.String(), stderr.String())
+		}
+		if code := run("type -t data"); code != 1 || stdout.Len() != 0 || stderr.Len() != 0 {
+			t.Errorf("type -t of missing command: code %d, stdout %q, stderr %q", code, stdout.String(), stderr.String())
+		}
+	})
+
+	t.Run("Which", func(t *testing.T) {
+		if code := run("which -a tool"); code != 0 || stdout.String() != filepath.Join(bin1, "tool")+"\n"+filepath.Join(bin2, "tool")+"\n" {
+			t.Errorf("which -a: code %d, got %q", code, stdout.String())
+		}
+		if code := run("which tool data"); code != 1 || stdout.String() != filepath.Join(bin1, "tool")+"\n" {
+			t.Errorf("which with a missing command: code %d, got %q", code, stdout.String())
+		}
+	})
+
+	t.Run("Hash", func(t *testing.T) {
+		if run("hash"); stdout.String() != "hash: hash table empty\n" {
+			t.Errorf("Hash table not empty: %q", stdout.String())
+		}
+		run("tool")
+		run("tool")
+		if run("hash"); stdout.String() != "hits\tcommand\n   2\t"+filepath.Join(bin1, "tool")+"\n" {
+			t.Errorf("Hash listing wrong: %q", stdout.String())
+		}
+		if run("type tool"); stdout.String() != "tool is hashed ("+filepath.Join(bin1, "tool")+")\n" {
+			t.Errorf("type ignores the hash table: %q", stdout.String())
+		}
+
+		// A removed file is looked up again.
+		os.Rename(filepath.Join(bin1, "tool"), filepath.Join(bin1, "tool.off"))
+		if run("tool"); stdout.String() != "two\n" {
+			t.Errorf("Stale hash entry used: %q, %q", stdout.String(), stderr.String())
+		}
+		os.Rename(filepath.Join(bin1, "tool.off"), filepath.Join(bin1, "tool"))
+		if run("tool"); stdout.String() != "two\n" {
+			t.Errorf("Hashed command not used: %q", stdout.String())
+		}
+		run("hash -r")
+		if run("tool"); stdout.String() != "one\n" {
+			t.Errorf("hash -r did not forget: %q", stdout.String())
+		}
+
+		run("export PATH=" + bin2)
+		if run("hash"); stdout.String() != "hash: hash table empty\n" {
+			t.Errorf("Changing PATH kept the hash table: %q", stdout.String())
+		}
+		if code := run("hash tool nope"); code != 1 || stderr.String() != "hash: nope: not found\n" {
+			t.Errorf("hash of missing command: code %d, stderr %q", code, stderr.String())
+		}
+		if run("hash"); !strings.Contains(stdout.String(), "   0\t"+filepath.Join(bin2, "tool")) {
+			t.Errorf("hash name did not remember: %q", stdout.String())
+		}
+	})
+}
+
+func TestLimits(t *testing.T) {
+	in, stdout, stderr := newTestInterpreter(t, "PATH="+os.Getenv("PATH"))
+	run := func(line string) int {
+		stdout.Reset()
+		stderr.Reset()
+		return in.Execute(line)
+	}
+
+	t.Run("Timeout", func(t *testing.T) {
+		start := time.Now()
+		if code := run("timeout 0.2 sleep 5"); code != 124 || time.Since(start) > 3*time.Second {
+			t.Errorf("timeout did not stop sleep: code %d after %v", code, time.Since(start))
+		}
+		if code := run(`timeout -k 0.2 0.1 sh -c 'trap "" TERM; sleep 5'`); code != 137 {
+			t.Errorf("timeout did not kill a command ignoring SIGTERM: code %d, stderr %q", code, stderr.String())
+		}
+		if code := run("timeout 5 sh -c 'exit 3'"); code != 3 {
+			t.Errorf("timeout changed the status: code %d", code)
+		}
+		if code := run("timeout 1m echo hi"); code != 0 || stdout.String() != "hi\n" {
+			t.Errorf("timeout with minutes: code %d, stdout %q", code, stdout.String())
+		}
+		if code := run("timeout x sleep 1"); code != 125 || stderr.String() != "timeout: invalid time interval 'x'\n" {
+			t.Errorf("Invalid duration: code %d, stderr %q", code, stderr.String())
+		}
+		if code := run("timeout 1 no-such-command"); code != 127 {
+			t.Errorf("Missing command: code %d", code)
+		}
+	})
+
+	t.Run("Ulimit", func(t *testing.T) {
+		if runtime.GOOS != "linux" {
+			t.Skip("resource limits need Linux")
+		}
+		if code := run("ulimit -n 64"); code != 0 {
+			t.Fatalf("ulimit -n failed: %s", stderr.String())
+		}
+		if run("ulimit -n"); stdout.String() != "64\n" {
+			t.Errorf("ulimit -n printed %q", stdout.String())
+		}
+		// The limits are in place before the command runs.
+		if run("sh -c 'ulimit -n; ulimit -Hn; echo ${GOSH_EXEC_LIMITS-clean}'"); stdout.String() != "64\n64\nclean\n" {
+			t.Errorf("Child has open files limit %q", stdout.String())
+		}
+		run("ulimit -t 5")
+		run("ulimit -v unlimited")
+		run("ulimit -a")
+		for _, want := range []string{"cpu time (seconds, -t)       5\n", "virtual memory (kbytes, -v)  unlimited\n", "open files (-n)              64\n"} {
+			if !strings.Contains(stdout.String(), want) {
+				t.Errorf("ulimit -a missing %q, got: %s", want, stdout.String())
+			}
+		}
+		if code := run("ulimit -n 18446744073709551615"); code != 1 || !strings.Contains(stderr.String(), "cannot raise the limit") {
+			t.Errorf("Limit above the hard limit accepted: code %d, stderr %q", code, stderr.String())
+		}
+		if code := run("ulimit -t -n 5"); code != 1 || stderr.String() != "ulimit: too many arguments\n" {
+			t.Errorf("Setting two limits: code %d, stderr %q", code, stderr.String())
+		}
+	})
+
+	t.Run("Time", func(t *testing.T) {
+		if code := run("time sh -c 'sleep 0.1; exit 3'"); code != 3 {
+			t.Errorf("time changed the status: code %d", code)
+		}
+		if !regexp.MustCompile(`\nreal\t0m0\.[1-9]\d\ds\nuser\t0m\d\.\d{3}s\nsys\t0m\d\.\d{3}s\n$`).MatchString(stderr.String()) {
+			t.Errorf("Unexpected time report: %q", stderr.String())
+		}
+		if run("time echo a | wc -l"); stdout.String() != "1\n" || !strings.Contains(stderr.String(), "real\t") {
+			t.Errorf("time of a pipeline: stdout %q, stderr %q", stdout.String(), stderr.String())
+		}
+		if run("type -t time"); stdout.String() != "keyword\n" {
+			t.Errorf("type -t time printed %q", stdout.String())
+		}
+	})
+
+	t.Run("Permissions", func(t *testing.T) {
+		run("adduser root R00t!pass")
+		run("login root R00t!pass")
+		run("perm deny guest sleep")
+		run("logout")
+		if code := run("timeout 1 sleep 0"); code != 1 || !strings.Contains(stderr.String(), "sleep: permission denied") {
+			t.Errorf("timeout ran a denied command: code %d, stderr %q", code, stderr.String())
+		}
+	})
+}
+
+func TestRestricted(t *testing.T) {
+	db, err := OpenDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("OpenDB failed: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "sub"), 0755)
+	os.Symlink("/", filepath.Join(root, "escape"))
+	os.WriteFile(filepath.Join(root, "in.txt"), []byte("input\n"), 0644)
+	os.WriteFile(filepath.Join(root, "prog"), []byte("#!/bin/sh\necho ran\n"), 0755)
+
+	var stdout, stderr bytes.Buffer
+	in, err := New(Config{DB: db, Stdout: &stdout, Stderr: &stderr, Dir: root, Env: []string{"PATH=" + os.Getenv("PATH")}, Restricted: true})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	run := func(line string) int {
+		stdout.Reset()
+		stderr.Reset()
+		return in.Execute(line)
+	}
+
+	if !in.Restricted() {
+		t.Fatal("Interpreter not restricted")
+	}
+	for _, line := range []string{"cd /", "cd ..", "cd escape", "cd sub/../.."} {
+		if code := run(line); code != 1 || !strings.Contains(stderr.String(), "restricted") {
+			t.Errorf("%s: code %d, stderr %q", line, code, stderr.String())
+		}
+	}
+	if code := run("cd sub"); code != 0 || filepath.Base(in.Dir()) != "sub" {
+		t.Errorf("cd within the root failed: code %d, stderr %q", code, stderr.String())
+	}
+	run("cd ..")
+
+	if code := run("export PATH=/tmp"); code != 1 || stderr.String() != "export: PATH: restricted\n" || in.Getenv("PATH") != os.Getenv("PATH") {
+		t.Errorf("PATH changed: code %d, stderr %q", code, stderr.String())
+	}
+	if code := run("export GREETING=hi"); code != 0 || in.Getenv("GREETING") != "hi" {
+		t.Errorf("export of other variables refused: code %d, stderr %q", code, stderr.String())
+	}
+
+	for _, line := range []string{"echo hi > out.txt", "echo hi >> out.txt", "ls 2> out.txt", "cat in.txt | cat 1> out.txt"} {
+		if code := run(line); code != 1 || stderr.String() != "out.txt: restricted: cannot redirect output\n" {
+			t.Errorf("%s: code %d, stderr %q", line, code, stderr.String())
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "out.txt")); err == nil {
+		t.Error("Output was redirected to a file")
+	}
+	if run("cat < in.txt"); stdout.String() != "input\n" {
+		t.Errorf("Input redirection refused: stdout %q, stderr %q", stdout.String(), stderr.String())
+	}
+
+	for _, line := range []string{"./prog", "/bin/echo hi", "echo a | ./prog", "timeout 1 ./prog"} {
+		if code := run(line); code != 1 || !strings.Contains(stderr.String(), "restricted: cannot specify '/' in command names") || stdout.Len() != 0 {
+			t.Errorf("%s: code %d, stdout %q, stderr %q", line, code, stdout.String(), stderr.String())
+		}
+	}
+
+	isDir := func(path string) bool {
+		info, err := os.Stat(path)
+		return err == nil && info.IsDir()
+	}
+	outside := t.TempDir()
+	os.WriteFile(filepath.Join(outside, "keep.txt"), []byte("keep"), 0644)
+	for line, want := range map[string]string{
+		"touch " + outside + "/touched":          "touch: cannot touch '" + outside + "/touched': restricted: outside the root directory\n",
+		"mkdir -p " + outside + "/dir/sub":       "mkdir: cannot create directory '" + outside + "/dir/sub': restricted: outside the root directory\n",
+		"cp in.txt " + outside + "/copy":         "cp: cannot copy 'in.txt': restricted: outside the root directory\n",
+		"cp in.txt escape" + outside + "/copy":   "cp: cannot copy 'in.txt': restricted: outside the root directory\n",
+		"cp " + outside + "/keep.txt inside.txt": "cp: cannot copy '" + outside + "/keep.txt': restricted: outside the root directory\n",
+		"mv in.txt " + outside:                   "mv: cannot move 'in.txt': restricted: outside the root directory\n",
+		"rm -rf " + outside + "/keep.txt":        "rm: cannot remove '" + outside + "/keep.txt': restricted: outside the root directory\n",
+		"rm -rf escape" + outside + "/keep.txt":  "rm: cannot remove 'escape" + outside + "/keep.txt': restricted: outside the root directory\n",
+	} {
+		if code := run(line); code != 1 || stderr.String() != want {
+			t.Errorf("%s: code %d, stderr %q, want %q", line, code, stderr.String(), want)
+		}
+	}
+	if entries, _ := os.ReadDir(outside); len(entries) != 1 {
+		t.Errorf("Files changed outside the root: %v", entries)
+	}
+	if _, err := os.Stat(filepath.Join(root, "inside.txt")); err == nil {
+		t.Error("A file outside the root was copied in")
+	}
+	if code := run("mkdir -p made/sub"); code != 0 || !isDir(filepath.Join(root, "made/sub")) {
+		t.Errorf("mkdir within the root failed: code %d, stderr %q", code, stderr.String())
+	}
+
+	if _, err := New(Config{DB: db, Dir: "/", Root: root, Restricted: true}); err == nil {
+		t.Error("Session started outside its root")
+	}
+}
+
+func TestServer(t *testing.T) {
+	db, err := OpenDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("OpenDB failed: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	admin, err := New(Config{DB: db, Stdout: io.Discard, Stderr: io.Discard})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	admin.Execute("adduser alice A1ice!pass")
+
+	dir := t.TempDir()
+	srv := &Server{
+		Config:       Config{DB: db, Dir: dir, Env: []string{"PATH=" + os.Getenv("PATH")}},
+		LoginTimeout: 500 * time.Millisecond,
+		ErrorLog:     log.New(io.Discard, "", 0),
+	}
+	unixListener, err := Listen("unix:" + filepath.Join(t.TempDir(), "gosh.sock"))
+	if err != nil {
+		t.Fatalf("Listen on a Unix socket failed: %v", err)
+	}
+	tcpListener, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen on TCP failed: %v", err)
+	}
+	for _, l := range []net.Listener{unixListener, tcpListener} {
+		go srv.Serve(l)
+	}
+	t.Cleanup(func() { srv.Close() })
+
+	dial := func(t *testing.T, l net.Listener) net.Conn {
+		t.Helper()
+		conn, err := net.Dial(l.Addr().Network(), l.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		return conn
+	}
+	session := func(t *testing.T, l net.Listener, input string) string {
+		t.Helper()
+		conn := dial(t, l)
+		io.WriteString(conn, input)
+		out, err := io.ReadAll(conn)
+		if err != nil {
+			t.Fatalf("Reading the session failed: %v, got: %s", err, out)
+		}
+		return string(out)
+	}
+
+	t.Run("Session", func(t *testing.T) {
+		for _, l := range []net.Listener{unixListener, tcpListener} {
+			out := session(t, l, "alice\r\nA1ice!pass\r\nwhoami\r\ncd /tmp\r\npwd\r\nlogout\r\npwd\r\n")
+			for _, want := range []string{"login: Password: login successful\n", "alice:$ alice\n", "alice:$ alice:$ /tmp\n"} {
+				if !strings.Contains(out, want) {
+					t.Errorf("%s session missing %q, got: %s", l.Addr().Network(), want, out)
+				}
+			}
+			if strings.Count(out, "/tmp\n") != 1 {
+				t.Errorf("Session went on after logout: %s", out)
+			}
+		}
+	})
+
+	t.Run("Independent", func(t *testing.T) {
+		first := dial(t, unixListener)
+		io.WriteString(first, "alice\nA1ice!pass\ncd /tmp\nexport COLOR=red\n")
+		out := session(t, tcpListener, "alice\nA1ice!pass\npwd\necho color=$COLOR\nlogout\n")
+		if !strings.Contains(out, dir+"\n") || !strings.Contains(out, "color=\n") {
+			t.Errorf("Sessions share state, got: %s", out)
+		}
+		io.WriteString(first, "pwd\necho color=$COLOR\nlogout\n")
+		rest, _ := io.ReadAll(first)
+		if !strings.Contains(string(rest), "/tmp\n") || !strings.Contains(string(rest), "color=red\n") {
+			t.Errorf("Session lost its state, got: %s", rest)
+		}
+	})
+
+	t.Run("FailedLogin", func(t *testing.T) {
+		out := session(t, tcpListener, "mallory\nx\nmallory\nx\nmallory\nx\nwhoami\n")
+		if strings.Count(out, "Password: ") != 3 || !strings.HasSuffix(out, "too many failed logins\n") {
+			t.Errorf("Failed logins not refused, got: %s", out)
+		}
+	})
+
+	t.Run("LoginTimeout", func(t *testing.T) {
+		conn := dial(t, unixListener)
+		out, _ := io.ReadAll(conn)
+		if !strings.Contains(string(out), "login timed out") {
+			t.Errorf("Idle connection not closed, got: %q", out)
+		}
+	})
+
+	t.Run("Close", func(t *testing.T) {
+		srv := &Server{Config: Config{DB: db}, ErrorLog: log.New(io.Discard, "", 0)}
+		l, err := Listen("127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Listen failed: %v", err)
+		}
+		served := make(chan error, 1)
+		go func() { served <- srv.Serve(l) }()
+
+		conn := dial(t, l)
+		io.WriteString(conn, "alice\nA1ice!pass\n")
+		buf := make([]byte, 256)
+		for out := ""; !strings.Contains(out, "alice:$ "); {
+			n, err := conn.Read(buf)
+			if err != nil {
+				t.Fatalf("Session ended early: %v, got: %s", err, out)
+			}
+			out += string(buf[:n])
+		}
+		srv.Close()
+		if err := <-served; err != nil {
+			t.Errorf("Serve returned %v after Close", err)
+		}
+		var open int
+		db.QueryRow("SELECT COUNT(*) FROM sessions WHERE username = 'alice' AND logout_at IS NULL").Scan(&open)
+		if open != 0 {
+			t.Errorf("%d sessions still open after Close", open)
+		}
+	})
+}
+
+func TestRecording(t *testing.T) {
+	in, stdout, stderr := newTestInterpreter(t, "PATH="+os.Getenv("PATH"), "TERM=xterm")
+	dir := in.Dir()
+
+	for _, line := range []string{"record -t demo s.cast", "record", "echo héllo", "", "cat nope", "login bob S3cret!pw", "sh -c 'echo external'", "record stop"} {
+		in.Execute(line)
+	}
+	if !strings.Contains(stdout.String(), "recording since") || !strings.Contains(stdout.String(), "external\n") {
+		t.Errorf("Output not passed through while recording: %q", stdout.String())
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "s.cast"))
+	if err != nil {
+		t.Fatalf("Recording not written: %v", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	var header castHeader
+	if err := json.Unmarshal([]byte(lines[0]), &header); err != nil || header.Version != 2 || header.Title != "demo" || header.Width != 80 || header.Env["TERM"] != "xterm" {
+		t.Errorf("Bad header %q: %v", lines[0], err)
+	}
+	var inputs, outputs strings.Builder
+	last := 0.0
+	for _, line := range lines[1:] {
+		var event []any
+		if err := json.Unmarshal([]byte(line), &event); err != nil || len(event) != 3 {
+			t.Fatalf("Bad event %q: %v", line, err)
+		}
+		if at := event[0].(float64); at < last {
+			t.Errorf("Event times go back: %v after %v", at, last)
+		} else {
+			last = at
+		}
+		switch event[1] {
+		case "i":
+			inputs.WriteString(event[2].(string))
+		case "o":
+			outputs.WriteString(event[2].(string))
+		}
+	}
+	if want := "record\necho héllo\n\ncat nope\nlogin bob\nsh -c 'echo external'\nrecord stop\n"; inputs.String() != want {
+		t.Errorf("Recorded input %q, want %q", inputs.String(), want)
+	}
+	for _, want := range []string{"echo héllo\r\nhéllo\r\n", "cat: open ", "external\r\n"} {
+		if !strings.Contains(outputs.String(), want) {
+			t.Errorf("Recorded output missing %q, got: %q", want, outputs.String())
+		}
+	}
+	if strings.Contains(string(data), "S3cret") {
+		t.Error("Password recorded")
+	}
+
+	t.Run("Replay", func(t *testing.T) {
+		stdout.Reset()
+		if code := in.Execute("replay -s 1000 s.cast"); code != 0 || stdout.String() != outputs.String() {
+			t.Errorf("Replay: code %d, got %q, want %q", code, stdout.String(), outputs.String())
+		}
+
+		cast := `{"version": 2, "width": 80, "height": 24}
+[0.5, "o", "a"]
+[0.6, "i", "x"]
+[10.5, "o", "b"]
+`
+		os.WriteFile(filepath.Join(dir, "idle.cast"), []byte(cast), 0644)
+		stdout.Reset()
+		start := time.Now()
+		in.Execute("replay -s 2 -i 0.1 idle.cast")
+		if elapsed := time.Since(start); stdout.String() != "ab" || elapsed < 50*time.Millisecond || elapsed > 2*time.Second {
+			t.Errorf("Replay with idle limit: got %q after %v", stdout.String(), elapsed)
+		}
+
+		os.WriteFile(filepath.Join(dir, "bad.cast"), []byte(`{"version": 1}`+"\n"), 0644)
+		stderr.Reset()
+		if code := in.Execute("replay bad.cast"); code != 1 || stderr.String() != "replay: bad.cast: not an asciicast v2 file\n" {
+			t.Errorf("Bad file: code %d, stderr %q", code, stderr.String())
+		}
+	})
+
+	stderr.Reset()
+	if code := in.Execute("record stop"); code != 1 || stderr.String() != "record: not recording\n" {
+		t.Errorf("Stop without recording: code %d, stderr %q", code, stderr.String())
+	}
+}
+
+func TestJSONOutput(t *testing.T) {
+	in, stdout, stderr := newTestInterpreter(t, "PATH="+os.Getenv("PATH"))
+	dir := in.Dir()
+	os.WriteFile(filepath.Join(dir, "a.txt"), []byte("hello"), 0640)
+	os.Mkdir(filepath.Join(dir, "sub"), 0755)
+
+	run := func(line string) int {
+		stdout.Reset()
+		stderr.Reset()
+		return in.Execute(line)
+	}
+	records := func(t *testing.T) []map[string]any {
+		t.Helper()
+		var out []map[string]any
+		for _, line := range strings.Split(strings.TrimSuffix(stdout.String(), "\n"), "\n") {
+			var record map[string]any
+			if err := json.Unmarshal([]byte(line), &record); err != nil {
+				t.Fatalf("Not a JSON record: %q", line)
+			}
+			out = append(out, record)
+		}
+		return out
+	}
+
+	if run("set -o json"); !in.Option("json") {
+		t.Fatalf("set -o json failed: %s", stderr.String())
+	}
+	if run("set"); !strings.Contains(stdout.String(), "json            on\n") {
+		t.Errorf("set listing: %q", stdout.String())
+	}
+	if run("set +o"); !strings.Contains(stdout.String(), "set -o json\n") {
+		t.Errorf("set +o listing: %q", stdout.String())
+	}
+	if code := run("set -o nope"); code != 1 || stderr.String() != "set: nope: invalid option name\n" {
+		t.Errorf("Unknown option: code %d, stderr %q", code, stderr.String())
+	}
+
+	t.Run("Ls", func(t *testing.T) {
+		run("ls")
+		got := records(t)
+		if len(got) != 2 || got[0]["name"] != "a.txt" || got[0]["type"] != "regular file" || got[0]["size"] != 5.0 ||
+			got[0]["mode"] != "-rw-r-----" || got[1]["name"] != "sub" || got[1]["type"] != "directory" {
+			t.Errorf("ls records: %v", got)
+		}
+		if _, err := time.Parse(time.RFC3339, got[0]["modified"].(string)); err != nil {
+			t.Errorf("Bad modification time: %v", err)
+		}
+	})
+
+	t.Run("Type", func(t *testing.T) {
+		run("type time cd sh")
+		got := records(t)
+		if len(got) != 3 || got[0]["kind"] != "keyword" || got[1]["kind"] != "builtin" || got[1]["path"] != nil ||
+			got[2]["name"] != "sh" || got[2]["kind"] != "file" || !strings.HasSuffix(got[2]["path"].(string), "/sh") {
+			t.Errorf("type records: %v", got)
+		}
+		if code := run("type nope"); code != 1 || stdout.Len() != 0 || stderr.String() != "type: nope: not found\n" {
+			t.Errorf("type of a missing command: code %d, stdout %q, stderr %q", code, stdout.String(), stderr.String())
+		}
+	})
+
+	t.Run("History", func(t *testing.T) {
+		for _, user := range []string{"", "dana"} {
+			if user != "" {
+				run("adduser dana D4na!pass")
+				run("login dana D4na!pass")
+			}
+			run("echo one")
+			run("echo one")
+			run("pwd")
+			before := time.Now().Add(-time.Minute)
+			run("history")
+			got := records(t)
+			found := false
+			for _, r := range got {
+				if r["command"] == "echo one" {
+					found = true
+					last, err := time.Parse(time.RFC3339, r["last_used"].(string))
+					if r["count"] != 2.0 || err != nil || last.Before(before) {
+						t.Errorf("%q history record: %v", user, r)
+					}
+				}
+				if r["command"] == "history" {
+					t.Errorf("%q history lists itself", user)
+				}
+			}
+			if !found {
+				t.Errorf("%q history records: %v", user, got)
+			}
+		}
+	})
+
+	t.Run("Flag", func(t *testing.T) {
+		out, _, _ := runShellWithArgs(t, []string{"--json"}, "type cd\nset +o json\ntype cd")
+		if !strings.Contains(out, `{"name":"cd","kind":"builtin"}`) || !strings.Contains(out, "cd is a shell builtin") {
+			t.Errorf("--json not applied, got: %s", out)
+		}
+	})
+}
+
+func TestSetOptions(t *testing.T) {
+	in, stdout, stderr := newTestInterpreter(t, "PATH="+os.Getenv("PATH"))
+	run := func(line string) int {
+		stdout.Reset()
+		stderr.Reset()
+		return in.Execute(line)
+	}
+
+	t.Run("Flags", func(t *testing.T) {
+		if code := run("set -eu -o pipefail"); code != 0 {
+			t.Fatalf("set failed: %s", stderr.String())
+		}
+		for _, name := range []string{"errexit", "nounset", "pipefail"} {
+			if !in.Option(name) {
+				t.Errorf("%s not set", name)
+			}
+		}
+		run("set +eu +o pipefail")
+		if in.Option("errexit") || in.Option("nounset") || in.Option("pipefail") {
+			t.Error("Options not cleared")
+		}
+		if code := run("set -q"); code != 2 || stderr.String() != "set: -q: invalid option\n" {
+			t.Errorf("Invalid flag: code %d, stderr %q", code, stderr.String())
+		}
+		if run("set"); stdout.String() != "errexit         off\njson            off\nnounset         off\npipefail        off\nxtrace          off\n" {
+			t.Errorf("set listing: %q", stdout.String())
+		}
+	})
+
+	t.Run("Xtrace", func(t *testing.T) {
+		defer run("set +x")
+		run("set -x")
+		run(`export GREETING="hello world"`)
+		run("echo $GREETING")
+		if stderr.String() != "+ echo 'hello world'\n" {
+			t.Errorf("Trace: %q", stderr.String())
+		}
+		run("export PS4='> '")
+		if run("echo hi"); stderr.String() != "> echo hi\n" {
+			t.Errorf("Trace with PS4: %q", stderr.String())
+		}
+		if run("login nobody 'Passw0rd!'"); !strings.HasPrefix(stderr.String(), "> login nobody\n") || strings.Contains(stderr.String(), "Passw0rd") {
+			t.Errorf("Trace of a password: %q", stderr.String())
+		}
+	})
+
+	t.Run("Nounset", func(t *testing.T) {
+		defer run("set +u")
+		run("set -u")
+		if code := run("echo $UNSET_VARIABLE"); code != 1 || stderr.String() != "UNSET_VARIABLE: unbound variable\n" {
+			t.Errorf("Unset variable: code %d, stderr %q", code, stderr.String())
+		}
+		run("export EMPTY=")
+		if code := run("echo x${EMPTY}x"); code != 0 || stdout.String() != "xx\n" {
+			t.Errorf("Empty variable: code %d, stdout %q", code, stdout.String())
+		}
+	})
+
+	t.Run("Pipefail", func(t *testing.T) {
+		if code := run("false | true"); code != 0 {
+			t.Errorf("Without pipefail: got %d", code)
+		}
+		defer run("set +o pipefail")
+		run("set -o pipefail")
+		if code := run("sh -c 'exit 3' | sh -c 'exit 4' | true"); code != 4 {
+			t.Errorf("With pipefail: got %d", code)
+		}
+	})
+
+	t.Run("Errexit", func(t *testing.T) {
+		script := "# a comment\nexport STEP=one\nset -e\ncat missing-file\nexport STEP=two\n"
+		in, _, stderr := newTestInterpreter(t)
+		if code := in.RunScript(strings.NewReader(script)); code != 1 {
+			t.Errorf("Script status: got %d, stderr %s", code, stderr.String())
+		}
+		if step := in.Getenv("STEP"); step != "one" {
+			t.Errorf("Script went on after a failure: STEP=%s", step)
+		}
+	})
+
+	t.Run("Source", func(t *testing.T) {
+		os.WriteFile(filepath.Join(in.Dir(), "setup.sh"), []byte("export SOURCED=yes\ncd ..\n"), 0644)
+		dir := in.Dir()
+		if code := run(". setup.sh"); code != 0 || in.Getenv("SOURCED") != "yes" {
+			t.Errorf("source: code %d, stderr %s", code, stderr.String())
+		}
+		if in.Dir() != filepath.Dir(dir) {
+			t.Errorf("Directory not changed by source: %s", in.Dir())
+		}
+	})
+}
+
+func TestArithmetic(t *testing.T) {
+	in, stdout, stderr := newTestInterpreter(t)
+	run := func(line string) int {
+		stdout.Reset()
+		stderr.Reset()
+		return in.Execute(line)
+	}
+
+	in.Execute("export N=7 E=2+3 EMPTY=")
+	for expr, want := range map[string]string{
+		"1 + 2 * 3":               "7",
+		"(1 + 2) * 3":             "9",
+		"2 ** 10":                 "1024",
+		"-2 ** 2":                 "4",
+		"7 / 2, 7 % 3":            "1",
+		"-7 / 2":                  "-3",
+		"0x1f + 010 + 2#101":      "44",
+		"N * 2":                   "14",
+		"$N - 1":                  "6",
+		"${N} << 1":               "14",
+		"E * 2":                   "10",
+		"EMPTY + UNSET":           "0",
+		"1 < 2 && 3 >= 3":         "1",
+		"0 || !5":                 "0",
+		"~0 & 6 ^ 3 | 8":          "13",
+		"N > 5 ? 10 : 20":         "10",
+		"0 ? 1/0 : 3":             "3",
+		"0 && 1/0":                "0",
+		"(1) + (2)":               "3",
+		"9223372036854775807 + 1": "-9223372036854775808",
+	} {
+		if code := run("echo $((" + expr + "))"); code != 0 || stdout.String() != want+"\n" {
+			t.Errorf("$((%s)): code %d, got %q, want %s (stderr %q)", expr, code, stdout.String(), want, stderr.String())
+		}
+	}
+
+	t.Run("Words", func(t *testing.T) {
+		if run(`echo "$(( 1 | 2 ))" x$((N+1))y '$((1))'`); stdout.String() != "3 x8y $((1))\n" {
+			t.Errorf("Expansion in words: %q", stdout.String())
+		}
+		if run("echo $(( 3 | 4 )) | cat"); stdout.String() != "7\n" {
+			t.Errorf("Pipe inside arithmetic: %q %q", stdout.String(), stderr.String())
+		}
+	})
+
+	t.Run("Assignment", func(t *testing.T) {
+		in.Execute("export i=0")
+		if code := run("let i++ 'j = i + 5'"); code != 0 || in.Getenv("i") != "1" || in.Getenv("j") != "6" {
+			t.Errorf("let: code %d, i=%s j=%s", code, in.Getenv("i"), in.Getenv("j"))
+		}
+		if code := run("(( i += 10, j *= 2 ))"); code != 0 || in.Getenv("i") != "11" || in.Getenv("j") != "12" {
+			t.Errorf("((: code %d, i=%s j=%s", code, in.Getenv("i"), in.Getenv("j"))
+		}
+		if run("echo $((i++)) $((++i)) $((i--))"); stdout.String() != "11 13 13\n" {
+			t.Errorf("Increments: %q", stdout.String())
+		}
+		if run("(( 0 && (k = 1) ))"); in.Getenv("k") != "" {
+			t.Errorf("Assignment in a branch not taken: k=%s", in.Getenv("k"))
+		}
+	})
+
+	t.Run("Status", func(t *testing.T) {
+		for line, want := range map[string]int{
+			"(( 1 ))":     0,
+			"(( 0 ))":     1,
+			"(( N > 5 ))": 0,
+			"let 'N < 5'": 1,
+			"let 1 0":     1,
+			"let 0 1":     0,
+			"(( 1 / 0 ))": 1,
+			"let '1 +'":   1,
+			"let '2 = 3'": 1,
+		} {
+			if code := run(line); code != want {
+				t.Errorf("%s: got status %d, want %d", line, code, want)
+			}
+		}
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		for line, want := range map[string]string{
+			"echo $(( 1 / 0 ))": "1 / 0: division by zero\n",
+			"let '1 +'":         "let: 1 +: syntax error: operand expected\n",
+			"(( 2 = 3 ))":       "((: 2 = 3: attempted assignment to non-variable\n",
+			"let '2 ** -1'":     "let: 2 ** -1: exponent less than 0\n",
+			"let '1 @ 2'":       "let: 1 @ 2: syntax error: invalid character '@'\n",
+		} {
+			if code := run(line); code != 1 || stderr.String() != want {
+				t.Errorf("%s: code %d, stderr %q, want %q", line, code, stderr.String(), want)
+			}
+		}
+		in.Execute("export loop=loop")
+		if run("echo $((loop))"); !strings.Contains(stderr.String(), "recursion level exceeded") {
+			t.Errorf("Recursive variable: %q", stderr.String())
+		}
+	})
+}
+
+func TestConditionals(t *testing.T) {
+	in, stdout, stderr := newTestInterpreter(t)
+	run := func(line string) int {
+		stdout.Reset()
+		stderr.Reset()
+		return in.Execute(line)
+	}
+	dir := in.Dir()
+	os.WriteFile(filepath.Join(dir, "empty"), nil, 0644)
+	os.WriteFile(filepath.Join(dir, "full.txt"), []byte("data"), 0600)
+	os.WriteFile(filepath.Join(dir, "script"), []byte("#!/bin/sh\n"), 0755)
+	os.Mkdir(filepath.Join(dir, "sub"), 0755)
+	in.Execute(`export F=full.txt V=1.23 EMPTY= SPACED="a b"`)
+
+	for line, want := range map[string]int{
+		"test -e empty":                       0,
+		"test -e missing":                     1,
+		"test -f full.txt":                    0,
+		"test -f sub":                         1,
+		"test -d sub":                         0,
+		"test -s full.txt":                    0,
+		"test -s empty":                       1,
+		"test -r full.txt":                    0,
+		"test -w full.txt":                    0,
+		"test -x script":                      0,
+		"test -x full.txt":                    1,
+		"[ -n abc ]":                          0,
+		"[ -z '' ]":                           0,
+		"[ abc ]":                             0,
+		"[ '' ]":                              1,
+		"test":                                1,
+		"test -f":                             0,
+		"[ a = a ]":                           0,
+		"[ a != a ]":                          1,
+		"[ a '<' b ]":                         0,
+		"[ 10 -gt 9 ]":                        0,
+		"[ 10 -le 9 ]":                        1,
+		"[ ! -d sub ]":                        1,
+		"[ -d sub -a -f full.txt ]":           0,
+		"[ -d missing -o a = b ]":             1,
+		"[ ( a = b ) -o a ]":                  0,
+		"[ -f = -f ]":                         0,
+		"[[ -f $F ]]":                         0,
+		"[[ $F == *.txt ]]":                   0,
+		"[[ $F == full.??? ]]":                0,
+		`[[ $F == "*.txt" ]]`:                 1,
+		`[[ $F == full"."* ]]`:                0,
+		`[[ 'a*b' == a\** ]]`:                 0,
+		`[[ axb == a\** ]]`:                   1,
+		`[[ "été" == "été" ]]`:                0,
+		`[[ été.txt == "été".* ]]`:            0,
+		`[[ été =~ ^"é"t ]]`:                  0,
+		"[[ $F != [a-f]* ]]":                  1,
+		"[[ $V =~ ^[0-9]+\\.[0-9]+$ ]]":       0,
+		`[[ 1x23 =~ "1.2" ]]`:                 1,
+		"[[ $V =~ (1|2)\\.2 ]]":               0,
+		"[[ $EMPTY ]]":                        1,
+		"[[ -z $EMPTY && -n $SPACED ]]":       0,
+		"[[ -n $EMPTY || $SPACED == 'a b' ]]": 0,
+		"[[ ! -e missing && ( 1 -eq 2 || b > a ) ]]": 0,
+		"[[ 2+1 -eq 3 ]]":              0,
+		"[[ -z $EMPTY || 1/0 -eq 1 ]]": 0,
+	} {
+		if code := run(line); code != want {
+			t.Errorf("%s: got status %d, want %d (stderr %q)", line, code, want, stderr.String())
+		}
+	}
+
+	t.Run("Errors", func(t *testing.T) {
+		for line, want := range map[string]string{
+			"[ a = a":         "[: missing ]\n",
+			"[ 3 -lt x ]":     "[: x: integer expression expected\n",
+			"test a b":        "test: b: unexpected argument\n",
+			"[[ a =~ ( ]]":    "[[: (: invalid regular expression\n",
+			"[[ 1/0 -eq 1 ]]": "[[: 1/0: division by zero\n",
+			"[[ ]]":           "[[: condition expected\n",
+		} {
+			if code := run(line); code != 2 || stderr.String() != want {
+				t.Errorf("%s: code %d, stderr %q, want %q", line, code, stderr.String(), want)
+			}
+		}
+	})
+
+	t.Run("Words", func(t *testing.T) {
+		if run("type [[ test ["); stdout.String() != "[[ is a shell keyword\ntest is a shell builtin\n[ is a shell builtin\n" {
+			t.Errorf("type: %q", stdout.String())
+		}
+		if run("echo [[ a ]] | cat"); stdout.String() != "[[ a ]]\n" {
+			t.Errorf("[[ as an argument: %q", stdout.String())
+		}
+	})
+}
+
+func TestRead(t *testing.T) {
+	db, err := OpenDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("OpenDB failed: %v", err)
+	}
+	defer db.Close()
+	var stdout, stderr bytes.Buffer
+	input := "alpha beta  gamma delta\n" +
+		`one\ two three\` + "\n" + "continued\n" +
+		"  padded  \n"
+	in, err := New(Config{DB: db, Stdin: strings.NewReader(input), Stdout: &stdout, Stderr: &stderr, Dir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	run := func(line string) int {
+		stdout.Reset()
+		stderr.Reset()
+		return in.Execute(line)
+	}
+
+	t.Run("Input", func(t *testing.T) {
+		if code := run("read -p 'Words: ' a b c"); code != 0 || stderr.String() != "Words: " {
+			t.Fatalf("read: code %d, stderr %q", code, stderr.String())
+		}
+		if a, b, c := in.Getenv("a"), in.Getenv("b"), in.Getenv("c"); a != "alpha" || b != "beta" || c != "gamma delta" {
+			t.Errorf("Fields: a=%q b=%q c=%q", a, b, c)
+		}
+		if run("read x y"); in.Getenv("x") != "one two" || in.Getenv("y") != "threecontinued" {
+			t.Errorf("Escapes: x=%q y=%q", in.Getenv("x"), in.Getenv("y"))
+		}
+		if run("read"); in.Getenv("REPLY") != "  padded  " {
+			t.Errorf("REPLY: %q", in.Getenv("REPLY"))
+		}
+		if code := run("read z"); code != 1 || in.Getenv("z") != "" {
+			t.Errorf("End of input: code %d, z=%q", code, in.Getenv("z"))
+		}
+	})
+
+	t.Run("Redirection", func(t *testing.T) {
+		os.WriteFile(filepath.Join(in.Dir(), "data"), []byte(`a\b c\`+"\nnext\n"), 0644)
+		if code := run("read -r first rest < data"); code != 0 || in.Getenv("first") != `a\b` || in.Getenv("rest") != `c\` {
+			t.Errorf("read -r: code %d, first=%q rest=%q", code, in.Getenv("first"), in.Getenv("rest"))
+		}
+		if run("echo piped input | read p q"); in.Getenv("p") != "piped" || in.Getenv("q") != "input" {
+			t.Errorf("Pipe: p=%q q=%q", in.Getenv("p"), in.Getenv("q"))
+		}
+	})
+
+	t.Run("Arrays", func(t *testing.T) {
+		in.Execute("export IFS=.:")
+		defer in.Execute("export IFS=' \t'")
+		if code := run("echo 192.168..1: | read -a octets"); code != 0 {
+			t.Fatalf("read -a: %s", stderr.String())
+		}
+		if octets, _ := in.Array("octets"); strings.Join(octets, ",") != "192,168,,1" {
+			t.Errorf("Array: %q", octets)
+		}
+		if run(`echo ${octets[0]} ${octets[-1]} ${#octets[@]} "${octets[@]}" x${octets[9]}x`); stdout.String() != "192 1 4 192 168  1 xx\n" {
+			t.Errorf("Array expansion: %q", stdout.String())
+		}
+		in.Execute("export i=1")
+		if run("echo ${octets[i+2]} ${#octets[1]}"); stdout.String() != "1 3\n" {
+			t.Errorf("Arithmetic index: %q", stdout.String())
+		}
+
+		// The command checked is the one that runs, each word being expanded
+		// once.
+		run("echo echo.audit | read -a cmds")
+		in.Execute("export i=0")
+		if code := run("${cmds[i++]} -n ran"); code != 0 || stdout.String() != "ran" || in.Getenv("i") != "1" {
+			t.Errorf("Allowed command: code %d, stdout %q, i=%s", code, stdout.String(), in.Getenv("i"))
+		}
+		if code := run("${cmds[i++]} -n 2"); code != 1 || stdout.String() != "" || !strings.Contains(stderr.String(), "audit: permission denied") || in.Getenv("i") != "2" {
+			t.Errorf("Denied command: code %d, stdout %q, stderr %q, i=%s", code, stdout.String(), stderr.String(), in.Getenv("i"))
+		}
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		start := time.Now()
+		code := run("sh -c 'sleep 1' | read -t 0.2 slow")
+		if code != readTimeoutStatus || time.Since(start) > 3*time.Second {
+			t.Errorf("Timeout: code %d after %v", code, time.Since(start))
+		}
+		start = time.Now()
+		if code := run("read -t 0.2 zeros < /dev/zero"); code != readTimeoutStatus || time.Since(start) > 3*time.Second {
+			t.Errorf("Timeout on /dev/zero: code %d after %v", code, time.Since(start))
+		}
+
+		// A partial line on input without read deadlines, as a descriptor
+		// in blocking mode is.
+		pr, pw, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer pr.Close()
+		defer pw.Close()
+		blocking, err := New(Config{DB: db, Stdin: os.NewFile(pr.Fd(), "input"), Stdout: &stdout, Stderr: &stderr, Dir: t.TempDir()})
+		if err != nil {
+			t.Fatalf("New failed: %v", err)
+		}
+		pw.WriteString("partial")
+		start = time.Now()
+		if code := blocking.Execute("read -t 0.2 part"); code != readTimeoutStatus || time.Since(start) > 3*time.Second {
+			t.Errorf("Timeout on a partial line: code %d after %v", code, time.Since(start))
+		}
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		for line, want := range map[string]string{
+			"read 1x":     "read: 1x: not a valid identifier\n",
+			"read -t x v": "read: x: invalid timeout\n",
+			"read -q v":   "read: invalid option -- 'q'\n",
+		} {
+			if code := run(line); code != 1 || stderr.String() != want {
+				t.Errorf("%s: code %d, stderr %q, want %q", line, code, stderr.String(), want)
+			}
+		}
+	})
+}
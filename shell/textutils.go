@@ -0,0 +1,765 @@
+package shell
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The text utilities below stand in for their coreutils namesakes on systems
+// that do not have them. They read their file operands, or their input for
+// "-" and when no file is given, so they work inside pipelines.
+
+// openInput opens a file operand; "-" is the builtin's input.
+func openInput(env *Env, name string) (io.Reader, func(), error) {
+	if name == "-" {
+		return env.Stdin, func() {}, nil
+	}
+	f, err := os.Open(env.Path(name))
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, func() { f.Close() }, nil
+}
+
+// eachLine calls fn with every line of r, including its newline, until fn
+// returns false. The last line may lack the newline.
+func eachLine(r io.Reader, fn func(line string) bool) error {
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if line != "" && !fn(line) {
+			return nil
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// numericShorthand rewrites the historical "-5" form of head and tail into
+// "-n 5".
+func numericShorthand(args []string) []string {
+	if len(args) > 0 && len(args[0]) > 1 && args[0][0] == '-' {
+		if _, err := strconv.Atoi(args[0][1:]); err == nil {
+			return append([]string{"-n", args[0][1:]}, args[1:]...)
+		}
+	}
+	return args
+}
+
+// grep [-ivnrclhHFE] pattern [file ...]
+func handleGrep(env *Env, args []string) int {
+	opts, args, err := getopt(args, "ivnrclhHFE")
+	if err != nil {
+		fmt.Fprintf(env.Stderr, "grep: %v\n", err)
+		return 2
+	}
+	if len(args) == 0 {
+		fmt.Fprintln(env.Stderr, "grep: missing pattern")
+		return 2
+	}
+	pattern, files := args[0], args[1:]
+	if opts.has('F') {
+		pattern = regexp.QuoteMeta(pattern)
+	}
+	if opts.has('i') {
+		pattern = "(?i)" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		fmt.Fprintf(env.Stderr, "grep: invalid pattern: %v\n", err)
+		return 2
+	}
+	if len(files) == 0 {
+		files = []string{"-"}
+		if opts.has('r') {
+			files = []string{"."}
+		}
+	}
+	showNames := (len(files) > 1 || opts.has('r')) && !opts.has('h') || opts.has('H')
+
+	matched, failed := false, false
+	search := func(r io.Reader, name string) error {
+		prefix := ""
+		if showNames {
+			prefix = name + ":"
+		}
+		count, lineNo := 0, 0
+		var werr error
+		err := eachLine(r, func(line string) bool {
+			lineNo++
+			if re.MatchString(strings.TrimSuffix(line, "\n")) == opts.has('v') {
+				return true
+			}
+			count++
+			switch {
+			case opts.has('l'):
+				_, werr = fmt.Fprintln(env.Stdout, name)
+				return false
+			case opts.has('c'):
+			case opts.has('n'):
+				_, werr = fmt.Fprintf(env.Stdout, "%s%d:%s", prefix, lineNo, withNewline(line))
+			default:
+				_, werr = fmt.Fprint(env.Stdout, prefix+withNewline(line))
+			}
+			return werr == nil
+		})
+		if opts.has('c') && werr == nil {
+			_, werr = fmt.Fprintf(env.Stdout, "%s%d\n", prefix, count)
+		}
+		if count > 0 {
+			matched = true
+		}
+		if werr != nil {
+			return werr
+		}
+		return err
+	}
+
+	for _, name := range files {
+		if name == "-" {
+			if err := search(env.Stdin, "(standard input)"); err != nil {
+				fmt.Fprintf(env.Stderr, "grep: %v\n", err)
+				failed = true
+			}
+			continue
+		}
+
+		root := env.Path(name)
+		info, err := os.Stat(root)
+		if err == nil && info.IsDir() && !opts.has('r') {
+			err = fmt.Errorf("%s: is a directory", name)
+		}
+		if err != nil {
+			fmt.Fprintf(env.Stderr, "grep: %v\n", err)
+			failed = true
+			continue
+		}
+		err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				fmt.Fprintf(env.Stderr, "grep: %v\n", err)
+				failed = true
+				return nil
+			}
+			if d.IsDir() {
+				return nil
+			}
+			f, err := os.Open(path)
+			if err != nil {
+				fmt.Fprintf(env.Stderr, "grep: %v\n", err)
+				failed = true
+				return nil
+			}
+			defer f.Close()
+			// Show paths the way they were given, not resolved.
+			return search(f, name+strings.TrimPrefix(path, root))
+		})
+		if err != nil {
+			fmt.Fprintf(env.Stderr, "grep: %v\n", err)
+			failed = true
+			break
+		}
+	}
+
+	switch {
+	case failed:
+		return 2
+	case matched:
+		return 0
+	}
+	return 1
+}
+
+func withNewline(line string) string {
+	if strings.HasSuffix(line, "\n") {
+		return line
+	}
+	return line + "\n"
+}
+
+// printHeader prints the "==> name <==" line head and tail put before each
+// file when given several.
+func printHeader(env *Env, name string, first bool) {
+	if !first {
+		fmt.Fprintln(env.Stdout)
+	}
+	if name == "-" {
+		name = "standard input"
+	}
+	fmt.Fprintf(env.Stdout, "==> %s <==\n", name)
+}
+
+// head [-n lines | -c bytes] [file ...]
+func handleHead(env *Env, args []string) int {
+	opts, files, err := getopt(numericShorthand(args), "n:c:")
+	if err != nil {
+		fmt.Fprintf(env.Stderr, "head: %v\n", err)
+		return 1
+	}
+	lines, bytes := 10, -1
+	if v, ok := opts['n']; ok {
+		if lines, err = strconv.Atoi(v); err != nil || lines < 0 {
+			fmt.Fprintf(env.Stderr, "head: invalid number of lines: %s\n", v)
+			return 1
+		}
+	}
+	if v, ok := opts['c']; ok {
+		if bytes, err = strconv.Atoi(v); err != nil || bytes < 0 {
+			fmt.Fprintf(env.Stderr, "head: invalid number of bytes: %s\n", v)
+			return 1
+		}
+	}
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+
+	status := 0
+	for i, name := range files {
+		r, done, err := openInput(env, name)
+		if err != nil {
+			fmt.Fprintf(env.Stderr, "head: %v\n", err)
+			status = 1
+			continue
+		}
+		if len(files) > 1 {
+			printHeader(env, name, i == 0)
+		}
+
+		if bytes >= 0 {
+			_, err = io.CopyN(env.Stdout, r, int64(bytes))
+			if err == io.EOF {
+				err = nil
+			}
+		} else {
+			n := 0
+			var werr error
+			if lines > 0 {
+				err = eachLine(r, func(line string) bool {
+					_, werr = io.WriteString(env.Stdout, line)
+					n++
+					return werr == nil && n < lines
+				})
+			}
+			if werr != nil {
+				err = werr
+			}
+		}
+		done()
+		if err != nil {
+			fmt.Fprintf(env.Stderr, "head: %s: %v\n", name, err)
+			status = 1
+		}
+	}
+	return status
+}
+
+// lastLinesOffset returns the offset at which the last n lines of f start,
+// reading the file backwards so that only the end of it is read.
+func lastLinesOffset(f *os.File, size int64, n int) (int64, error) {
+	if n == 0 {
+		return size, nil
+	}
+	buf := make([]byte, 32*1024)
+	newlines := 0
+	for end := size; end > 0; {
+		start := max(end-int64(len(buf)), 0)
+		chunk := buf[:end-start]
+		if _, err := f.ReadAt(chunk, start); err != nil {
+			return 0, err
+		}
+		for i := len(chunk) - 1; i >= 0; i-- {
+			// A newline ending the file does not start another line.
+			if chunk[i] != '\n' || start+int64(i) == size-1 {
+				continue
+			}
+			if newlines++; newlines == n {
+				return start + int64(i) + 1, nil
+			}
+		}
+		end = start
+	}
+	return 0, nil
+}
+
+// tailLines writes the last n lines of r, or everything from line n on when
+// fromStart is set.
+func tailLines(env *Env, r io.Reader, n int, fromStart bool) error {
+	if f, ok := r.(*os.File); ok && !fromStart {
+		if info, err := f.Stat(); err == nil && info.Mode().IsRegular() {
+			offset, err := lastLinesOffset(f, info.Size(), n)
+			if err != nil {
+				return err
+			}
+			if _, err := f.Seek(offset, io.SeekStart); err != nil {
+				return err
+			}
+			_, err = io.Copy(env.Stdout, f)
+			return err
+		}
+	}
+
+	if fromStart {
+		lineNo := 0
+		var werr error
+		err := eachLine(r, func(line string) bool {
+			if lineNo++; lineNo >= n {
+				_, werr = io.WriteString(env.Stdout, line)
+			}
+			return werr == nil
+		})
+		if werr != nil {
+			return werr
+		}
+		return err
+	}
+
+	// Streams are read to the end, keeping only the last n lines.
+	if n == 0 {
+		_, err := io.Copy(io.Discard, r)
+		return err
+	}
+	ring := make([]string, 0, n)
+	next := 0
+	err := eachLine(r, func(line string) bool {
+		if len(ring) < n {
+			ring = append(ring, line)
+		} else {
+			ring[next] = line
+			next = (next + 1) % n
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	for _, line := range append(ring[next:], ring[:next]...) {
+		if _, err := io.WriteString(env.Stdout, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// followInterval is how often tail -f checks its files for new data.
+const followInterval = 250 * time.Millisecond
+
+// tail [-f] [-n [+]lines] [file ...]
+func handleTail(env *Env, args []string) int {
+	opts, files, err := getopt(numericShorthand(args), "n:f")
+	if err != nil {
+		fmt.Fprintf(env.Stderr, "tail: %v\n", err)
+		return 1
+	}
+	lines, fromStart := 10, false
+	if v, ok := opts['n']; ok {
+		fromStart = strings.HasPrefix(v, "+")
+		if lines, err = strconv.Atoi(strings.TrimPrefix(v, "+")); err != nil || lines < 0 {
+			fmt.Fprintf(env.Stderr, "tail: invalid number of lines: %s\n", v)
+			return 1
+		}
+	}
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+
+	status := 0
+	var followed []*os.File
+	var names []string
+	for i, name := range files {
+		r, done, err := openInput(env, name)
+		if err != nil {
+			fmt.Fprintf(env.Stderr, "tail: %v\n", err)
+			status = 1
+			continue
+		}
+		if len(files) > 1 {
+			printHeader(env, name, i == 0)
+		}
+		if err := tailLines(env, r, lines, fromStart); err != nil {
+			fmt.Fprintf(env.Stderr, "tail: %s: %v\n", name, err)
+			status = 1
+		}
+		// Following only makes sense for files; input is read to the end.
+		if f, ok := r.(*os.File); ok && opts.has('f') && name != "-" {
+			defer done()
+			followed = append(followed, f)
+			names = append(names, name)
+		} else {
+			done()
+		}
+	}
+	if len(followed) == 0 {
+		return status
+	}
+	if err := follow(env, followed, names, len(files) > 1); err != nil {
+		fmt.Fprintf(env.Stderr, "tail: %v\n", err)
+		return 1
+	}
+	return status
+}
+
+// follow prints data appended to the files until writing fails, typically
+// because the reader of a pipeline went away.
+func follow(env *Env, files []*os.File, names []string, headers bool) error {
+	last := len(files) - 1
+	for {
+		wrote := false
+		for i, f := range files {
+			offset, err := f.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return err
+			}
+			info, err := f.Stat()
+			if err != nil {
+				return err
+			}
+			if info.Size() < offset {
+				fmt.Fprintf(env.Stderr, "tail: %s: file truncated\n", names[i])
+				if _, err := f.Seek(0, io.SeekStart); err != nil {
+					return err
+				}
+			} else if info.Size() == offset {
+				continue
+			}
+			if headers && i != last {
+				printHeader(env, names[i], false)
+				last = i
+			}
+			if _, err := io.Copy(env.Stdout, f); err != nil {
+				return err
+			}
+			wrote = true
+		}
+		if !wrote {
+			time.Sleep(followInterval)
+		}
+	}
+}
+
+type wcCounts struct {
+	lines, words, chars, bytes int64
+}
+
+// countWc counts the input as UTF-8: words are separated by Unicode white
+// space and bytes that are not valid UTF-8 are not counted as characters.
+func countWc(r io.Reader) (wcCounts, error) {
+	var c wcCounts
+	inWord := false
+	buf := make([]byte, 32*1024)
+	carry := 0
+	for {
+		n, err := r.Read(buf[carry:])
+		c.bytes += int64(n)
+		data := buf[:carry+n]
+		carry = 0
+		for len(data) > 0 {
+			if err == nil && !utf8.FullRune(data) {
+				// The rest of the character comes with the next read.
+				carry = copy(buf, data)
+				break
+			}
+			ch, size := utf8.DecodeRune(data)
+			data = data[size:]
+			if ch == '\n' {
+				c.lines++
+			}
+			if ch != utf8.RuneError || size > 1 {
+				c.chars++
+			}
+			if unicode.IsSpace(ch) {
+				inWord = false
+			} else if !inWord {
+				inWord = true
+				c.words++
+			}
+		}
+		if err == io.EOF {
+			return c, nil
+		}
+		if err != nil {
+			return c, err
+		}
+	}
+}
+
+// wc [-lwmc] [file ...]
+func handleWc(env *Env, args []string) int {
+	opts, files, err := getopt(args, "lwmc")
+	if err != nil {
+		fmt.Fprintf(env.Stderr, "wc: %v\n", err)
+		return 1
+	}
+	if len(opts) == 0 {
+		opts = options{'l': "", 'w': "", 'c': ""}
+	}
+	named := len(files) > 0
+	if !named {
+		files = []string{"-"}
+	}
+
+	status := 0
+	var results []wcCounts
+	var labels []string
+	var total wcCounts
+	for _, name := range files {
+		r, done, err := openInput(env, name)
+		if err != nil {
+			fmt.Fprintf(env.Stderr, "wc: %v\n", err)
+			status = 1
+			continue
+		}
+		c, err := countWc(r)
+		done()
+		if err != nil {
+			fmt.Fprintf(env.Stderr, "wc: %s: %v\n", name, err)
+			status = 1
+			continue
+		}
+		results = append(results, c)
+		labels = append(labels, name)
+		total.lines += c.lines
+		total.words += c.words
+		total.chars += c.chars
+		total.bytes += c.bytes
+	}
+	if len(files) > 1 {
+		results = append(results, total)
+		labels = append(labels, "total")
+	}
+
+	// Columns are as wide as the largest count printed.
+	columns := func(c wcCounts) []int64 {
+		var counts []int64
+		for _, f := range []struct {
+			flag  byte
+			count int64
+		}{{'l', c.lines}, {'w', c.words}, {'m', c.chars}, {'c', c.bytes}} {
+			if opts.has(f.flag) {
+				counts = append(counts, f.count)
+			}
+		}
+		return counts
+	}
+	width := len(strconv.FormatInt(slices.Max(columns(total)), 10))
+	for i, c := range results {
+		var fields []string
+		for _, count := range columns(c) {
+			fields = append(fields, fmt.Sprintf("%*d", width, count))
+		}
+		if named {
+			fields = append(fields, labels[i])
+		}
+		fmt.Fprintln(env.Stdout, strings.Join(fields, " "))
+	}
+	return status
+}
+
+// sortKey returns fields start to end (1-based, end 0 meaning the end of the
+// line) of line. Fields are separated by sep, or by runs of blanks when sep
+// is empty, in which case the leading blanks belong to the field.
+func sortKey(line string, start, end int, sep string) string {
+	if sep != "" {
+		fields := strings.Split(line, sep)
+		if start > len(fields) {
+			return ""
+		}
+		if end == 0 || end > len(fields) {
+			end = len(fields)
+		}
+		if end < start {
+			return ""
+		}
+		return strings.Join(fields[start-1:end], sep)
+	}
+
+	// Find where each field begins.
+	var bounds []int
+	for i := 0; i < len(line); {
+		bounds = append(bounds, i)
+		for i < len(line) && (line[i] == ' ' || line[i] == '\t') {
+			i++
+		}
+		for i < len(line) && line[i] != ' ' && line[i] != '\t' {
+			i++
+		}
+	}
+	bounds = append(bounds, len(line))
+	fields := len(bounds) - 1
+	if start > fields {
+		return ""
+	}
+	if end == 0 || end > fields {
+		end = fields
+	}
+	if end < start {
+		return ""
+	}
+	return line[bounds[start-1]:bounds[end]]
+}
+
+var leadingNumber = regexp.MustCompile(`^[-+]?(\d+\.?\d*|\.\d+)`)
+
+// numericValue returns the number at the start of s, ignoring leading
+// blanks; anything else sorts as zero.
+func numericValue(s string) float64 {
+	f, _ := strconv.ParseFloat(leadingNumber.FindString(strings.TrimLeft(s, " \t")), 64)
+	return f
+}
+
+// sort [-nrfu] [-t sep] [-k field[,field]] [file ...]
+func handleSort(env *Env, args []string) int {
+	opts, files, err := getopt(args, "nrfuk:t:")
+	if err != nil {
+		fmt.Fprintf(env.Stderr, "sort: %v\n", err)
+		return 1
+	}
+	start, end := 1, 0
+	if v, ok := opts['k']; ok {
+		from, to, hasTo := strings.Cut(v, ",")
+		start, err = strconv.Atoi(from)
+		if err == nil && hasTo {
+			end, err = strconv.Atoi(to)
+		}
+		if err != nil || start < 1 || end < 0 {
+			fmt.Fprintf(env.Stderr, "sort: invalid key: %s\n", v)
+			return 1
+		}
+	}
+	sep := opts['t']
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+
+	status := 0
+	var lines []string
+	for _, name := range files {
+		r, done, err := openInput(env, name)
+		if err != nil {
+			fmt.Fprintf(env.Stderr, "sort: %v\n", err)
+			status = 1
+			continue
+		}
+		err = eachLine(r, func(line string) bool {
+			lines = append(lines, strings.TrimSuffix(line, "\n"))
+			return true
+		})
+		done()
+		if err != nil {
+			fmt.Fprintf(env.Stderr, "sort: %s: %v\n", name, err)
+			status = 1
+		}
+	}
+
+	compareKeys := func(a, b string) int {
+		ka, kb := a, b
+		if opts.has('k') || sep != "" {
+			ka, kb = sortKey(a, start, end, sep), sortKey(b, start, end, sep)
+		}
+		switch {
+		case opts.has('n'):
+			na, nb := numericValue(ka), numericValue(kb)
+			if na < nb {
+				return -1
+			} else if na > nb {
+				return 1
+			}
+			return 0
+		case opts.has('f'):
+			return strings.Compare(strings.ToLower(ka), strings.ToLower(kb))
+		}
+		return strings.Compare(ka, kb)
+	}
+	slices.SortStableFunc(lines, func(a, b string) int {
+		c := compareKeys(a, b)
+		// Lines with equal keys fall back to comparing whole lines.
+		if c == 0 && !opts.has('u') {
+			c = strings.Compare(a, b)
+		}
+		if opts.has('r') {
+			c = -c
+		}
+		return c
+	})
+
+	for i, line := range lines {
+		if opts.has('u') && i > 0 && compareKeys(lines[i-1], line) == 0 {
+			continue
+		}
+		if _, err := fmt.Fprintln(env.Stdout, line); err != nil {
+			return 1
+		}
+	}
+	return status
+}
+
+// uniq [-cdui] [file]
+func handleUniq(env *Env, args []string) int {
+	opts, files, err := getopt(args, "cdui")
+	if err != nil {
+		fmt.Fprintf(env.Stderr, "uniq: %v\n", err)
+		return 1
+	}
+	if len(files) > 1 {
+		fmt.Fprintln(env.Stderr, "uniq: too many arguments")
+		return 1
+	}
+	name := "-"
+	if len(files) == 1 {
+		name = files[0]
+	}
+	r, done, err := openInput(env, name)
+	if err != nil {
+		fmt.Fprintf(env.Stderr, "uniq: %v\n", err)
+		return 1
+	}
+	defer done()
+
+	var current string
+	count := 0
+	var werr error
+	flush := func() {
+		if count == 0 || opts.has('d') && count == 1 || opts.has('u') && count > 1 {
+			return
+		}
+		if opts.has('c') {
+			_, werr = fmt.Fprintf(env.Stdout, "%7d %s\n", count, current)
+		} else {
+			_, werr = fmt.Fprintln(env.Stdout, current)
+		}
+	}
+	err = eachLine(r, func(line string) bool {
+		line = strings.TrimSuffix(line, "\n")
+		if count > 0 && (line == current || opts.has('i') && strings.EqualFold(line, current)) {
+			count++
+			return true
+		}
+		flush()
+		current, count = line, 1
+		return werr == nil
+	})
+	if werr == nil {
+		flush()
+	}
+	if err == nil {
+		err = werr
+	}
+	if err != nil {
+		fmt.Fprintf(env.Stderr, "uniq: %v\n", err)
+		return 1
+	}
+	return 0
+}
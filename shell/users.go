@@ -0,0 +1,322 @@
+package shell
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// User Management
+func handleAddUser(env *Env, args []string) int {
+	currentUser := env.Shell.User()
+	if len(args) < 1 || len(args) > 2 {
+		fmt.Fprintln(env.Stderr, "adduser: invalid arguments")
+		return 1
+	}
+	username := args[0]
+	var password string
+	if len(args) == 2 {
+		password = args[1]
+	} else {
+		var err error
+		password, err = promptNewPassword(env)
+		if err != nil {
+			fmt.Fprintf(env.Stderr, "adduser: %v\n", err)
+			return 1
+		}
+	}
+
+	if err := env.Shell.policy.check(password); err != nil {
+		printPolicyViolations(env.Stderr, "adduser", err)
+		return 1
+	}
+
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		fmt.Fprintf(env.Stderr, "Error creating user: %v\n", err)
+		return 1
+	}
+
+	// The first account becomes the administrator. The role is chosen in the
+	// insert itself, so that concurrent sessions cannot both get it.
+	res, err := env.Shell.db.Exec(`
+		INSERT INTO users (username, password_hash, role)
+		SELECT ?, ?, CASE WHEN EXISTS (SELECT 1 FROM users) THEN ? ELSE ? END
+		WHERE true
+		ON CONFLICT (username) DO NOTHING
+	`, username, hashed, roleUser, roleAdmin)
+	var added int64
+	if err == nil {
+		added, err = res.RowsAffected()
+	}
+	var role string
+	if err == nil && added > 0 {
+		err = env.Shell.db.QueryRow("SELECT role FROM users WHERE username = ?", username).Scan(&role)
+	}
+	switch {
+	case err != nil:
+		env.Shell.audit(currentUser, "adduser", username, false, err.Error())
+		fmt.Fprintf(env.Stderr, "adduser: %v\n", err)
+		return 1
+	case added == 0:
+		env.Shell.audit(currentUser, "adduser", username, false, "duplicate username")
+		fmt.Fprintln(env.Stderr, "duplicate user exists with this username")
+		return 1
+	}
+	env.Shell.audit(currentUser, "adduser", username, true, "role "+role)
+	fmt.Fprintln(env.Stdout, "user created successfully")
+	return 0
+}
+
+func handleLogin(env *Env, args []string) int {
+	if len(args) < 1 || len(args) > 2 {
+		fmt.Fprintln(env.Stderr, "login: invalid arguments")
+		return 1
+	}
+	username := args[0]
+	var password string
+	if len(args) == 2 {
+		password = args[1]
+	} else {
+		var err error
+		password, err = readPassword(env, "Password: ")
+		if err != nil {
+			fmt.Fprintf(env.Stderr, "login: %v\n", err)
+			return 1
+		}
+	}
+
+	now := time.Now()
+	wait, err := env.Shell.limits.wait(env.Shell.db, username, now)
+	if err != nil {
+		fmt.Fprintf(env.Stderr, "login: %v\n", err)
+		return 1
+	}
+	if wait > 0 {
+		env.Shell.audit(username, "login", username, false, "locked out")
+		msg := fmt.Sprintf("login: too many failed attempts, try again in %v", wait.Round(time.Second))
+		fmt.Fprintln(env.Stderr, msg)
+		return 1
+	}
+
+	// The same message is used for unknown users and wrong passwords so that
+	// login cannot be used to probe for existing usernames.
+	if err := verifyPassword(env.Shell.db, username, password); err != nil {
+		if err := recordLoginAttempt(env.Shell.db, username, false, now); err != nil {
+			fmt.Fprintf(env.Stderr, "login: %v\n", err)
+		}
+		env.Shell.audit(username, "login", username, false, "invalid username or password")
+		fmt.Fprintln(env.Stderr, "login: invalid username or password")
+		return 1
+	}
+
+	previous, hasPrevious, err := lastLogin(env.Shell.db, username)
+	if err != nil {
+		fmt.Fprintf(env.Stderr, "login: %v\n", err)
+	}
+	if err := recordLoginAttempt(env.Shell.db, username, true, now); err != nil {
+		fmt.Fprintf(env.Stderr, "login: %v\n", err)
+	}
+	env.Shell.audit(username, "login", username, true, "")
+
+	env.Shell.switchUser(username, "login")
+	fmt.Fprintln(env.Stdout, "login successful")
+	if hasPrevious {
+		fmt.Fprintf(env.Stdout, "Last login: %s\n", previous.Local().Format(time.ANSIC))
+	}
+	return 0
+}
+
+func handleLogout(env *Env, args []string) int {
+	env.Shell.switchUser("", "logout")
+	return 0
+}
+
+func handlePasswd(env *Env, args []string) int {
+	currentUser := env.Shell.User()
+	if len(args) != 0 {
+		fmt.Fprintln(env.Stderr, "passwd: too many arguments")
+		return 1
+	}
+	if currentUser == "" {
+		fmt.Fprintln(env.Stderr, "passwd: not logged in")
+		return 1
+	}
+
+	current, err := readPassword(env, "Current password: ")
+	if err != nil {
+		fmt.Fprintf(env.Stderr, "passwd: %v\n", err)
+		return 1
+	}
+	if err := env.Shell.confirmPassword(currentUser, current); err != nil {
+		env.Shell.audit(currentUser, "passwd", currentUser, false, err.Error())
+		fmt.Fprintf(env.Stderr, "passwd: %v\n", err)
+		return 1
+	}
+
+	password, err := promptNewPassword(env)
+	if err != nil {
+		fmt.Fprintf(env.Stderr, "passwd: %v\n", err)
+		return 1
+	}
+
+	if err := env.Shell.policy.check(password); err != nil {
+		printPolicyViolations(env.Stderr, "passwd", err)
+		return 1
+	}
+
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		fmt.Fprintf(env.Stderr, "passwd: %v\n", err)
+		return 1
+	}
+
+	_, err = env.Shell.db.Exec("UPDATE users SET password_hash = ? WHERE username = ?", hashed, currentUser)
+	if err != nil {
+		fmt.Fprintf(env.Stderr, "passwd: %v\n", err)
+		return 1
+	}
+	env.Shell.audit(currentUser, "passwd", currentUser, true, "")
+	fmt.Fprintln(env.Stdout, "password updated successfully")
+	return 0
+}
+
+func handleDelUser(env *Env, args []string) int {
+	currentUser := env.Shell.User()
+	if len(args) != 1 {
+		fmt.Fprintln(env.Stderr, "deluser: invalid arguments")
+		return 1
+	}
+	username := args[0]
+
+	if currentUser == "" {
+		fmt.Fprintln(env.Stderr, "deluser: not logged in")
+		return 1
+	}
+
+	var targetRole string
+	err := env.Shell.db.QueryRow("SELECT role FROM users WHERE username = ?", username).Scan(&targetRole)
+	if err != nil {
+		fmt.Fprintln(env.Stderr, "deluser: user not found")
+		return 1
+	}
+	if targetRole == roleAdmin {
+		var admins int
+		if err := env.Shell.db.QueryRow("SELECT COUNT(*) FROM users WHERE role = ?", roleAdmin).Scan(&admins); err != nil {
+			fmt.Fprintf(env.Stderr, "deluser: %v\n", err)
+			return 1
+		}
+		if admins == 1 {
+			fmt.Fprintln(env.Stderr, "deluser: cannot delete the last admin")
+			return 1
+		}
+	}
+
+	// Confirm with the password of whoever is running the command.
+	password, err := readPassword(env, "Password: ")
+	if err != nil {
+		fmt.Fprintf(env.Stderr, "deluser: %v\n", err)
+		return 1
+	}
+	if err := env.Shell.confirmPassword(currentUser, password); err != nil {
+		env.Shell.audit(currentUser, "deluser", username, false, err.Error())
+		fmt.Fprintf(env.Stderr, "deluser: %v\n", err)
+		return 1
+	}
+
+	if err := deleteUser(env.Shell.db, username); err != nil {
+		fmt.Fprintf(env.Stderr, "deluser: %v\n", err)
+		return 1
+	}
+	env.Shell.audit(currentUser, "deluser", username, true, "")
+	if username == currentUser {
+		env.Shell.switchUser("", "deleted")
+	}
+	fmt.Fprintln(env.Stdout, "user deleted successfully")
+	return 0
+}
+
+func handleUsers(env *Env, args []string) int {
+	currentUser := env.Shell.User()
+	if currentUser == "" {
+		fmt.Fprintln(env.Stderr, "users: not logged in")
+		return 1
+	}
+
+	rows, err := env.Shell.db.Query("SELECT username FROM users ORDER BY username")
+	if err != nil {
+		fmt.Fprintf(env.Stderr, "users: %v\n", err)
+		return 1
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var username string
+		if err := rows.Scan(&username); err != nil {
+			fmt.Fprintf(env.Stderr, "users: %v\n", err)
+			continue
+		}
+		fmt.Fprintln(env.Stdout, username)
+	}
+	return 0
+}
+
+func handleWhoami(env *Env, args []string) int {
+	currentUser := env.Shell.User()
+	if currentUser == "" {
+		fmt.Fprintln(env.Stderr, "whoami: not logged in")
+		return 1
+	}
+	fmt.Fprintln(env.Stdout, currentUser)
+	return 0
+}
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     []byte
+)
+
+// verifyPassword compares password against the stored hash of username. For
+// unknown users a dummy hash is compared instead, so both failures take about
+// the same time.
+func verifyPassword(db *sql.DB, username, password string) error {
+	var storedHash string
+	err := db.QueryRow("SELECT password_hash FROM users WHERE username = ?", username).Scan(&storedHash)
+	if err == sql.ErrNoRows {
+		dummyHashOnce.Do(func() {
+			dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+		})
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	return bcrypt.CompareHashAndPassword([]byte(storedHash), []byte(password))
+}
+
+// deleteUser removes a user together with their command history.
+func deleteUser(db *sql.DB, username string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM command_history WHERE username = ?", username); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM sessions WHERE username = ?", username); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM login_attempts WHERE username = ?", username); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM users WHERE username = ?", username); err != nil {
+		return err
+	}
+	return tx.Commit()
+}